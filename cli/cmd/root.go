@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spawn08/chronos/cli/repl"
 	"github.com/spawn08/chronos/engine/graph"
+	"github.com/spawn08/chronos/engine/model"
 	chronosos "github.com/spawn08/chronos/os"
 	"github.com/spawn08/chronos/sdk/agent"
 	"github.com/spawn08/chronos/sdk/team"
@@ -37,6 +39,8 @@ func Execute() error {
 		return runTeamCmd()
 	case "sessions":
 		return runSessions()
+	case "graph":
+		return runGraphCmd()
 	case "memory":
 		return runMemory()
 	case "db":
@@ -69,9 +73,11 @@ Commands:
   team list                 List teams defined in config
   team run <id> <message>   Run a multi-agent team on a task
   team show <id>            Show team configuration details
-  sessions                  Session management (list, resume, export)
+  sessions                  Session management (list, resume, export, runs)
+  graph render <agent_id>   Render an agent's graph (--format mermaid|dot, --session, --run)
+  graph check <agent_id>    List unfinished runs the agent's graph cannot resume
   memory                    Memory management (list, forget, clear)
-  db                        Database operations (init, status)
+  db                        Database operations (init, status, compact)
   config                    Configuration (show)
   version                   Print version
   help                      Show this help
@@ -124,7 +130,13 @@ func loadAgentByID(idOrName string) (*agent.Agent, error) {
 	if err != nil {
 		return nil, err
 	}
-	return agent.BuildAgent(context.Background(), cfg)
+	// Build the whole file so that sub-agents, and the graph nodes that
+	// call them, are wired
+	agents, err := agent.BuildAll(context.Background(), fc)
+	if err != nil {
+		return nil, err
+	}
+	return agents[cfg.ID], nil
 }
 
 // loadDefaultAgent loads the first agent from YAML config.
@@ -136,7 +148,11 @@ func loadDefaultAgent() (*agent.Agent, error) {
 	if len(fc.Agents) == 0 {
 		return nil, fmt.Errorf("no agents defined in config")
 	}
-	return agent.BuildAgent(context.Background(), &fc.Agents[0])
+	agents, err := agent.BuildAll(context.Background(), fc)
+	if err != nil {
+		return nil, err
+	}
+	return agents[fc.Agents[0].ID], nil
 }
 
 func runREPL() error {
@@ -168,6 +184,18 @@ func runServe() error {
 		return err
 	}
 	srv := chronosos.New(addr, store)
+	// Expose the graphs defined in agents.yaml to the graph endpoints
+	if fc, err := loadAgentConfig(); err == nil {
+		agents, err := agent.BuildAll(context.Background(), fc)
+		if err != nil {
+			log.Printf("skipping graphs: %v", err)
+		}
+		for _, cfg := range fc.Agents {
+			if a := agents[cfg.ID]; a != nil && a.Graph != nil {
+				srv.RegisterGraph(a.Graph)
+			}
+		}
+	}
 	log.Printf("Starting ChronosOS on %s", addr)
 	return srv.Start(context.Background())
 }
@@ -209,11 +237,15 @@ func runAgent() error {
 	fmt.Printf("Agent: %s (model: %s)\n", a.Name, a.Model.Name())
 	fmt.Printf("Message: %s\n\n", message)
 
-	resp, err := a.Chat(context.Background(), message)
+	var resp *model.ChatResponse
+	if a.Stream {
+		resp, err = repl.ChatStream(context.Background(), a, message, os.Stdout)
+	} else if resp, err = a.Chat(context.Background(), message); err == nil {
+		fmt.Println(resp.Content)
+	}
 	if err != nil {
 		return fmt.Errorf("chat: %w", err)
 	}
-	fmt.Println(resp.Content)
 	if resp.Usage.PromptTokens > 0 || resp.Usage.CompletionTokens > 0 {
 		fmt.Printf("\n[tokens: %d prompt + %d completion]\n", resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
 	}
@@ -568,8 +600,13 @@ func runSessions() error {
 			return fmt.Errorf("usage: chronos sessions export <session_id>")
 		}
 		return sessionsExport(ctx, store, os.Args[3])
+	case "runs":
+		if len(os.Args) < 4 {
+			return fmt.Errorf("usage: chronos sessions runs <session_id>")
+		}
+		return sessionsRuns(ctx, store, os.Args[3])
 	default:
-		return fmt.Errorf("unknown sessions subcommand: %s\nUsage: chronos sessions [list|resume|export]", sub)
+		return fmt.Errorf("unknown sessions subcommand: %s\nUsage: chronos sessions [list|resume|export|runs]", sub)
 	}
 }
 
@@ -611,6 +648,129 @@ func sessionsExport(ctx context.Context, store storage.Storage, sessionID string
 	return nil
 }
 
+func sessionsRuns(ctx context.Context, store storage.Storage, sessionID string) error {
+	roots, err := graph.RunTree(ctx, store, sessionID)
+	if err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		fmt.Println("No runs found.")
+		return nil
+	}
+	var printRuns func(runs []*graph.RunInfo, depth int)
+	printRuns = func(runs []*graph.RunInfo, depth int) {
+		for _, r := range runs {
+			indent := strings.Repeat("  ", depth)
+			from := ""
+			if r.ParentCheckpointID != "" {
+				from = " (forked from " + r.ParentCheckpointID + ")"
+			}
+			fmt.Printf("%s%s  %d checkpoints, last node %s, started %s%s\n",
+				indent, r.RunID, r.Checkpoints, r.LastNode, r.StartedAt.Format(time.RFC3339), from)
+			printRuns(r.Forks, depth+1)
+		}
+	}
+	printRuns(roots, 0)
+	return nil
+}
+
+// --- graph subcommands ---
+
+func runGraphCmd() error {
+	if len(os.Args) > 2 && os.Args[2] == "check" {
+		return runGraphCheck()
+	}
+	if len(os.Args) < 3 || os.Args[2] != "render" {
+		return fmt.Errorf("usage: chronos graph render <agent_id> [--format mermaid|dot] [--session <id>] [--run <id>]")
+	}
+	agentID, format, sessionID, runID := "", "mermaid", "", ""
+	args := os.Args[3:]
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--format" && i+1 < len(args):
+			format = args[i+1]
+			i++
+		case args[i] == "--session" && i+1 < len(args):
+			sessionID = args[i+1]
+			i++
+		case args[i] == "--run" && i+1 < len(args):
+			runID = args[i+1]
+			i++
+		default:
+			agentID = args[i]
+		}
+	}
+	if agentID == "" {
+		return fmt.Errorf("usage: chronos graph render <agent_id> [--format mermaid|dot] [--session <id>] [--run <id>]")
+	}
+
+	a, err := loadAgentByID(agentID)
+	if err != nil {
+		return err
+	}
+	if a.Graph == nil {
+		return fmt.Errorf("agent %q has no graph", agentID)
+	}
+	var path *graph.RunPath
+	if sessionID != "" {
+		store := a.Storage
+		if store == nil {
+			s, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			store = s
+		}
+		if path, err = graph.LoadRunPath(context.Background(), store, sessionID, runID); err != nil {
+			return err
+		}
+	}
+	out, err := a.Graph.Render(format, path)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+// runGraphCheck lists the paused and unfinished runs in storage that the
+// agent's current graph cannot resume, and fails if there are any.
+func runGraphCheck() error {
+	if len(os.Args) < 4 {
+		return fmt.Errorf("usage: chronos graph check <agent_id>")
+	}
+	agentID := os.Args[3]
+	a, err := loadAgentByID(agentID)
+	if err != nil {
+		return err
+	}
+	if a.Graph == nil {
+		return fmt.Errorf("agent %q has no graph", agentID)
+	}
+	store := a.Storage
+	if store == nil {
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		store = s
+	}
+	stranded, err := a.Graph.CheckRuns(context.Background(), store)
+	if err != nil {
+		return err
+	}
+	if len(stranded) == 0 {
+		fmt.Printf("All unfinished runs can be resumed by graph %q version %q.\n", a.Graph.ID, a.Graph.Version)
+		return nil
+	}
+	for _, s := range stranded {
+		fmt.Printf("%s\t%s\tversion %q\t%v\n", s.SessionID, s.RunID, s.Version, s.Err)
+	}
+	return fmt.Errorf("%d runs cannot be resumed by graph %q version %q", len(stranded), a.Graph.ID, a.Graph.Version)
+}
+
 // --- memory subcommands ---
 
 func runMemory() error {
@@ -715,9 +875,56 @@ func runDB() error {
 		sessions, _ := store.ListSessions(context.Background(), "", 1000, 0)
 		fmt.Printf("Sessions: %d\n", len(sessions))
 		return nil
+	case "compact":
+		return runDBCompact(os.Args[3:])
 	default:
-		return fmt.Errorf("unknown db subcommand: %s\nUsage: chronos db [init|status]", sub)
+		return fmt.Errorf("unknown db subcommand: %s\nUsage: chronos db [init|status|compact]", sub)
+	}
+}
+
+const dbCompactUsage = "usage: chronos db compact [--keep-last N] [--keep-interrupts] [--ttl duration]"
+
+// runDBCompact deletes the checkpoints the retention flags do not keep and
+// rewrites the rest as state diffs.
+func runDBCompact(args []string) error {
+	var policy graph.RetentionPolicy
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--keep-last" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid --keep-last %q\n%s", args[i+1], dbCompactUsage)
+			}
+			policy.KeepLast = n
+			i++
+		case args[i] == "--keep-interrupts":
+			policy.KeepInterrupts = true
+		case args[i] == "--ttl" && i+1 < len(args):
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid --ttl %q\n%s", args[i+1], dbCompactUsage)
+			}
+			policy.MaxAge = d
+			i++
+		default:
+			return fmt.Errorf("unknown argument %q\n%s", args[i], dbCompactUsage)
+		}
 	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ctx := context.Background()
+	report, err := graph.CompactCheckpoints(ctx, store, policy)
+	if err != nil {
+		return err
+	}
+	if err := store.Vacuum(ctx); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	fmt.Printf("Compacted %d sessions: %d checkpoints kept, %d deleted.\n", report.Sessions, report.Kept, report.Deleted)
+	return nil
 }
 
 func humanizeBytes(b int64) string {
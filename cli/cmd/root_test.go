@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -427,3 +428,48 @@ func TestExecuteTeamCommand(t *testing.T) {
 		}
 	})
 }
+
+func TestLoadAgentWiresSubAgents(t *testing.T) {
+	yaml := `
+agents:
+  - id: boss
+    name: Boss
+    model:
+      provider: ollama
+    storage:
+      backend: none
+    sub_agents: [worker]
+    graph:
+      nodes:
+        - id: delegate
+          kind: agent
+          agent: worker
+      edges:
+        - from: delegate
+          to: end
+  - id: worker
+    name: Worker
+    model:
+      provider: ollama
+    storage:
+      backend: none
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("write test config: %v", err)
+	}
+	t.Setenv("CHRONOS_CONFIG", path)
+
+	for name, load := range map[string]func() (*agent.Agent, error){
+		"by id":   func() (*agent.Agent, error) { return loadAgentByID("Boss") },
+		"default": loadDefaultAgent,
+	} {
+		a, err := load()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if a.ID != "boss" || len(a.SubAgents) != 1 || a.SubAgents[0].ID != "worker" || a.Graph == nil {
+			t.Errorf("%s: expected boss with its graph and sub-agent worker, got %+v", name, a)
+		}
+	}
+}
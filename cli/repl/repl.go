@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -274,14 +275,24 @@ func (r *REPL) Start() error {
 }
 
 func (r *REPL) chatWithAgent(message string) {
-	resp, err := r.agent.Chat(r.ctx, message)
+	var resp *model.ChatResponse
+	var err error
+	if r.agent.Stream {
+		fmt.Println()
+		resp, err = ChatStream(r.ctx, r.agent, message, os.Stdout)
+		fmt.Println()
+	} else {
+		resp, err = r.agent.Chat(r.ctx, message)
+		if err == nil {
+			fmt.Println()
+			fmt.Println(resp.Content)
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
 	fmt.Println()
-	fmt.Println(resp.Content)
-	fmt.Println()
 	if resp.Usage.PromptTokens > 0 || resp.Usage.CompletionTokens > 0 {
 		fmt.Printf("[tokens: %d prompt + %d completion]\n", resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
 	}
@@ -303,3 +314,31 @@ func (r *REPL) execShell(cmdStr string) {
 
 // Ensure model is imported (used by SetAgent for type checking)
 var _ model.Provider
+
+// ChatStream sends message to a with Agent.ChatStream, printing the answer
+// to w as it arrives and a line for every tool call, and returns the final
+// response.
+func ChatStream(ctx context.Context, a *agent.Agent, message string, w io.Writer) (*model.ChatResponse, error) {
+	events, err := a.ChatStream(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	for evt := range events {
+		switch evt.Type {
+		case agent.StreamDelta:
+			fmt.Fprint(w, evt.Delta)
+		case agent.StreamToolCallStart:
+			fmt.Fprintf(w, "\n[tool] %s %s\n", evt.ToolCall.Name, evt.ToolCall.Arguments)
+		case agent.StreamToolCallEnd:
+			if evt.Err != nil {
+				fmt.Fprintf(w, "[tool] %s failed: %v\n", evt.ToolCall.Name, evt.Err)
+			}
+		case agent.StreamError:
+			return nil, evt.Err
+		case agent.StreamDone:
+			fmt.Fprintln(w)
+			return evt.Response, nil
+		}
+	}
+	return nil, ctx.Err()
+}
@@ -3,12 +3,14 @@ package repl
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/spawn08/chronos/engine/model"
 	"github.com/spawn08/chronos/sdk/agent"
 	"github.com/spawn08/chronos/storage"
 	"github.com/spawn08/chronos/storage/adapters/sqlite"
@@ -295,3 +297,36 @@ func TestSlashAgentInfo(t *testing.T) {
 		}
 	}
 }
+
+// streamProvider streams a fixed answer in two chunks.
+type streamProvider struct{}
+
+func (streamProvider) Chat(context.Context, *model.ChatRequest) (*model.ChatResponse, error) {
+	return nil, errors.New("not supported")
+}
+
+func (streamProvider) StreamChat(context.Context, *model.ChatRequest) (<-chan *model.ChatResponse, error) {
+	ch := make(chan *model.ChatResponse, 2)
+	ch <- &model.ChatResponse{Content: "Hello, ", Delta: true}
+	ch <- &model.ChatResponse{Content: "world.", Delta: true}
+	close(ch)
+	return ch, nil
+}
+
+func (streamProvider) Name() string  { return "stream" }
+func (streamProvider) Model() string { return "stream" }
+
+func TestChatStream(t *testing.T) {
+	a, err := agent.New("streamer", "Streamer").WithModel(streamProvider{}).WithStream(true).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	var buf bytes.Buffer
+	resp, err := ChatStream(context.Background(), a, "hi", &buf)
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+	if buf.String() != "Hello, world.\n" || resp.Content != "Hello, world." {
+		t.Errorf("unexpected output %q, response %q", buf.String(), resp.Content)
+	}
+}
@@ -0,0 +1,161 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Checkpoint metadata keys written when a run is cancelled.
+const (
+	metaCancelled = "cancelled" // the checkpoint written on cancellation
+	// metaUnfinished marks a cancellation during a fan-out or a map node,
+	// whose branches or items have recorded their own progress.
+	metaUnfinished = "unfinished"
+)
+
+// ErrCancelled is the cause of the context of a run stopped with Cancel.
+var ErrCancelled = errors.New("run cancelled")
+
+// ErrNotRunning is returned when cancelling a run that is not executing in
+// this process.
+var ErrNotRunning = errors.New("run is not running")
+
+// activeRun is a run executing in this process.
+type activeRun struct {
+	hub    *streamHub // identifies the runner that executes the run
+	cancel context.CancelCauseFunc
+}
+
+var (
+	activeMu   sync.Mutex
+	activeRuns = make(map[string]*activeRun)
+)
+
+// Cancel stops the run runID executed by this runner. The node that is
+// running sees its context cancelled with ErrCancelled as the cause. The
+// run then records a final checkpoint before that node and a run_cancelled
+// event, marks its session cancelled and returns with RunStatusCancelled.
+// Resuming the session later runs the interrupted node again.
+func (r *Runner) Cancel(runID string) error {
+	activeMu.Lock()
+	run := activeRuns[runID]
+	activeMu.Unlock()
+	if run == nil || run.hub != r.hub {
+		return fmt.Errorf("cancel %q: %w", runID, ErrNotRunning)
+	}
+	run.cancel(ErrCancelled)
+	return nil
+}
+
+// CancelRun stops the run runID, whichever runner of this process executes
+// it. See Runner.Cancel.
+func CancelRun(runID string) error {
+	activeMu.Lock()
+	run := activeRuns[runID]
+	activeMu.Unlock()
+	if run == nil {
+		return fmt.Errorf("cancel %q: %w", runID, ErrNotRunning)
+	}
+	run.cancel(ErrCancelled)
+	return nil
+}
+
+// RequestCancel stops the run runID, whichever process executes it. A run
+// of this process is cancelled with CancelRun. Otherwise the request is
+// recorded in store, which must implement storage.RunCanceller, and the
+// worker that leased the run stops it before its next node. A request for
+// a run that is paused or waiting stops it when a worker resumes it.
+func RequestCancel(ctx context.Context, store storage.Storage, runID string) error {
+	if err := CancelRun(runID); err == nil {
+		return nil
+	}
+	canceller, ok := store.(storage.RunCanceller)
+	if !ok {
+		return fmt.Errorf("cancel %q: %w", runID, ErrNotRunning)
+	}
+	if err := canceller.RequestCancel(ctx, runID); err != nil {
+		return fmt.Errorf("cancel %q: %w", runID, err)
+	}
+	return nil
+}
+
+// pollCancel cancels a run leased by a worker if another process has
+// requested it with RequestCancel.
+func (r *Runner) pollCancel(ctx context.Context, rs *RunState) {
+	if r.guard == nil || r.ns != "" {
+		return
+	}
+	canceller, ok := r.store.(storage.RunCanceller)
+	if !ok {
+		return
+	}
+	if requested, err := canceller.CancelRequested(ctx, rs.RunID); err == nil && requested {
+		_ = CancelRun(rs.RunID)
+	}
+}
+
+// track registers rs as running until the returned function is called, tags
+// the runner's events with its run ID and returns the context its nodes run
+// with. Subgraph runs and replays are cancelled through their parent and are
+// not registered.
+func (r *Runner) track(ctx context.Context, rs *RunState) (context.Context, func()) {
+	if r.ns != "" || r.replay != nil {
+		return ctx, func() {}
+	}
+	r.runID = rs.RunID
+	ctx, cancel := context.WithCancelCause(ctx)
+	activeMu.Lock()
+	activeRuns[rs.RunID] = &activeRun{hub: r.hub, cancel: cancel}
+	activeMu.Unlock()
+	return ctx, func() {
+		activeMu.Lock()
+		delete(activeRuns, rs.RunID)
+		activeMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelled reports whether ctx belongs to a run stopped with Cancel.
+func cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrCancelled)
+}
+
+// abort stops a cancelled run at nodeID, with rs.State as it was before
+// the node ran. The top-level run records the cancellation in a checkpoint
+// with meta; a subgraph returns ErrCancelled so that its parent does. A run
+// cancelled during a fan-out or a map node is checkpointed at that node
+// with metaUnfinished, and a resume continues from the progress its
+// branches or items recorded.
+func (r *Runner) abort(ctx context.Context, rs *RunState, nodeID string, meta map[string]any) (*RunState, error) {
+	rs.Status = RunStatusCancelled
+	if r.ns != "" {
+		return rs, ErrCancelled
+	}
+	// The records are written after the run's context was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	r.emit(StreamEvent{Type: "cancelled", NodeID: nodeID, State: rs.State})
+	meta[metaCancelled] = true
+	cp, err := r.checkpoint(ctx, rs, nodeID, rs.State, meta)
+	if err != nil {
+		return rs, fmt.Errorf("checkpoint on cancel: %w", err)
+	}
+	if canceller, ok := r.store.(storage.RunCanceller); ok {
+		if err := canceller.ClearCancel(ctx, rs.RunID); err != nil {
+			return rs, fmt.Errorf("cancel: clear request: %w", err)
+		}
+	}
+	r.appendEvent(ctx, rs, cp.SeqNum, "run_cancelled", map[string]any{"node": nodeID})
+	if sess, err := r.store.GetSession(ctx, rs.SessionID); err == nil {
+		sess.Status = string(RunStatusCancelled)
+		sess.UpdatedAt = time.Now()
+		if err := r.store.UpdateSession(ctx, sess); err != nil {
+			return rs, fmt.Errorf("cancel: update session: %w", err)
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,126 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Checkpoint metadata keys recorded on the first checkpoint of a forked run.
+const (
+	metaParentCheckpoint = "parent_checkpoint" // checkpoint the run was forked from
+	metaParentRun        = "parent_run"        // run that checkpoint belongs to
+)
+
+// Fork starts a new run from the given checkpoint and continues it. patch,
+// if not nil, overwrites keys of the checkpointed state first, so a run can
+// be rewound, edited and replayed. The new run gets its own run ID and
+// records the checkpoint it was forked from; the original run's history is
+// left untouched. A fork of a run paused at an interrupt pauses there again,
+// to be resumed with ResumeWith.
+func (r *Runner) Fork(ctx context.Context, checkpointID string, patch State) (*RunState, error) {
+	parent, err := r.store.GetCheckpoint(ctx, checkpointID)
+	if err != nil {
+		return nil, fmt.Errorf("fork: %w", err)
+	}
+	if parent, err = r.graph.migrate(parent); err != nil {
+		return nil, fmt.Errorf("fork: %w", err)
+	}
+	if _, ok := parent.Metadata[metaBranch]; ok {
+		return nil, fmt.Errorf("fork: checkpoint %q belongs to a fan-out branch; fork from the checkpoint before the fan-out", parent.ID)
+	}
+	r, end := r.begin(parent.SessionID)
+	defer end()
+
+	state := copyState(State(parent.State))
+	for k, v := range patch {
+		state[k] = v
+	}
+	if state, err = r.graph.conform(state); err != nil {
+		return nil, fmt.Errorf("fork: %w", err)
+	}
+	meta := make(map[string]any, len(parent.Metadata)+2)
+	for k, v := range parent.Metadata {
+		// A paused subgraph run belongs to the original run; the fork
+		// starts the subgraph over. Timers are likewise set anew, and a
+		// fork of a paused run pauses again for its own human input.
+		switch k {
+		case metaSubgraph, metaWakeAt, metaInterrupt, metaPrompt:
+		default:
+			meta[k] = v
+		}
+	}
+	meta[metaParentCheckpoint] = parent.ID
+	meta[metaParentRun] = parent.RunID
+
+	rs := &RunState{
+		RunID:     newRunID(),
+		SessionID: parent.SessionID,
+		GraphID:   r.graph.ID,
+		StartedAt: time.Now(),
+	}
+	root, err := r.checkpoint(ctx, rs, parent.NodeID, state, meta)
+	if err != nil {
+		return nil, fmt.Errorf("fork: checkpoint: %w", err)
+	}
+	return r.resume(ctx, root, nil)
+}
+
+// RunInfo summarises one run of a session and the runs forked from it.
+type RunInfo struct {
+	RunID              string     `json:"run_id"`
+	ParentRunID        string     `json:"parent_run_id,omitempty"`
+	ParentCheckpointID string     `json:"parent_checkpoint_id,omitempty"`
+	LastNode           string     `json:"last_node"`
+	Checkpoints        int        `json:"checkpoints"`
+	StartedAt          time.Time  `json:"started_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	Forks              []*RunInfo `json:"forks,omitempty"`
+}
+
+// RunTree returns the runs of a session, built from its checkpoints. Runs
+// started with Run are the roots; each forked run is listed under the run it
+// was forked from. Runs are ordered by start time.
+func RunTree(ctx context.Context, store storage.Storage, sessionID string) ([]*RunInfo, error) {
+	cps, err := store.ListCheckpoints(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("run tree: %w", err)
+	}
+	runs := make(map[string]*RunInfo)
+	var order []*RunInfo
+	for _, cp := range cps {
+		info, ok := runs[cp.RunID]
+		if !ok {
+			info = &RunInfo{RunID: cp.RunID, StartedAt: cp.CreatedAt}
+			runs[cp.RunID] = info
+			order = append(order, info)
+		}
+		if p, ok := cp.Metadata[metaParentRun].(string); ok {
+			info.ParentRunID = p
+			info.ParentCheckpointID, _ = cp.Metadata[metaParentCheckpoint].(string)
+		}
+		info.Checkpoints++
+		if cp.CreatedAt.Before(info.StartedAt) {
+			info.StartedAt = cp.CreatedAt
+		}
+		if !cp.CreatedAt.Before(info.UpdatedAt) {
+			info.UpdatedAt = cp.CreatedAt
+			info.LastNode = cp.NodeID
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].StartedAt.Before(order[j].StartedAt) })
+
+	var roots []*RunInfo
+	for _, info := range order {
+		// Runs whose parent no longer has checkpoints are shown as roots.
+		if parent, ok := runs[info.ParentRunID]; ok && parent != info {
+			parent.Forks = append(parent.Forks, info)
+		} else {
+			roots = append(roots, info)
+		}
+	}
+	return roots, nil
+}
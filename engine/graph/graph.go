@@ -1,7 +1,5 @@
 package graph
 
-import "fmt"
-
 const (
 	StartNode = "__start__"
 	EndNode   = "__end__"
@@ -9,19 +7,42 @@ const (
 
 // StateGraph is a builder for defining directed graphs with durable execution.
 type StateGraph struct {
-	id    string
-	nodes map[string]*Node
-	edges []*Edge
+	id       string
+	nodes    map[string]*Node
+	edges    []*Edge
+	reducers map[string]Reducer
+	retries  map[string]RetryPolicy
+	onError  map[string]string
+
+	maxSteps  int
+	maxVisits map[string]int
+	fixpoints bool
+	schema    Schema
+
+	version    string
+	migrations []Migration
 }
 
 // New creates a new StateGraph with the given ID.
 func New(id string) *StateGraph {
 	return &StateGraph{
-		id:    id,
-		nodes: make(map[string]*Node),
+		id:       id,
+		nodes:    make(map[string]*Node),
+		reducers: make(map[string]Reducer),
+		retries:  make(map[string]RetryPolicy),
+		onError:  make(map[string]string),
+
+		maxVisits: make(map[string]int),
 	}
 }
 
+// AddReducer declares how updates to a state key are merged. Without a
+// reducer, the last value written to a key wins.
+func (g *StateGraph) AddReducer(key string, r Reducer) *StateGraph {
+	g.reducers[key] = r
+	return g
+}
+
 // AddNode registers a node with the given ID and handler function.
 func (g *StateGraph) AddNode(id string, fn NodeFunc) *StateGraph {
 	g.nodes[id] = &Node{ID: id, Fn: fn}
@@ -34,6 +55,28 @@ func (g *StateGraph) AddInterruptNode(id string, fn NodeFunc) *StateGraph {
 	return g
 }
 
+// AddInterruptNodeWithPrompt registers an interrupt node whose interrupt
+// event and paused RunState carry the payload built by prompt.
+func (g *StateGraph) AddInterruptNodeWithPrompt(id string, fn NodeFunc, prompt PromptFunc) *StateGraph {
+	g.nodes[id] = &Node{ID: id, Fn: fn, Interrupt: true, Prompt: prompt}
+	return g
+}
+
+// AddJoinNode registers a node that waits for all branches of a fan-out and
+// runs once on their merged state. reducers may be nil.
+func (g *StateGraph) AddJoinNode(id string, fn NodeFunc, reducers map[string]Reducer) *StateGraph {
+	g.nodes[id] = &Node{ID: id, Fn: fn, Join: true, Reducers: reducers}
+	return g
+}
+
+// AddSubgraph registers a node that runs sub as a nested graph. The
+// subgraph's checkpoints are stored in the same storage under a session
+// namespaced by the node, and an interrupt inside it pauses the parent run.
+func (g *StateGraph) AddSubgraph(id string, sub *CompiledGraph, input, output map[string]string) *StateGraph {
+	g.nodes[id] = &Node{ID: id, Subgraph: &Subgraph{Graph: sub, Input: input, Output: output}}
+	return g
+}
+
 // AddEdge adds a static edge from one node to another.
 func (g *StateGraph) AddEdge(from, to string) *StateGraph {
 	g.edges = append(g.edges, &Edge{From: from, To: to})
@@ -41,8 +84,32 @@ func (g *StateGraph) AddEdge(from, to string) *StateGraph {
 }
 
 // AddConditionalEdge adds a dynamic edge that routes based on state.
-func (g *StateGraph) AddConditionalEdge(from string, condition EdgeCondition) *StateGraph {
-	g.edges = append(g.edges, &Edge{From: from, Condition: condition})
+// routes optionally declares every node ID the condition may return; when
+// given, Compile checks that they exist and the runner rejects any other
+// result.
+func (g *StateGraph) AddConditionalEdge(from string, condition EdgeCondition, routes ...string) *StateGraph {
+	g.edges = append(g.edges, &Edge{From: from, Condition: condition, Routes: routes})
+	return g
+}
+
+// AddFanOut adds an edge that runs every target concurrently after from
+// completes. Each branch continues along its own edges until it reaches join.
+func (g *StateGraph) AddFanOut(from, join string, targets ...string) *StateGraph {
+	g.edges = append(g.edges, &Edge{From: from, Targets: targets, Join: join})
+	return g
+}
+
+// SetRetryPolicy sets how failed executions of a node are retried.
+func (g *StateGraph) SetRetryPolicy(nodeID string, p RetryPolicy) *StateGraph {
+	g.retries[nodeID] = p
+	return g
+}
+
+// AddErrorEdge routes the run to the recovery node to when from still fails
+// after its retries. The error is available to the recovery node under
+// ErrorKey in the state.
+func (g *StateGraph) AddErrorEdge(from, to string) *StateGraph {
+	g.onError[from] = to
 	return g
 }
 
@@ -58,41 +125,58 @@ func (g *StateGraph) SetFinishPoint(nodeID string) *StateGraph {
 
 // CompiledGraph is the immutable, validated graph ready for execution.
 type CompiledGraph struct {
-	ID      string
-	Nodes   map[string]*Node
-	AdjList map[string][]*Edge // from -> edges
-	Entry   string
+	ID       string
+	Nodes    map[string]*Node
+	AdjList  map[string][]*Edge // from -> edges
+	Entry    string
+	Reducers map[string]Reducer // state key -> reducer
+
+	MaxSteps        int  // nodes a run may execute; 0 means no limit
+	DetectFixpoints bool // fail runs that reach a node again with unchanged state
+
+	Schema Schema // types of state keys; nil leaves the state untyped
+
+	Version    string      // recorded by checkpoints; see SetVersion
+	Migrations []Migration // upgrade checkpoints of earlier versions
 }
 
-// Compile validates the graph and returns a CompiledGraph.
+// Compile validates the graph and returns a CompiledGraph. All problems
+// found are reported together in a *ValidationError.
 func (g *StateGraph) Compile() (*CompiledGraph, error) {
 	// Find entry point
 	var entry string
 	adj := make(map[string][]*Edge)
 	for _, e := range g.edges {
 		adj[e.From] = append(adj[e.From], e)
-		if e.From == StartNode {
+		if e.From == StartNode && entry == "" {
 			entry = e.To
 		}
 	}
-	if entry == "" {
-		return nil, fmt.Errorf("graph %q: no entry point set", g.id)
+	if issues := g.validate(entry, adj); len(issues) > 0 {
+		return nil, &ValidationError{GraphID: g.id, Issues: issues}
 	}
-	if _, ok := g.nodes[entry]; !ok {
-		return nil, fmt.Errorf("graph %q: entry node %q not found", g.id, entry)
+	for id, p := range g.retries {
+		g.nodes[id].Retry = &p
 	}
-	// Validate all edge targets exist
-	for _, e := range g.edges {
-		if e.To != "" && e.To != EndNode {
-			if _, ok := g.nodes[e.To]; !ok {
-				return nil, fmt.Errorf("graph %q: edge target %q not found", g.id, e.To)
-			}
-		}
+	for from, to := range g.onError {
+		g.nodes[from].OnError = to
+	}
+	for id, n := range g.maxVisits {
+		g.nodes[id].MaxVisits = n
 	}
 	return &CompiledGraph{
-		ID:      g.id,
-		Nodes:   g.nodes,
-		AdjList: adj,
-		Entry:   entry,
+		ID:       g.id,
+		Nodes:    g.nodes,
+		AdjList:  adj,
+		Entry:    entry,
+		Reducers: g.reducers,
+
+		MaxSteps:        g.maxSteps,
+		DetectFixpoints: g.fixpoints,
+
+		Schema: g.schema,
+
+		Version:    g.version,
+		Migrations: g.migrations,
 	}, nil
 }
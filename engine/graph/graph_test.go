@@ -0,0 +1,147 @@
+package graph
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompileValidation(t *testing.T) {
+	route := func(State) string { return "b" }
+
+	tests := []struct {
+		name  string
+		build func() *StateGraph
+		want  []IssueKind
+	}{
+		{
+			name: "valid",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).AddNode("b", passthrough).
+					SetEntryPoint("a").AddEdge("a", "b").SetFinishPoint("b")
+			},
+		},
+		{
+			name: "no entry",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).SetFinishPoint("a")
+			},
+			want: []IssueKind{IssueNoEntry},
+		},
+		{
+			name: "orphan and dead end",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).AddNode("orphan", passthrough).
+					SetEntryPoint("a").SetFinishPoint("a")
+			},
+			want: []IssueKind{IssueDeadEnd, IssueUnreachable},
+		},
+		{
+			name: "multiple static edges",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).AddNode("b", passthrough).AddNode("c", passthrough).
+					SetEntryPoint("a").AddEdge("a", "b").AddEdge("a", "c").
+					SetFinishPoint("b").SetFinishPoint("c")
+			},
+			want: []IssueKind{IssueMultipleEdges},
+		},
+		{
+			name: "missing conditional route",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).AddNode("b", passthrough).
+					SetEntryPoint("a").AddConditionalEdge("a", route, "b", "missing").SetFinishPoint("b")
+			},
+			want: []IssueKind{IssueMissingNode},
+		},
+		{
+			name: "error edge and retry policy on unknown nodes",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).SetEntryPoint("a").SetFinishPoint("a").
+					AddErrorEdge("a", "missing").SetRetryPolicy("b", RetryPolicy{MaxAttempts: 2})
+			},
+			want: []IssueKind{IssueMissingNode, IssueMissingNode},
+		},
+		{
+			name: "migrations that do not reach the version",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).SetEntryPoint("a").SetFinishPoint("a").
+					SetVersion("3").
+					AddMigration(Migration{From: "1", To: "2"}).
+					AddMigration(Migration{From: "2", To: "3", Nodes: map[string]string{"old": "missing"}}).
+					AddMigration(Migration{From: "x", To: "y"})
+			},
+			want: []IssueKind{IssueInvalidMigration, IssueInvalidMigration},
+		},
+		{
+			name: "undeclared routes skip reachability",
+			build: func() *StateGraph {
+				return New("g").AddNode("a", passthrough).AddNode("b", passthrough).
+					SetEntryPoint("a").AddConditionalEdge("a", route).SetFinishPoint("b")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.build().Compile()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Compile: unexpected error %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if len(verr.Issues) != len(tt.want) {
+				t.Fatalf("got issues %+v, want kinds %v", verr.Issues, tt.want)
+			}
+			for i, kind := range tt.want {
+				if verr.Issues[i].Kind != kind {
+					t.Errorf("issue %d: got %s, want %s", i, verr.Issues[i].Kind, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMarksNodesAndPath(t *testing.T) {
+	route := func(State) string { return "b" }
+	compiled, err := New("render").
+		AddNode("a", passthrough).
+		AddNode("b", passthrough).
+		AddInterruptNode("approve", passthrough).
+		SetEntryPoint("a").
+		AddConditionalEdge("a", route, "b", "approve").
+		SetFinishPoint("b").
+		SetFinishPoint("approve").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	path := &RunPath{Nodes: []string{"a", "b"}, Edges: [][2]string{{StartNode, "a"}, {"a", "b"}, {"b", EndNode}}}
+
+	mermaid := compiled.Mermaid(path)
+	for _, want := range []string{
+		`n1{{"approve (interrupt)"}}`,
+		`n0 -.->|condition| n2`,
+		"class n1 interrupt",
+		"class n0,n2 visited",
+		"linkStyle 0,1,4 stroke",
+	} {
+		if !strings.Contains(mermaid, want) {
+			t.Errorf("Mermaid output missing %q:\n%s", want, mermaid)
+		}
+	}
+
+	dot := compiled.DOT(nil)
+	for _, want := range []string{
+		`"approve" [label="approve (interrupt)", shape=hexagon`,
+		`"a" -> "b" [style=dashed, label="condition"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output missing %q:\n%s", want, dot)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package graph
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Kinds of limits a run can exceed.
+const (
+	LimitMaxSteps  = "max_steps"  // more nodes executed than the graph's step budget
+	LimitMaxVisits = "max_visits" // a node executed more often than its visit limit
+	LimitFixpoint  = "fixpoint"   // a node reached again with unchanged state
+)
+
+// Checkpoint metadata keys carrying a run's step and visit counts, so that
+// its limits hold across resumes.
+const (
+	metaSteps  = "steps"
+	metaVisits = "visits"
+)
+
+// trailLength is the number of transitions a LimitError lists.
+const trailLength = 10
+
+// LimitError is returned when a run exceeds a step or visit limit, or
+// reaches a state fixpoint. The run stops with RunStatusLimitExceeded.
+type LimitError struct {
+	Kind   string
+	NodeID string // node that was about to execute
+	Limit  int    // the exceeded limit; 0 for fixpoints
+	// Trail lists the last nodes executed, oldest first and ending with
+	// NodeID. Nodes of fan-out branches are prefixed with the branch.
+	Trail []string
+}
+
+func (e *LimitError) Error() string {
+	var msg string
+	switch e.Kind {
+	case LimitMaxSteps:
+		msg = fmt.Sprintf("run exceeded its budget of %d steps at node %q", e.Limit, e.NodeID)
+	case LimitMaxVisits:
+		msg = fmt.Sprintf("node %q exceeded its limit of %d visits", e.NodeID, e.Limit)
+	default:
+		msg = fmt.Sprintf("node %q reached again with unchanged state", e.NodeID)
+	}
+	return msg + "; last transitions: " + strings.Join(e.Trail, " -> ")
+}
+
+// SetMaxSteps limits the number of nodes a run executes, counting the nodes
+// of fan-out branches and those executed before the run was resumed. 0 (the
+// default) means no limit.
+func (g *StateGraph) SetMaxSteps(n int) *StateGraph {
+	g.maxSteps = n
+	return g
+}
+
+// SetMaxVisits limits how often a run executes nodeID, counting the visits
+// made before the run was resumed.
+func (g *StateGraph) SetMaxVisits(nodeID string, n int) *StateGraph {
+	g.maxVisits[nodeID] = n
+	return g
+}
+
+// DetectFixpoints makes runs fail when a node is reached again with the
+// same state it ran with before: with deterministic nodes and routers, the
+// cycle in between would repeat forever.
+func (g *StateGraph) DetectFixpoints() *StateGraph {
+	g.fixpoints = true
+	return g
+}
+
+// limitTracker counts the node visits of a run and the states it has seen
+// since it started or was resumed.
+type limitTracker struct {
+	visits map[string]int
+	seen   map[string]map[[sha256.Size]byte]bool // states each node ran with
+	trail  []string
+}
+
+func newLimitTracker() *limitTracker {
+	return &limitTracker{visits: make(map[string]int), seen: make(map[string]map[[sha256.Size]byte]bool)}
+}
+
+// recordLimits adds rs's step and visit counts to the metadata of a
+// checkpoint. The caller holds r.mu.
+func recordLimits(rs *RunState, meta map[string]any) {
+	if rs.Steps > 0 {
+		meta[metaSteps] = rs.Steps
+	}
+	if rs.limits != nil && len(rs.limits.visits) > 0 {
+		meta[metaVisits] = maps.Clone(rs.limits.visits)
+	}
+}
+
+// restoreLimits sets rs's step and visit counts to those recorded in cp.
+func restoreLimits(rs *RunState, cp *storage.Checkpoint) {
+	if n, ok := toIndex(cp.Metadata[metaSteps]); ok {
+		rs.Steps = n
+	}
+	var visits map[string]int
+	switch v := cp.Metadata[metaVisits].(type) {
+	case map[string]int:
+		visits = maps.Clone(v)
+	case map[string]any:
+		visits = make(map[string]int, len(v))
+		for id, count := range v {
+			if n, ok := toIndex(count); ok {
+				visits[id] = n
+			}
+		}
+	}
+	if len(visits) > 0 {
+		rs.limits = newLimitTracker()
+		rs.limits.visits = visits
+	}
+}
+
+// step accounts for node executing with state, in branch branchID if set,
+// and fails if the run exceeds one of its limits.
+func (r *Runner) step(rs *RunState, branchID string, node *Node, state State) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := rs.limits
+	if l == nil {
+		l = newLimitTracker()
+		rs.limits = l
+	}
+	rs.Steps++
+	l.visits[node.ID]++
+	label := node.ID
+	if branchID != "" {
+		label = branchID + ":" + node.ID
+	}
+	l.trail = append(l.trail, label)
+	if len(l.trail) > trailLength+1 {
+		l.trail = append(l.trail[:0], l.trail[1:]...)
+	}
+
+	fail := func(kind string, limit int) error {
+		return &LimitError{Kind: kind, NodeID: node.ID, Limit: limit, Trail: append([]string(nil), l.trail...)}
+	}
+	if limit := r.graph.MaxSteps; limit > 0 && rs.Steps > limit {
+		return fail(LimitMaxSteps, limit)
+	}
+	if node.MaxVisits > 0 && l.visits[node.ID] > node.MaxVisits {
+		return fail(LimitMaxVisits, node.MaxVisits)
+	}
+	if r.graph.DetectFixpoints {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		if l.seen[label][sum] {
+			return fail(LimitFixpoint, 0)
+		}
+		if l.seen[label] == nil {
+			l.seen[label] = make(map[[sha256.Size]byte]bool)
+		}
+		l.seen[label][sum] = true
+	}
+	return nil
+}
+
+// failedStatus returns the status of a run that stopped with err.
+func failedStatus(err error) RunStatus {
+	var limit *LimitError
+	if errors.As(err, &limit) {
+		return RunStatusLimitExceeded
+	}
+	return RunStatusFailed
+}
@@ -0,0 +1,251 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Checkpoint metadata keys written when an item of a map node completes.
+const (
+	metaMapItem   = "map_item"   // index of the completed item
+	metaMapOutput = "map_output" // the item's output
+)
+
+// MapNode runs a graph once for every element of a list in the state, and
+// reduces the outputs into a single update. Each completed item is
+// checkpointed, so a resumed run only runs the items that had not finished.
+type MapNode struct {
+	Graph *CompiledGraph // run once per item
+	// Items is the state key of the list to map over. A missing key maps
+	// over no items.
+	Items string
+	// ItemKey is the child state key the item is set under; "item" if empty.
+	ItemKey string
+	// Input maps child state keys to the parent keys they are read from, in
+	// addition to the item. A nil Input passes a copy of the whole state.
+	Input map[string]string
+	// Output is the child state key collected as the item's output. Empty
+	// collects the whole final child state.
+	Output string
+	// Into is the state key the reduced outputs are written to.
+	Into string
+	// Reducer folds the outputs in item order, starting from nil. A nil
+	// Reducer collects them into a []any.
+	Reducer Reducer
+	// Concurrency bounds the items that run at once; 0 runs all of them.
+	Concurrency int
+}
+
+// AddMapNode registers a node that runs m.Graph for every element of the
+// list at m.Items. Each child run checkpoints to the same storage under the
+// session <session>/<node>/<index>. Interrupt and timer nodes cannot run
+// inside the mapped graph.
+func (g *StateGraph) AddMapNode(id string, m *MapNode) *StateGraph {
+	g.nodes[id] = &Node{ID: id, Map: m}
+	return g
+}
+
+// input builds the child state of one item from the parent state.
+func (m *MapNode) input(parent State, item any) State {
+	var in State
+	if m.Input == nil {
+		in = copyState(parent)
+	} else {
+		in = make(State, len(m.Input)+1)
+		for key, from := range m.Input {
+			if v, ok := parent[from]; ok {
+				in[key] = v
+			}
+		}
+	}
+	key := m.ItemKey
+	if key == "" {
+		key = "item"
+	}
+	in[key] = item
+	return in
+}
+
+// output returns the output of an item from its child's final state.
+func (m *MapNode) output(final State) any {
+	if m.Output == "" {
+		return map[string]any(final)
+	}
+	return final[m.Output]
+}
+
+// reduce folds the outputs of every item, in order, into m.Into.
+func (m *MapNode) reduce(outputs []any) State {
+	if m.Reducer == nil {
+		return State{m.Into: outputs}
+	}
+	var acc any
+	for _, out := range outputs {
+		acc = m.Reducer(acc, out)
+	}
+	return State{m.Into: acc}
+}
+
+// mapItems returns the list at key in state.
+func mapItems(state State, key string) ([]any, error) {
+	v, ok := state[key]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("state key %q is a %T, not a list", key, v)
+	}
+	items := make([]any, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// runMap runs node's graph for every item of the list in state that is not
+// already in done, and returns the reduced outputs as the node's update.
+func (r *Runner) runMap(ctx context.Context, rs *RunState, node *Node, state State, done map[int]any) (State, error) {
+	m := node.Map
+	if m.Graph == nil {
+		return nil, fmt.Errorf("map node %q has no graph", node.ID)
+	}
+	items, err := mapItems(state, m.Items)
+	if err != nil {
+		return nil, fmt.Errorf("map %q: %w", node.ID, err)
+	}
+	outputs := make([]any, len(items))
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	limit := m.Concurrency
+	if limit <= 0 || limit > len(items) {
+		limit = len(items)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i, item := range items {
+		if out, ok := done[i]; ok {
+			outputs[i] = out
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, item any) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out, err := r.runMapItem(ctx, rs, node, state, i, item)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("map %q: item %d: %w", node.ID, i, err)
+					cancel(firstErr)
+				}
+				return
+			}
+			outputs[i] = out
+		}(i, item)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return m.reduce(outputs), nil
+}
+
+// runMapItem runs the child of item index and checkpoints the parent with
+// its output.
+func (r *Runner) runMapItem(ctx context.Context, rs *RunState, node *Node, state State, index int, item any) (any, error) {
+	m := node.Map
+	ns := fmt.Sprintf("%s[%d]", node.ID, index)
+	if r.ns != "" {
+		ns = r.ns + "/" + ns
+	}
+	child := &Runner{graph: m.Graph, store: r.store, stream: r.stream, runID: r.runID, ns: ns, guard: r.guard}
+	crs, err := child.execute(ctx, &RunState{
+		RunID:       newRunID(),
+		SessionID:   fmt.Sprintf("%s/%d", subgraphSession(rs.SessionID, node.ID), index),
+		GraphID:     m.Graph.ID,
+		CurrentNode: m.Graph.Entry,
+		Status:      RunStatusRunning,
+		State:       m.input(state, item),
+		StartedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch crs.Status {
+	case RunStatusPaused:
+		return nil, fmt.Errorf("interrupt node %q cannot run inside a map node", crs.CurrentNode)
+	case RunStatusWaiting:
+		return nil, fmt.Errorf("timer node %q cannot run inside a map node", crs.CurrentNode)
+	}
+	out := m.output(crs.State)
+	// The parent runs the map node again on resume, skipping this item.
+	if _, err := r.checkpoint(ctx, rs, node.ID, state, map[string]any{
+		metaNext:      node.ID,
+		metaMapItem:   index,
+		metaMapOutput: out,
+	}); err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	return out, nil
+}
+
+// mapProgress returns the outputs recorded by the map item checkpoints that
+// lead up to cp in its run.
+func mapProgress(ctx context.Context, store storage.Storage, cp *storage.Checkpoint) (map[int]any, error) {
+	cps, err := store.ListCheckpoints(ctx, cp.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("list checkpoints: %w", err)
+	}
+	done := make(map[int]any)
+	for _, c := range cps {
+		if c.RunID != cp.RunID || c.SeqNum > cp.SeqNum {
+			continue
+		}
+		if isTrue(c.Metadata[metaUnfinished]) {
+			// The map node was cancelled; its items' checkpoints still count.
+			continue
+		}
+		index, ok := c.Metadata[metaMapItem]
+		if !ok {
+			// Any map items before a node's checkpoint belong to an
+			// earlier execution.
+			done = make(map[int]any)
+			continue
+		}
+		i, ok := toIndex(index)
+		if !ok {
+			return nil, fmt.Errorf("checkpoint %q: invalid map item %v", c.ID, index)
+		}
+		done[i] = c.Metadata[metaMapOutput]
+	}
+	return done, nil
+}
+
+// toIndex converts an item index read back from a checkpoint.
+func toIndex(v any) (int, bool) {
+	f, ok := toFloat(reflect.ValueOf(v))
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
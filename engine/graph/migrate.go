@@ -0,0 +1,188 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// metaVersion records the version of the graph that wrote a checkpoint.
+const metaVersion = "graph_version"
+
+// ErrNoMigration is returned when resuming from a checkpoint written by a
+// graph version that no chain of migrations leads from.
+var ErrNoMigration = errors.New("no migration from graph version")
+
+// Migration upgrades the checkpoints of runs started on version From of a
+// graph to version To, so that runs paused before a deploy can be resumed
+// by the new graph. Migrations are chained: a checkpoint of version 1 is
+// resumed by version 3 through the migrations from 1 to 2 and from 2 to 3.
+type Migration struct {
+	From string // "" matches checkpoints written before the graph had a version
+	To   string
+	// Nodes maps node IDs of version From to their IDs in version To. Nodes
+	// that are not listed keep their ID.
+	Nodes map[string]string
+	// State, if set, converts the checkpointed state, and the updates of
+	// fan-out branches, from the shape of version From to that of To.
+	State func(State) (State, error)
+}
+
+// SetVersion sets the version of the graph. Checkpoints record it, and
+// resuming a checkpoint of another version applies the graph's migrations.
+func (g *StateGraph) SetVersion(v string) *StateGraph {
+	g.version = v
+	return g
+}
+
+// AddMigration registers a migration from an earlier version of the graph.
+func (g *StateGraph) AddMigration(m Migration) *StateGraph {
+	g.migrations = append(g.migrations, m)
+	return g
+}
+
+// checkpointVersion returns the graph version that wrote cp.
+func checkpointVersion(cp *storage.Checkpoint) string {
+	v, _ := cp.Metadata[metaVersion].(string)
+	return v
+}
+
+// migrate returns cp upgraded to the graph's version, or cp itself if it
+// has that version already. cp is not modified.
+func (c *CompiledGraph) migrate(cp *storage.Checkpoint) (*storage.Checkpoint, error) {
+	from := checkpointVersion(cp)
+	if from == c.Version {
+		return cp, nil
+	}
+	byFrom := make(map[string]*Migration, len(c.Migrations))
+	for i := range c.Migrations {
+		byFrom[c.Migrations[i].From] = &c.Migrations[i]
+	}
+	out := *cp
+	out.Metadata = make(map[string]any, len(cp.Metadata))
+	for k, v := range cp.Metadata {
+		out.Metadata[k] = v
+	}
+	for v := from; v != c.Version; {
+		m := byFrom[v]
+		if m == nil {
+			return nil, fmt.Errorf("checkpoint %q: %w %q to %q", cp.ID, ErrNoMigration, from, c.Version)
+		}
+		if err := m.apply(&out); err != nil {
+			return nil, fmt.Errorf("checkpoint %q: migrate %q to %q: %w", cp.ID, m.From, m.To, err)
+		}
+		v = m.To
+	}
+	return &out, nil
+}
+
+// apply upgrades cp, whose Metadata it may modify, from m.From to m.To.
+func (m *Migration) apply(cp *storage.Checkpoint) error {
+	rename := func(id string) string {
+		if to, ok := m.Nodes[id]; ok {
+			return to
+		}
+		return id
+	}
+	cp.NodeID = rename(cp.NodeID)
+	for _, key := range []string{metaNext, metaBranch} {
+		if id, ok := cp.Metadata[key].(string); ok {
+			cp.Metadata[key] = rename(id)
+		}
+	}
+	if m.State != nil {
+		state, err := m.State(copyState(cp.State))
+		if err != nil {
+			return err
+		}
+		cp.State = state
+		if delta, ok := cp.Metadata[metaDelta].(map[string]any); ok {
+			if delta, err = m.State(copyState(delta)); err != nil {
+				return err
+			}
+			cp.Metadata[metaDelta] = map[string]any(delta)
+		}
+	}
+	cp.Metadata[metaVersion] = m.To
+	return nil
+}
+
+// resumable reports why cp, migrated to the graph's version, cannot be
+// resumed, or nil if it can.
+func (c *CompiledGraph) resumable(cp *storage.Checkpoint) error {
+	cp, err := c.migrate(cp)
+	if err != nil {
+		return err
+	}
+	check := func(id string) error {
+		if _, ok := c.Nodes[id]; !ok && id != EndNode {
+			return fmt.Errorf("checkpoint %q: node %q not found", cp.ID, id)
+		}
+		return nil
+	}
+	if next, ok := cp.Metadata[metaNext].(string); ok && !isTrue(cp.Metadata[metaFanOut]) {
+		if err := check(next); err != nil {
+			return err
+		}
+	} else if err := check(cp.NodeID); err != nil {
+		return err
+	}
+	if c.Schema != nil {
+		if _, err := c.conform(State(cp.State)); err != nil {
+			return fmt.Errorf("checkpoint %q: %w", cp.ID, err)
+		}
+	}
+	return nil
+}
+
+func isTrue(v any) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+// StrandedRun is an unfinished run that a graph cannot resume.
+type StrandedRun struct {
+	SessionID    string
+	RunID        string
+	CheckpointID string
+	Version      string // graph version that wrote the checkpoint
+	Err          error
+}
+
+// CheckRuns returns the unfinished runs in store that the graph cannot
+// resume: those whose latest checkpoint has no migration path to the
+// graph's version or, once migrated, refers to a node the graph does not
+// have or a state its schema rejects. Run it against the new graph before
+// deploying it. Checkpoints of other graphs are skipped; checkpoints that
+// predate graph IDs being recorded are checked as well. The store must
+// implement storage.CheckpointPruner to list sessions.
+func (c *CompiledGraph) CheckRuns(ctx context.Context, store storage.Storage) ([]StrandedRun, error) {
+	lister, ok := store.(storage.CheckpointPruner)
+	if !ok {
+		return nil, errors.New("check runs: storage cannot list checkpoint sessions")
+	}
+	sessions, err := lister.ListCheckpointSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("check runs: %w", err)
+	}
+	var out []StrandedRun
+	for _, sessionID := range sessions {
+		cp, err := store.GetLatestCheckpoint(ctx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("check runs: session %s: %w", sessionID, err)
+		}
+		if id, ok := cp.Metadata[metaGraph].(string); ok && id != c.ID {
+			continue
+		}
+		if next, _ := cp.Metadata[metaNext].(string); next == EndNode {
+			continue
+		}
+		if err := c.resumable(cp); err != nil {
+			out = append(out, StrandedRun{SessionID: sessionID, RunID: cp.RunID, CheckpointID: cp.ID,
+				Version: checkpointVersion(cp), Err: err})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,196 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spawn08/chronos/engine/model"
+	"github.com/spawn08/chronos/engine/tool"
+)
+
+// RecordedCall is a model or tool call made by a node, as stored with the
+// node's node_executed event in the ledger.
+type RecordedCall struct {
+	Kind   string `json:"kind"` // "model", "tool" or a caller-defined kind
+	Name   string `json:"name"`
+	Output any    `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type recorderKey struct{}
+
+func withRecorder(ctx context.Context, rec *callRecorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, rec)
+}
+
+// recorderFor returns the recorder for an execution of node in branch and,
+// during a replay, the recorded execution it is checked against.
+func (r *Runner) recorderFor(branch string, node *Node) (*callRecorder, *recordedNode, error) {
+	rec := &callRecorder{node: node.ID, branch: branch}
+	if r.replay == nil {
+		return rec, nil, nil
+	}
+	rn, err := r.replay.beginReplay(branch, node, rec)
+	return rec, rn, err
+}
+
+// callRecorder collects the calls of one node execution or, during a
+// replay, serves the calls recorded for it.
+type callRecorder struct {
+	mu        sync.Mutex
+	calls     []RecordedCall
+	replaying bool
+	recorded  []RecordedCall
+	pos       int
+	div       *Divergence
+	node      string
+	branch    string
+}
+
+// reset discards the calls of a failed attempt before the node is retried.
+func (c *callRecorder) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls, c.pos, c.div = nil, 0, nil
+}
+
+func (c *callRecorder) add(kind, name string, output any, err error) {
+	call := RecordedCall{Kind: kind, Name: name, Output: output}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	c.mu.Unlock()
+}
+
+// next returns the recorded call that a replayed call of kind and name
+// stands for.
+func (c *callRecorder) next(kind, name string) (RecordedCall, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.div != nil {
+		return RecordedCall{}, c.div
+	}
+	if c.pos >= len(c.recorded) {
+		c.div = &Divergence{NodeID: c.node, Branch: c.branch,
+			Reason: fmt.Sprintf("unexpected %s call %q", kind, name)}
+		return RecordedCall{}, c.div
+	}
+	call := c.recorded[c.pos]
+	if call.Kind != kind || call.Name != name {
+		c.div = &Divergence{NodeID: c.node, Branch: c.branch,
+			Reason:   fmt.Sprintf("%s call %q made instead of recorded %s call %q", kind, name, call.Kind, call.Name),
+			Recorded: call.Name, Replayed: name}
+		return RecordedCall{}, c.div
+	}
+	c.pos++
+	return call, nil
+}
+
+// divergence returns the mismatch found while serving recorded calls,
+// including recorded calls the replayed node did not make.
+func (c *callRecorder) divergence() *Divergence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.div == nil && c.replaying && c.pos < len(c.recorded) {
+		call := c.recorded[c.pos]
+		c.div = &Divergence{NodeID: c.node, Branch: c.branch,
+			Reason: fmt.Sprintf("recorded %s call %q was not made", call.Kind, call.Name)}
+	}
+	return c.div
+}
+
+// Recorded performs a call with an external effect, such as a model or tool
+// call, on behalf of a graph node. While the graph runs normally the call is
+// made and its output is recorded in the ledger with the node's execution;
+// while a run is replayed the recorded output is returned instead and call
+// is not invoked. Outside a graph node, call is simply invoked. T must
+// survive a JSON round trip.
+func Recorded[T any](ctx context.Context, kind, name string, call func(context.Context) (T, error)) (T, error) {
+	rec, _ := ctx.Value(recorderKey{}).(*callRecorder)
+	if rec == nil {
+		return call(ctx)
+	}
+	if !rec.replaying {
+		out, err := call(ctx)
+		rec.add(kind, name, out, err)
+		return out, err
+	}
+	var out T
+	recorded, err := rec.next(kind, name)
+	if err != nil {
+		return out, err
+	}
+	if recorded.Error != "" {
+		return out, errors.New(recorded.Error)
+	}
+	if recorded.Output != nil {
+		if err := convertValue(recorded.Output, &out); err != nil {
+			return out, fmt.Errorf("replay %s call %q: %w", kind, name, err)
+		}
+	}
+	return out, nil
+}
+
+// RecordedProvider wraps p so that the calls graph nodes make through it
+// are recorded for replay. StreamChat is collected into a single response
+// while a node runs, so that the complete response can be recorded; its
+// tokens are emitted as token events on the runner's stream meanwhile.
+func RecordedProvider(p model.Provider) model.Provider {
+	return &recordedProvider{Provider: p}
+}
+
+type recordedProvider struct {
+	model.Provider
+}
+
+func (p *recordedProvider) Chat(ctx context.Context, req *model.ChatRequest) (*model.ChatResponse, error) {
+	return Recorded(ctx, "model", p.Name(), func(ctx context.Context) (*model.ChatResponse, error) {
+		return p.Provider.Chat(ctx, req)
+	})
+}
+
+func (p *recordedProvider) StreamChat(ctx context.Context, req *model.ChatRequest) (<-chan *model.ChatResponse, error) {
+	if ctx.Value(recorderKey{}) == nil {
+		return p.Provider.StreamChat(ctx, req)
+	}
+	resp, err := Recorded(ctx, "model", p.Name(), func(ctx context.Context) (*model.ChatResponse, error) {
+		return collectStream(ctx, p.Provider, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *model.ChatResponse, 1)
+	ch <- resp
+	close(ch)
+	return ch, nil
+}
+
+// collectStream reads a streamed response into a single response,
+// forwarding its content to the node's stream writer as token events.
+func collectStream(ctx context.Context, p model.Provider, req *model.ChatRequest) (*model.ChatResponse, error) {
+	ch, err := p.StreamChat(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	w := StreamWriterFrom(ctx)
+	var acc model.StreamAccumulator
+	for chunk := range ch {
+		if chunk != nil {
+			w.Token(chunk.Content)
+		}
+		acc.Add(chunk)
+	}
+	return acc.Response(), nil
+}
+
+// ExecuteTool runs a tool from reg on behalf of a graph node, recording its
+// result for replay.
+func ExecuteTool(ctx context.Context, reg *tool.Registry, name string, args map[string]any) (any, error) {
+	return Recorded(ctx, "tool", name, func(ctx context.Context) (any, error) {
+		return reg.Execute(ctx, name, args)
+	})
+}
@@ -0,0 +1,196 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Reducer combines the current value of a state key with an update for the
+// same key and returns the new value. current is nil when the key is not set
+// yet. Reducers must not modify their arguments.
+type Reducer func(current, update any) any
+
+// Apply merges update into state using the graph's reducers and returns the
+// result as a new State. state itself is not modified.
+func (c *CompiledGraph) Apply(state, update State) State {
+	out := copyState(state)
+	applyUpdate(out, update, c.Reducers, nil)
+	return out
+}
+
+// applyUpdate merges update into dst in place. Reducers in overrides take
+// precedence over those in reducers.
+func applyUpdate(dst, update State, reducers, overrides map[string]Reducer) {
+	for k, v := range update {
+		reduce, ok := overrides[k]
+		if !ok {
+			reduce, ok = reducers[k]
+		}
+		if ok {
+			dst[k] = reduce(dst[k], v)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// ReplaceReducer keeps the latest value. It is the behaviour of keys without
+// a reducer and is useful to override a graph reducer on a join node.
+func ReplaceReducer(_, update any) any {
+	return update
+}
+
+// AppendReducer appends update to the current list. update may be a single
+// element or a slice. When both sides have the same slice type the result
+// keeps it; otherwise (for example after a JSON round trip through a
+// checkpoint) the result is a []any.
+func AppendReducer(current, update any) any {
+	if current == nil {
+		if isSlice(update) {
+			return update
+		}
+		return []any{update}
+	}
+	cur := reflect.ValueOf(current)
+	if cur.Kind() != reflect.Slice {
+		cur = reflect.ValueOf([]any{current})
+	}
+	upd := reflect.ValueOf(update)
+	if update == nil || upd.Kind() != reflect.Slice {
+		upd = reflect.ValueOf([]any{update})
+	}
+	if cur.Type() == upd.Type() {
+		out := reflect.MakeSlice(cur.Type(), 0, cur.Len()+upd.Len())
+		return reflect.AppendSlice(reflect.AppendSlice(out, cur), upd).Interface()
+	}
+	out := make([]any, 0, cur.Len()+upd.Len())
+	for i := 0; i < cur.Len(); i++ {
+		out = append(out, cur.Index(i).Interface())
+	}
+	for i := 0; i < upd.Len(); i++ {
+		out = append(out, upd.Index(i).Interface())
+	}
+	return out
+}
+
+// SumReducer adds a numeric update to the current value. Two integers of the
+// same type stay that type; any other combination of numbers yields a float64.
+// Non-numeric updates replace the current value.
+func SumReducer(current, update any) any {
+	if current == nil {
+		return update
+	}
+	cur, upd := reflect.ValueOf(current), reflect.ValueOf(update)
+	if isInt(cur) && isInt(upd) && cur.Type() == upd.Type() {
+		return reflect.ValueOf(cur.Int() + upd.Int()).Convert(cur.Type()).Interface()
+	}
+	a, okA := toFloat(cur)
+	b, okB := toFloat(upd)
+	if !okA || !okB {
+		return update
+	}
+	return a + b
+}
+
+// MergeMapReducer merges the keys of a map update into the current map.
+// Keys present in both take the update's value. Non-map updates replace the
+// current value.
+func MergeMapReducer(current, update any) any {
+	upd, ok := toStringMap(update)
+	if !ok {
+		return update
+	}
+	cur, _ := toStringMap(current)
+	out := make(map[string]any, len(cur)+len(upd))
+	for k, v := range cur {
+		out[k] = v
+	}
+	for k, v := range upd {
+		out[k] = v
+	}
+	return out
+}
+
+// TypedReducer adapts a reducer over a concrete type T. Values that are not
+// already a T, such as the float64 and map values produced when state is
+// loaded from a checkpoint, are converted through JSON. A nil current value
+// is passed as T's zero value. If the update cannot be converted, it
+// replaces the current value unchanged.
+func TypedReducer[T any](fn func(current, update T) T) Reducer {
+	return func(current, update any) any {
+		var cur T
+		if current != nil {
+			if err := convertValue(current, &cur); err != nil {
+				return update
+			}
+		}
+		var upd T
+		if err := convertValue(update, &upd); err != nil {
+			return update
+		}
+		return fn(cur, upd)
+	}
+}
+
+// convertValue stores v in out, converting through JSON when v is not
+// directly assignable.
+func convertValue[T any](v any, out *T) error {
+	if t, ok := v.(T); ok {
+		*out = t
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("convert %T: %w", v, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("convert %T: %w", v, err)
+	}
+	return nil
+}
+
+func isSlice(v any) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Slice
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func toStringMap(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case nil:
+		return nil, false
+	case map[string]any:
+		return m, true
+	case State:
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	out := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		out[iter.Key().String()] = iter.Value().Interface()
+	}
+	return out, true
+}
@@ -0,0 +1,338 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// RunPath is the part of a graph a run executed, read from its checkpoints.
+// It can be overlaid on a rendered diagram.
+type RunPath struct {
+	RunID string
+	Nodes []string    // executed nodes, in checkpoint order
+	Edges [][2]string // transitions taken, as (from, to)
+}
+
+// LoadRunPath reads the path of runID in sessionID from its checkpoints. An
+// empty runID selects the run of the latest checkpoint.
+func LoadRunPath(ctx context.Context, store storage.Storage, sessionID, runID string) (*RunPath, error) {
+	cps, err := store.ListCheckpoints(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("load run path: %w", err)
+	}
+	if runID == "" && len(cps) > 0 {
+		latest, err := store.GetLatestCheckpoint(ctx, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("load run path: %w", err)
+		}
+		runID = latest.RunID
+	}
+	path := &RunPath{RunID: runID}
+	seen := make(map[string]bool)
+	visit := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			path.Nodes = append(path.Nodes, id)
+		}
+	}
+	fanFrom := ""
+	branchStarted := make(map[string]bool)
+	for _, cp := range cps {
+		if cp.RunID != runID {
+			continue
+		}
+		if len(path.Edges) == 0 && len(path.Nodes) == 0 {
+			if _, forked := cp.Metadata[metaParentRun]; !forked {
+				path.Edges = append(path.Edges, [2]string{StartNode, cp.NodeID})
+			}
+		}
+		if b, ok := cp.Metadata[metaBranch].(string); ok && fanFrom != "" && !branchStarted[b] {
+			branchStarted[b] = true
+			path.Edges = append(path.Edges, [2]string{fanFrom, b})
+		}
+		if paused, _ := cp.Metadata[metaInterrupt].(bool); paused {
+			continue // the node has not run yet
+		}
+		if _, waiting := cp.Metadata[metaWakeAt]; waiting {
+			continue
+		}
+		if _, item := cp.Metadata[metaMapItem]; item {
+			continue // the map node is still running
+		}
+		visit(cp.NodeID)
+		if fan, _ := cp.Metadata[metaFanOut].(bool); fan {
+			fanFrom = cp.NodeID
+			continue
+		}
+		if next, ok := cp.Metadata[metaNext].(string); ok {
+			path.Edges = append(path.Edges, [2]string{cp.NodeID, next})
+		}
+	}
+	if len(path.Edges) == 0 && len(path.Nodes) == 0 {
+		return nil, fmt.Errorf("load run path: no checkpoints for run %q in session %q", runID, sessionID)
+	}
+	return path, nil
+}
+
+// edgeKind classifies the edges of a rendered diagram.
+type edgeKind int
+
+const (
+	edgeStatic edgeKind = iota
+	edgeCondition
+	edgeUndeclared // conditional edge whose routes are not declared
+	edgeFanOut
+	edgeError
+	edgeTaken // transition of the overlaid path not otherwise drawn
+)
+
+type renderEdge struct {
+	from, to string
+	kind     edgeKind
+	taken    bool
+}
+
+// renderEdges lists the edges to draw, in a stable order, marking those
+// taken by path.
+func (c *CompiledGraph) renderEdges(path *RunPath) []renderEdge {
+	taken := make(map[[2]string]bool)
+	if path != nil {
+		for _, e := range path.Edges {
+			taken[e] = true
+		}
+	}
+	drawn := make(map[[2]string]bool)
+	var out []renderEdge
+	add := func(from, to string, kind edgeKind) {
+		key := [2]string{from, to}
+		drawn[key] = true
+		out = append(out, renderEdge{from: from, to: to, kind: kind, taken: taken[key]})
+	}
+
+	froms := sortedKeys(c.AdjList)
+	for _, from := range froms {
+		for _, e := range c.AdjList[from] {
+			switch {
+			case len(e.Targets) > 0:
+				for _, t := range e.Targets {
+					add(from, t, edgeFanOut)
+				}
+			case e.Condition != nil && len(e.Routes) == 0:
+				out = append(out, renderEdge{from: from, kind: edgeUndeclared})
+			case e.Condition != nil:
+				for _, t := range e.Routes {
+					add(from, t, edgeCondition)
+				}
+			default:
+				add(from, e.To, edgeStatic)
+			}
+		}
+	}
+	for _, id := range sortedKeys(c.Nodes) {
+		if n := c.Nodes[id]; n.OnError != "" {
+			add(id, n.OnError, edgeError)
+		}
+	}
+	if path != nil {
+		for _, e := range path.Edges {
+			if !drawn[e] {
+				drawn[e] = true
+				out = append(out, renderEdge{from: e[0], to: e[1], kind: edgeTaken, taken: true})
+			}
+		}
+	}
+	return out
+}
+
+// nodeLabel describes a node's kind in diagrams.
+func nodeLabel(n *Node) string {
+	switch {
+	case n.Interrupt:
+		return n.ID + " (interrupt)"
+	case n.Subgraph != nil && n.Subgraph.Graph != nil:
+		return n.ID + " (subgraph " + n.Subgraph.Graph.ID + ")"
+	case n.Join:
+		return n.ID + " (join)"
+	case n.Wake != nil:
+		return n.ID + " (timer)"
+	}
+	return n.ID
+}
+
+// Mermaid renders the graph as a Mermaid flowchart. Interrupt nodes are
+// drawn as hexagons and conditional edges as dashed arrows. If path is not
+// nil, the nodes and transitions it took are highlighted.
+func (c *CompiledGraph) Mermaid(path *RunPath) string {
+	ids := map[string]string{StartNode: "__start__", EndNode: "__end__"}
+	nodes := sortedKeys(c.Nodes)
+	for i, id := range nodes {
+		ids[id] = fmt.Sprintf("n%d", i)
+	}
+	mid := func(id string) string {
+		if m, ok := ids[id]; ok {
+			return m
+		}
+		// A path may name nodes that were removed from the graph since.
+		m := fmt.Sprintf("n%d", len(ids))
+		ids[id] = m
+		return m
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	b.WriteString("    __start__((start))\n")
+	b.WriteString("    __end__((end))\n")
+	var interrupts []string
+	for _, id := range nodes {
+		n := c.Nodes[id]
+		label := mermaidText(nodeLabel(n))
+		switch {
+		case n.Interrupt:
+			fmt.Fprintf(&b, "    %s{{\"%s\"}}\n", ids[id], label)
+			interrupts = append(interrupts, ids[id])
+		case n.Subgraph != nil:
+			fmt.Fprintf(&b, "    %s[[\"%s\"]]\n", ids[id], label)
+		case n.Join:
+			fmt.Fprintf(&b, "    %s[/\"%s\"\\]\n", ids[id], label)
+		default:
+			fmt.Fprintf(&b, "    %s[\"%s\"]\n", ids[id], label)
+		}
+	}
+
+	var takenLinks []string
+	for i, e := range c.renderEdges(path) {
+		from := mid(e.from)
+		switch e.kind {
+		case edgeStatic:
+			fmt.Fprintf(&b, "    %s --> %s\n", from, mid(e.to))
+		case edgeCondition:
+			fmt.Fprintf(&b, "    %s -.->|condition| %s\n", from, mid(e.to))
+		case edgeUndeclared:
+			fmt.Fprintf(&b, "    %s -.->|condition| %s_routes((\"?\"))\n", from, from)
+		case edgeFanOut:
+			fmt.Fprintf(&b, "    %s ==>|fan-out| %s\n", from, mid(e.to))
+		case edgeError:
+			fmt.Fprintf(&b, "    %s -.->|on_error| %s\n", from, mid(e.to))
+		case edgeTaken:
+			fmt.Fprintf(&b, "    %s -.-> %s\n", from, mid(e.to))
+		}
+		if e.taken {
+			takenLinks = append(takenLinks, fmt.Sprint(i))
+		}
+	}
+
+	b.WriteString("    classDef interrupt fill:#fdebd0,stroke:#e67e22\n")
+	if len(interrupts) > 0 {
+		fmt.Fprintf(&b, "    class %s interrupt\n", strings.Join(interrupts, ","))
+	}
+	if path != nil {
+		var visited []string
+		for _, id := range path.Nodes {
+			visited = append(visited, mid(id))
+		}
+		b.WriteString("    classDef visited fill:#d6eaf8,stroke:#2e86de,stroke-width:2px\n")
+		if len(visited) > 0 {
+			fmt.Fprintf(&b, "    class %s visited\n", strings.Join(visited, ","))
+		}
+		if len(takenLinks) > 0 {
+			fmt.Fprintf(&b, "    linkStyle %s stroke:#2e86de,stroke-width:3px\n", strings.Join(takenLinks, ","))
+		}
+	}
+	return b.String()
+}
+
+// mermaidText escapes text for a quoted Mermaid label.
+func mermaidText(s string) string {
+	return strings.ReplaceAll(s, `"`, "#quot;")
+}
+
+// DOT renders the graph in Graphviz DOT format. Interrupt nodes are drawn
+// as filled hexagons and conditional edges as dashed arrows. If path is not
+// nil, the nodes and transitions it took are highlighted.
+func (c *CompiledGraph) DOT(path *RunPath) string {
+	visited := make(map[string]bool)
+	if path != nil {
+		for _, id := range path.Nodes {
+			visited[id] = true
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", c.ID)
+	b.WriteString("    rankdir=TB;\n")
+	b.WriteString("    node [shape=box, style=rounded];\n")
+	fmt.Fprintf(&b, "    %q [shape=circle, label=\"start\"];\n", StartNode)
+	fmt.Fprintf(&b, "    %q [shape=doublecircle, label=\"end\"];\n", EndNode)
+	ids := sortedKeys(c.Nodes)
+	if path != nil {
+		for _, id := range path.Nodes {
+			if _, ok := c.Nodes[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, id := range ids {
+		attrs := []string{fmt.Sprintf("label=%q", id)}
+		if n, ok := c.Nodes[id]; ok {
+			attrs[0] = fmt.Sprintf("label=%q", nodeLabel(n))
+			switch {
+			case n.Interrupt:
+				attrs = append(attrs, "shape=hexagon", `style=filled`, `fillcolor="#fdebd0"`)
+			case n.Subgraph != nil:
+				attrs = append(attrs, "shape=box3d")
+			case n.Join:
+				attrs = append(attrs, "shape=invtrapezium")
+			}
+		}
+		if visited[id] {
+			attrs = append(attrs, `color="#2e86de"`, "penwidth=2")
+			if n, ok := c.Nodes[id]; !ok || !n.Interrupt {
+				attrs = append(attrs, `style="rounded,filled"`, `fillcolor="#d6eaf8"`)
+			}
+		}
+		fmt.Fprintf(&b, "    %q [%s];\n", id, strings.Join(attrs, ", "))
+	}
+
+	for _, e := range c.renderEdges(path) {
+		var attrs []string
+		to := e.to
+		switch e.kind {
+		case edgeCondition:
+			attrs = append(attrs, "style=dashed", `label="condition"`)
+		case edgeUndeclared:
+			to = e.from + "_routes"
+			fmt.Fprintf(&b, "    %q [shape=circle, label=\"?\"];\n", to)
+			attrs = append(attrs, "style=dashed", `label="condition"`)
+		case edgeFanOut:
+			attrs = append(attrs, "style=bold", `label="fan-out"`)
+		case edgeError:
+			attrs = append(attrs, "style=dashed", "color=red", `label="on_error"`)
+		case edgeTaken:
+			attrs = append(attrs, "style=dashed")
+		}
+		if e.taken {
+			attrs = append(attrs, `color="#2e86de"`, "penwidth=2.5")
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(&b, "    %q -> %q;\n", e.from, to)
+		} else {
+			fmt.Fprintf(&b, "    %q -> %q [%s];\n", e.from, to, strings.Join(attrs, ", "))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Render renders the graph in the given format, "mermaid" or "dot".
+func (c *CompiledGraph) Render(format string, path *RunPath) (string, error) {
+	switch strings.ToLower(format) {
+	case "", "mermaid":
+		return c.Mermaid(path), nil
+	case "dot", "graphviz":
+		return c.DOT(path), nil
+	}
+	return "", fmt.Errorf("unknown graph format %q (want mermaid or dot)", format)
+}
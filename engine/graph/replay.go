@@ -0,0 +1,218 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Divergence describes the first point where a replayed run differs from
+// its recording.
+type Divergence struct {
+	Seq      int64  `json:"seq"` // ledger sequence number of the recorded event, 0 if none
+	NodeID   string `json:"node_id"`
+	Branch   string `json:"branch,omitempty"`
+	Reason   string `json:"reason"`
+	Recorded any    `json:"recorded,omitempty"`
+	Replayed any    `json:"replayed,omitempty"`
+}
+
+func (d *Divergence) Error() string {
+	if d.Branch != "" {
+		return fmt.Sprintf("replay diverged at node %q (branch %q): %s", d.NodeID, d.Branch, d.Reason)
+	}
+	return fmt.Sprintf("replay diverged at node %q: %s", d.NodeID, d.Reason)
+}
+
+// ReplayReport is the result of replaying a recorded run.
+type ReplayReport struct {
+	RunID      string      `json:"run_id"` // the recorded run
+	Status     RunStatus   `json:"status"`
+	State      State       `json:"state"`
+	Nodes      int         `json:"nodes"` // node executions replayed
+	Divergence *Divergence `json:"divergence,omitempty"`
+}
+
+// recordedNode is a node_executed event read back from the ledger.
+type recordedNode struct {
+	seq    int64
+	node   string
+	branch string
+	update State
+	input  State
+	calls  []RecordedCall
+}
+
+// replayLog serves the recorded node executions of a run in order: one
+// queue for the main path and one per fan-out branch.
+type replayLog struct {
+	mu       sync.Mutex                 // branches replay concurrently
+	queues   map[string][]*recordedNode // branch ("" for the main path) -> executions
+	replayed int
+}
+
+// Replay re-runs the graph against a run recorded in the ledger of
+// sessionID; an empty runID selects the latest run started with Run. Model
+// and tool calls made through Recorded are served from the recording, and
+// nothing is written to storage. The report's Divergence is set at the first
+// node whose path, calls or output differ from the recording.
+func (r *Runner) Replay(ctx context.Context, sessionID, runID string) (*ReplayReport, error) {
+	events, err := r.store.ListEvents(ctx, sessionID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	log, initial, runID, err := loadReplayLog(events, runID)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	if initial, err = r.graph.conform(initial); err != nil {
+		return nil, fmt.Errorf("replay: initial state: %w", err)
+	}
+
+	r, end := r.begin(sessionID)
+	defer end()
+	replayer := &Runner{graph: r.graph, store: r.store, stream: r.stream, replay: log}
+	rs, err := replayer.execute(ctx, &RunState{
+		RunID:       newRunID(),
+		SessionID:   sessionID,
+		GraphID:     r.graph.ID,
+		CurrentNode: r.graph.Entry,
+		Status:      RunStatusRunning,
+		State:       initial,
+	})
+	report := &ReplayReport{RunID: runID, Status: rs.Status, State: rs.State, Nodes: log.replayed}
+	var div *Divergence
+	if errors.As(err, &div) {
+		report.Divergence = div
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("replay: %w", err)
+	}
+	report.Divergence = log.leftover()
+	return report, nil
+}
+
+// loadReplayLog reads the run runID (or the latest run started with Run)
+// from the session's events.
+func loadReplayLog(events []*storage.Event, runID string) (*replayLog, State, string, error) {
+	var initial State
+	for _, e := range events {
+		p, _ := e.Payload.(map[string]any)
+		if e.Type != "run_started" || (runID != "" && p["run"] != runID) {
+			continue
+		}
+		runID, _ = p["run"].(string)
+		state, _ := p["state"].(map[string]any)
+		initial = copyState(state)
+	}
+	if initial == nil {
+		if runID == "" {
+			return nil, nil, "", errors.New("no run started with Run in this session")
+		}
+		return nil, nil, "", fmt.Errorf("run %q has no run_started event", runID)
+	}
+
+	log := &replayLog{queues: make(map[string][]*recordedNode)}
+	for _, e := range events {
+		p, _ := e.Payload.(map[string]any)
+		if e.Type != "node_executed" || p["run"] != runID {
+			continue
+		}
+		rn := &recordedNode{seq: e.SeqNum}
+		rn.node, _ = p["node"].(string)
+		rn.branch, _ = p["branch"].(string)
+		if err := convertValue(p["update"], &rn.update); err != nil {
+			return nil, nil, "", fmt.Errorf("event %s: %w", e.ID, err)
+		}
+		if err := convertValue(p["input"], &rn.input); err != nil {
+			return nil, nil, "", fmt.Errorf("event %s: %w", e.ID, err)
+		}
+		if err := convertValue(p["calls"], &rn.calls); err != nil {
+			return nil, nil, "", fmt.Errorf("event %s: %w", e.ID, err)
+		}
+		log.queues[rn.branch] = append(log.queues[rn.branch], rn)
+	}
+	return log, initial, runID, nil
+}
+
+// next returns the recorded execution that the replay of nodeID in branch
+// corresponds to. found is false when the recording has no more executions
+// on that path.
+func (l *replayLog) next(branch, nodeID string) (rn *recordedNode, found bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.queues[branch]
+	if len(q) == 0 {
+		return nil, false, nil
+	}
+	rn = q[0]
+	if rn.node != nodeID {
+		return nil, true, &Divergence{Seq: rn.seq, NodeID: nodeID, Branch: branch,
+			Reason:   fmt.Sprintf("replay ran node %q where the recording ran %q", nodeID, rn.node),
+			Recorded: rn.node, Replayed: nodeID}
+	}
+	l.queues[branch] = q[1:]
+	l.replayed++
+	return rn, true, nil
+}
+
+// leftover reports the first recorded execution the replay did not reach.
+func (l *replayLog) leftover() *Divergence {
+	var first *recordedNode
+	for _, q := range l.queues {
+		if len(q) > 0 && (first == nil || q[0].seq < first.seq) {
+			first = q[0]
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	return &Divergence{Seq: first.seq, NodeID: first.node, Branch: first.branch,
+		Reason: "the replay ended before this recorded node ran"}
+}
+
+// beginReplay looks up the recorded execution of node and prepares rec to
+// serve its calls. A nil result with a nil error means the recording ends
+// at an interrupt node that was never resumed.
+func (l *replayLog) beginReplay(branch string, node *Node, rec *callRecorder) (*recordedNode, error) {
+	rn, found, err := l.next(branch, node.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if node.Interrupt {
+			return nil, nil
+		}
+		return nil, &Divergence{NodeID: node.ID, Branch: branch, Reason: "node is not in the recording"}
+	}
+	rec.replaying, rec.recorded = true, rn.calls
+	return rn, nil
+}
+
+// compare reports a divergence if the replayed update differs from the
+// recorded one. Both are compared in their JSON form, as stored.
+func (rn *recordedNode) compare(update State) *Divergence {
+	var replayed State
+	data, err := json.Marshal(update)
+	if err == nil {
+		err = json.Unmarshal(data, &replayed)
+	}
+	if err != nil {
+		return &Divergence{Seq: rn.seq, NodeID: rn.node, Branch: rn.branch,
+			Reason: fmt.Sprintf("cannot encode node output: %v", err)}
+	}
+	if len(replayed) == 0 && len(rn.update) == 0 {
+		return nil
+	}
+	if !reflect.DeepEqual(replayed, rn.update) {
+		return &Divergence{Seq: rn.seq, NodeID: rn.node, Branch: rn.branch,
+			Reason: "node output differs from the recording", Recorded: rn.update, Replayed: update}
+	}
+	return nil
+}
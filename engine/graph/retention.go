@@ -0,0 +1,130 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// RetentionPolicy selects the checkpoints CompactCheckpoints keeps. The
+// latest checkpoint of a session, and the branch and item checkpoints a
+// resume from it needs, are always kept.
+type RetentionPolicy struct {
+	// KeepLast, if positive, keeps only the last KeepLast checkpoints of
+	// each session.
+	KeepLast int
+	// KeepInterrupts keeps the checkpoints of runs paused at an interrupt,
+	// whatever their position, so that they can still be resumed.
+	KeepInterrupts bool
+	// MaxAge, if positive, also deletes the checkpoints older than MaxAge
+	// that the other rules keep, except the latest checkpoint of a run
+	// still paused at an interrupt or waiting on a timer.
+	MaxAge time.Duration
+}
+
+// CompactReport summarises a CompactCheckpoints call.
+type CompactReport struct {
+	Sessions int // sessions with checkpoints
+	Kept     int
+	Deleted  int
+}
+
+// CompactCheckpoints deletes the checkpoints of every session in store that
+// policy does not keep, and rewrites the remaining ones as state diffs
+// against periodic snapshots. The store must implement
+// storage.CheckpointPruner.
+func CompactCheckpoints(ctx context.Context, store storage.Storage, policy RetentionPolicy) (*CompactReport, error) {
+	pruner, ok := store.(storage.CheckpointPruner)
+	if !ok {
+		return nil, errors.New("compact checkpoints: storage does not support deleting checkpoints")
+	}
+	sessions, err := pruner.ListCheckpointSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("compact checkpoints: %w", err)
+	}
+	report := &CompactReport{Sessions: len(sessions)}
+	now := time.Now()
+	for _, sessionID := range sessions {
+		cps, err := store.ListCheckpoints(ctx, sessionID)
+		if err != nil {
+			return report, fmt.Errorf("compact checkpoints: session %s: %w", sessionID, err)
+		}
+		drop := policy.prune(cps, now)
+		if err := pruner.DeleteCheckpoints(ctx, sessionID, drop); err != nil {
+			return report, fmt.Errorf("compact checkpoints: session %s: %w", sessionID, err)
+		}
+		report.Kept += len(cps) - len(drop)
+		report.Deleted += len(drop)
+	}
+	return report, nil
+}
+
+// prune returns the IDs of the checkpoints of one session that p deletes.
+func (p RetentionPolicy) prune(cps []*storage.Checkpoint, now time.Time) []string {
+	if len(cps) == 0 {
+		return nil
+	}
+	// Latest last, in the order of storage.Storage.GetLatestCheckpoint.
+	cps = append([]*storage.Checkpoint(nil), cps...)
+	sort.SliceStable(cps, func(i, j int) bool {
+		if !cps[i].CreatedAt.Equal(cps[j].CreatedAt) {
+			return cps[i].CreatedAt.Before(cps[j].CreatedAt)
+		}
+		return cps[i].SeqNum < cps[j].SeqNum
+	})
+	// Checkpoints a resume needs are kept whatever their age.
+	protected := make(map[string]bool)
+	latest := cps[len(cps)-1]
+	protected[latest.ID] = true
+	if inProgress(latest) {
+		// Resuming a fan-out or a map node reads the run's checkpoints back
+		// to the one written before the branches or items started.
+		for i := len(cps) - 2; i >= 0; i-- {
+			c := cps[i]
+			if c.RunID != latest.RunID || c.SeqNum > latest.SeqNum {
+				continue
+			}
+			protected[c.ID] = true
+			if !inProgress(c) {
+				break
+			}
+		}
+	}
+	// A run still paused at an interrupt or waiting on a timer resumes
+	// from its latest checkpoint, which therefore does not expire.
+	runLatest := make(map[string]*storage.Checkpoint)
+	for _, c := range cps {
+		runLatest[c.RunID] = c
+	}
+	pending := make(map[string]bool)
+	for _, c := range runLatest {
+		_, waiting := c.Metadata[metaWakeAt]
+		if isTrue(c.Metadata[metaInterrupt]) || waiting {
+			pending[c.ID] = true
+		}
+	}
+	var drop []string
+	for i, c := range cps {
+		paused := isTrue(c.Metadata[metaInterrupt])
+		switch {
+		case protected[c.ID], p.KeepInterrupts && paused:
+		case p.KeepLast > 0 && i < len(cps)-p.KeepLast:
+			drop = append(drop, c.ID)
+		case p.MaxAge > 0 && now.Sub(c.CreatedAt) > p.MaxAge && !pending[c.ID]:
+			drop = append(drop, c.ID)
+		}
+	}
+	return drop
+}
+
+// inProgress reports whether cp was written by a fan-out branch or a map
+// item, or by a cancellation, before the node that started them completed.
+func inProgress(cp *storage.Checkpoint) bool {
+	_, branch := cp.Metadata[metaBranch]
+	_, item := cp.Metadata[metaMapItem]
+	return branch || item || isTrue(cp.Metadata[metaUnfinished])
+}
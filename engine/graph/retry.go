@@ -0,0 +1,121 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrorKey is the state key that holds the failure of a node routed through
+// an error edge, as a map with "node" and "error" entries.
+const ErrorKey = "_error"
+
+// RetryPolicy controls how a failing node is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the wait before the second attempt; it doubles after each
+	// further failure, up to MaxDelay (0 means no limit).
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds each attempt through the context passed to the node.
+	// 0 means no timeout.
+	Timeout time.Duration
+	// RetryableError optionally classifies errors. If nil, all errors are retried.
+	RetryableError func(err error) bool
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	return p != nil && (p.RetryableError == nil || p.RetryableError(err))
+}
+
+// delay returns the wait after the given failed attempt (1-based). Without
+// a MaxDelay the doubling stops at the largest Duration instead of
+// overflowing.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	limit := p.MaxDelay
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	d := min(p.BaseDelay, limit)
+	for i := 1; i < attempt && d < limit; i++ {
+		if d > limit/2 {
+			d = limit
+		} else {
+			d *= 2
+		}
+	}
+	return d
+}
+
+// runNode invokes node, retrying failed attempts according to its retry
+// policy. Each attempt gets its own copy of state, so that changes a failed
+// attempt made in place are not seen by the next. Every failed attempt is
+// recorded in the ledger; attempts is the number of attempts made.
+func (r *Runner) runNode(ctx context.Context, rs *RunState, node *Node, state State, rp *resumePoint, branchID string) (update State, paused *RunState, attempts int, err error) {
+	p := node.Retry
+	rec, _ := ctx.Value(recorderKey{}).(*callRecorder)
+	ctx = withStreamWriter(ctx, r, node.ID, branchID)
+	for attempts = 1; ; attempts++ {
+		update, paused, err = r.attempt(ctx, rs, node, copyState(state), rp)
+		if err == nil {
+			return update, paused, attempts, nil
+		}
+		if rec != nil && rec.divergence() != nil {
+			return nil, nil, attempts, err
+		}
+		payload := map[string]any{"node": node.ID, "attempt": attempts, "error": err.Error()}
+		if branchID != "" {
+			payload["branch"] = branchID
+		}
+		r.appendEvent(ctx, rs, r.nextSeq(rs), "node_attempt", payload)
+		if attempts >= p.maxAttempts() || ctx.Err() != nil || !p.retryable(err) {
+			return nil, nil, attempts, err
+		}
+		r.emit(StreamEvent{Type: "retry", NodeID: node.ID, Branch: branchID, Error: err.Error()})
+		select {
+		case <-ctx.Done():
+			return nil, nil, attempts, err
+		case <-time.After(p.delay(attempts)):
+		}
+		// A paused subgraph is only resumed by the first attempt; retries
+		// start it over.
+		rp = nil
+		if rec != nil {
+			rec.reset()
+		}
+	}
+}
+
+// attempt runs node once, bounded by the retry policy's timeout.
+func (r *Runner) attempt(ctx context.Context, rs *RunState, node *Node, state State, rp *resumePoint) (State, *RunState, error) {
+	if node.Retry == nil || node.Retry.Timeout <= 0 {
+		return r.invoke(ctx, rs, node, state, rp)
+	}
+	actx, cancel := context.WithTimeout(ctx, node.Retry.Timeout)
+	defer cancel()
+	update, paused, err := r.invoke(actx, rs, node, state, rp)
+	if err != nil && ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("attempt timed out after %s: %w", node.Retry.Timeout, err)
+	}
+	return update, paused, err
+}
+
+// errorUpdate is the update recorded for a node whose failure is routed
+// through its error edge.
+func errorUpdate(nodeID string, err error) State {
+	return State{ErrorKey: map[string]any{"node": nodeID, "error": err.Error()}}
+}
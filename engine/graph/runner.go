@@ -2,46 +2,81 @@ package graph
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/spawn08/chronos/storage"
 )
 
+// Checkpoint metadata keys written by the runner so that a run can be resumed
+// at the right place.
+const (
+	metaNext   = "next"    // node to execute when resuming from the checkpoint
+	metaFanOut = "fan_out" // the checkpointed node's branches have not merged yet
+	metaBranch = "branch"  // fan-out branch the checkpoint belongs to
+	metaDelta  = "delta"   // a branch's updates folded together, merged at the join
+
+	metaInterrupt = "interrupt" // the run paused before the next node
+	metaPrompt    = "prompt"    // payload of the interrupt the run paused at
+)
+
 // Runner executes a CompiledGraph with durable checkpointing.
 type Runner struct {
 	graph  *CompiledGraph
 	store  storage.Storage
-	stream chan StreamEvent
+	hub    *streamHub                  // subscriptions waiting for a run; shared by all runs
+	stream *runStream                  // subscriptions of the run being executed; see begin
+	runID  string                      // top-level run being executed, set by track
+	ns     string                      // subgraph node path when running as a nested graph
+	replay *replayLog                  // recording served during Replay; nothing is persisted
+	guard  func(context.Context) error // renews a worker's lease on the run; see Worker
+
+	// mu guards RunState.SeqNum while fan-out branches checkpoint concurrently.
+	mu sync.Mutex
 }
 
 // NewRunner creates a runner for the given compiled graph.
 func NewRunner(g *CompiledGraph, store storage.Storage) *Runner {
 	return &Runner{
-		graph:  g,
-		store:  store,
-		stream: make(chan StreamEvent, 256),
+		graph: g,
+		store: store,
+		hub:   &streamHub{size: defaultStreamBuffer},
 	}
 }
 
-// Stream returns a channel of execution events for real-time observability.
+// Stream returns a channel of the execution events of the next run the
+// runner starts or resumes, for real-time observability. The channel is
+// closed when that run stops. It is shorthand for Subscribe("").Events().
 func (r *Runner) Stream() <-chan StreamEvent {
-	return r.stream
+	return r.Subscribe("").Events()
 }
 
 func (r *Runner) emit(evt StreamEvent) {
 	evt.Timestamp = time.Now()
-	select {
-	case r.stream <- evt:
-	default:
+	if evt.Namespace == "" {
+		evt.Namespace = r.ns
+	}
+	if evt.RunID == "" {
+		evt.RunID = r.runID
+	}
+	if r.stream != nil {
+		r.stream.send(evt)
 	}
 }
 
 // Run starts a new execution of the graph with the given initial state.
 func (r *Runner) Run(ctx context.Context, sessionID string, initial State) (*RunState, error) {
-	runID := fmt.Sprintf("run_%d", time.Now().UnixNano())
+	initial, err := r.graph.conform(initial)
+	if err != nil {
+		return nil, fmt.Errorf("run: initial state: %w", err)
+	}
+	r, end := r.begin(sessionID)
+	defer end()
 	rs := &RunState{
-		RunID:       runID,
+		RunID:       newRunID(),
 		SessionID:   sessionID,
 		GraphID:     r.graph.ID,
 		CurrentNode: r.graph.Entry,
@@ -51,36 +86,49 @@ func (r *Runner) Run(ctx context.Context, sessionID string, initial State) (*Run
 		StartedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
+	r.appendEvent(ctx, rs, r.nextSeq(rs), "run_started", map[string]any{"graph": r.graph.ID, "state": initial})
 
+	ctx, done := r.track(ctx, rs)
+	defer done()
 	return r.execute(ctx, rs)
 }
 
 // Resume continues execution from the latest checkpoint for the given session.
 func (r *Runner) Resume(ctx context.Context, sessionID string) (*RunState, error) {
+	return r.ResumeWith(ctx, sessionID, nil)
+}
+
+// ResumeWith continues a run paused at an interrupt node. input carries the
+// human response (an approval decision, edited state or a free-text reply);
+// it is merged into the state through the graph's reducers, after which the
+// interrupt node runs. A nil input resumes without changing the state.
+func (r *Runner) ResumeWith(ctx context.Context, sessionID string, input State) (*RunState, error) {
 	cp, err := r.store.GetLatestCheckpoint(ctx, sessionID)
 	if err != nil {
 		return nil, fmt.Errorf("resume: no checkpoint found: %w", err)
 	}
-
-	rs := &RunState{
-		RunID:       cp.RunID,
-		SessionID:   sessionID,
-		GraphID:     r.graph.ID,
-		CurrentNode: cp.NodeID,
-		Status:      RunStatusRunning,
-		State:       State(cp.State),
-		SeqNum:      cp.SeqNum,
-		UpdatedAt:   time.Now(),
-	}
-
-	return r.execute(ctx, rs)
+	r, end := r.begin(sessionID)
+	defer end()
+	return r.resume(ctx, cp, input)
 }
 
-// ResumeFromCheckpoint resumes from a specific checkpoint (time-travel).
+// ResumeFromCheckpoint resumes from a specific checkpoint (time-travel). The
+// execution continues as a new run forked from the checkpoint; see Fork.
 func (r *Runner) ResumeFromCheckpoint(ctx context.Context, checkpointID string) (*RunState, error) {
-	cp, err := r.store.GetCheckpoint(ctx, checkpointID)
+	return r.Fork(ctx, checkpointID, nil)
+}
+
+// resume rebuilds the run state recorded in cp and continues execution from
+// the node that follows it. input is only accepted when cp paused the run at
+// an interrupt.
+func (r *Runner) resume(ctx context.Context, cp *storage.Checkpoint, input State) (*RunState, error) {
+	cp, err := r.graph.migrate(cp)
 	if err != nil {
-		return nil, fmt.Errorf("resume from checkpoint: %w", err)
+		return nil, fmt.Errorf("resume: %w", err)
+	}
+	interrupted := r.interrupted(cp)
+	if input != nil && !interrupted {
+		return nil, fmt.Errorf("resume: checkpoint %q is not paused at an interrupt", cp.ID)
 	}
 
 	rs := &RunState{
@@ -89,14 +137,73 @@ func (r *Runner) ResumeFromCheckpoint(ctx context.Context, checkpointID string)
 		GraphID:     r.graph.ID,
 		CurrentNode: cp.NodeID,
 		Status:      RunStatusRunning,
-		State:       State(cp.State),
 		SeqNum:      cp.SeqNum,
 		UpdatedAt:   time.Now(),
 	}
+	state, err := r.graph.conform(State(cp.State))
+	if err != nil {
+		return nil, fmt.Errorf("resume: checkpoint %q: %w", cp.ID, err)
+	}
+	rs.State = state
+	restoreLimits(rs, cp)
+	ctx, done := r.track(ctx, rs)
+	defer done()
 
+	if _, ok := cp.Metadata[metaBranch]; ok || isTrue(cp.Metadata[metaUnfinished]) && isTrue(cp.Metadata[metaFanOut]) {
+		return r.resumeFanOut(ctx, rs, cp)
+	}
+	if at, ok := wakeAt(cp); ok {
+		if time.Now().Before(at) {
+			return nil, fmt.Errorf("resume: run %q waits until %s: %w", cp.RunID, at.Format(time.RFC3339), ErrNotDue)
+		}
+		// The timer node runs instead of waiting again.
+		rs.resumed = &resumePoint{}
+	}
+	if pending, _ := cp.Metadata[metaFanOut].(bool); pending {
+		return r.continueFanOut(ctx, rs, cp, nil)
+	}
+	if _, ok := cp.Metadata[metaMapItem]; ok || isTrue(cp.Metadata[metaUnfinished]) {
+		done, err := mapProgress(ctx, r.store, cp)
+		if err != nil {
+			return nil, fmt.Errorf("resume map %q: %w", cp.NodeID, err)
+		}
+		rs.resumed = &resumePoint{mapped: done}
+	}
+	// Checkpoints written before next-node tracking re-run their own node.
+	if next, ok := cp.Metadata[metaNext].(string); ok {
+		if next == EndNode {
+			rs.Status = RunStatusCompleted
+			return rs, nil
+		}
+		rs.CurrentNode = next
+	}
+	if interrupted {
+		rp := &resumePoint{input: input}
+		rp.subgraph, _ = cp.Metadata[metaSubgraph].(string)
+		if rp.subgraph == "" {
+			if rs.State, err = r.graph.conform(r.graph.Apply(rs.State, input)); err != nil {
+				return nil, fmt.Errorf("resume: input: %w", err)
+			}
+		}
+		rs.resumed = rp
+	}
 	return r.execute(ctx, rs)
 }
 
+// interrupted reports whether cp paused the run at an interrupt node.
+func (r *Runner) interrupted(cp *storage.Checkpoint) bool {
+	if v, ok := cp.Metadata[metaInterrupt].(bool); ok {
+		return v
+	}
+	// Checkpoints written before next-node tracking were saved at the
+	// interrupt node itself, before it ran.
+	if _, ok := cp.Metadata[metaNext]; !ok {
+		n := r.graph.Nodes[cp.NodeID]
+		return n != nil && n.Interrupt
+	}
+	return false
+}
+
 func (r *Runner) execute(ctx context.Context, rs *RunState) (*RunState, error) {
 	for rs.Status == RunStatusRunning {
 		node, ok := r.graph.Nodes[rs.CurrentNode]
@@ -104,80 +211,550 @@ func (r *Runner) execute(ctx context.Context, rs *RunState) (*RunState, error) {
 			rs.Status = RunStatusFailed
 			return rs, fmt.Errorf("node %q not found", rs.CurrentNode)
 		}
+		if err := r.checkLease(ctx); err != nil {
+			return rs, err
+		}
+		r.pollCancel(ctx, rs)
+		if cancelled(ctx) {
+			return r.abort(ctx, rs, node.ID, map[string]any{metaNext: node.ID})
+		}
+
+		// A resumed interrupt node runs instead of pausing again.
+		rp := rs.resumed
+		rs.resumed = nil
+
+		rec, recorded, err := r.recorderFor("", node)
+		if err != nil {
+			rs.Status = RunStatusFailed
+			return rs, err
+		}
+		if recorded != nil && node.Interrupt && rp == nil {
+			// The recorded human input stands in for the resume.
+			rp = &resumePoint{input: recorded.input}
+			if rs.State, err = r.graph.conform(r.graph.Apply(rs.State, recorded.input)); err != nil {
+				rs.Status = RunStatusFailed
+				return rs, fmt.Errorf("node %q: input: %w", node.ID, err)
+			}
+		}
 
 		// Check for interrupt (human-in-the-loop pause)
-		if node.Interrupt {
-			rs.Status = RunStatusPaused
-			r.emit(StreamEvent{Type: "interrupt", NodeID: node.ID, State: rs.State})
-			if err := r.checkpoint(ctx, rs); err != nil {
-				return rs, fmt.Errorf("checkpoint on interrupt: %w", err)
+		if node.Interrupt && rp == nil {
+			var prompt any
+			if node.Prompt != nil {
+				prompt = node.Prompt(rs.State)
 			}
-			return rs, nil
+			return r.pause(ctx, rs, node.ID, prompt, "")
+		}
+		// A timer node suspends the run until it is due; replays do not wait.
+		if node.Wake != nil && rp == nil && r.replay == nil {
+			if at := node.Wake(rs.State); at.After(time.Now()) {
+				return r.wait(ctx, rs, node.ID, at)
+			}
+		}
+
+		if err := r.step(rs, "", node, rs.State); err != nil {
+			rs.Status = RunStatusLimitExceeded
+			r.emit(StreamEvent{Type: "error", NodeID: node.ID, Error: err.Error()})
+			return rs, err
 		}
 
 		// Execute node
 		r.emit(StreamEvent{Type: "node_start", NodeID: node.ID, State: rs.State})
-		newState, err := node.Fn(ctx, rs.State)
+		update, paused, attempts, err := r.runNode(withRecorder(ctx, rec), rs, node, rs.State, rp, "")
+		if div := rec.divergence(); div != nil {
+			rs.Status = RunStatusFailed
+			return rs, div
+		}
+		if err != nil && cancelled(ctx) {
+			// The node runs again when the run is resumed. A map node's
+			// completed items are checkpointed already and are not run again.
+			if node.Map != nil {
+				return r.abort(ctx, rs, node.ID, map[string]any{metaNext: node.ID, metaUnfinished: true})
+			}
+			return r.abort(ctx, rs, node.ID, map[string]any{metaNext: node.ID})
+		}
+		// A failure routed through an error edge is recorded like an update
+		// and continues at the recovery node.
+		next := ""
 		if err != nil {
+			r.emit(StreamEvent{Type: "error", NodeID: node.ID, Error: err.Error()})
+			if node.OnError == "" {
+				rs.Status = failedStatus(err)
+				return rs, fmt.Errorf("node %q: %w", node.ID, err)
+			}
+			update, next = errorUpdate(node.ID, err), node.OnError
+		}
+		if paused != nil {
+			// An interrupt inside the subgraph pauses this run too; resuming
+			// it resumes the subgraph run.
+			return r.pause(ctx, rs, node.ID, paused.Interrupt, paused.RunID)
+		}
+		if recorded != nil {
+			if div := recorded.compare(update); div != nil {
+				rs.Status = RunStatusFailed
+				return rs, div
+			}
+		}
+		if rs.State, err = r.graph.conform(r.graph.Apply(rs.State, update)); err != nil {
 			rs.Status = RunStatusFailed
 			r.emit(StreamEvent{Type: "error", NodeID: node.ID, Error: err.Error()})
 			return rs, fmt.Errorf("node %q: %w", node.ID, err)
 		}
-		rs.State = newState
-		rs.SeqNum++
-		rs.UpdatedAt = time.Now()
 		r.emit(StreamEvent{Type: "node_end", NodeID: node.ID, State: rs.State})
 
+		// Find next node (or fan-out) before checkpointing so the checkpoint
+		// records where a resume has to continue.
+		var fan *Edge
+		if next == "" {
+			fan = r.fanOut(node.ID)
+		}
+		meta := map[string]any{}
+		if fan != nil {
+			meta[metaFanOut] = true
+			meta[metaNext] = fan.Join
+		} else if next != "" {
+			meta[metaNext] = next
+		} else {
+			next, err = r.findNext(node.ID, rs.State)
+			if err != nil {
+				rs.Status = RunStatusFailed
+				r.emit(StreamEvent{Type: "error", NodeID: node.ID, Error: err.Error()})
+				return rs, err
+			}
+			meta[metaNext] = next
+		}
+
 		// Checkpoint after each node
-		if err := r.checkpoint(ctx, rs); err != nil {
+		cp, err := r.checkpoint(ctx, rs, node.ID, rs.State, meta)
+		if err != nil {
+			if cancelled(ctx) {
+				return r.abort(ctx, rs, node.ID, map[string]any{metaNext: node.ID})
+			}
 			return rs, fmt.Errorf("checkpoint: %w", err)
 		}
+		payload := nodePayload(node.ID, "", update, rs.State, attempts, rec.calls)
+		if rp != nil && rp.subgraph == "" && rp.input != nil {
+			payload["input"] = rp.input
+		}
+		r.appendEvent(ctx, rs, cp.SeqNum, "node_executed", payload)
 
-		// Append event to ledger
-		_ = r.store.AppendEvent(ctx, &storage.Event{
-			ID:        fmt.Sprintf("evt_%s_%d", rs.RunID, rs.SeqNum),
-			SessionID: rs.SessionID,
-			SeqNum:    rs.SeqNum,
-			Type:      "node_executed",
-			Payload:   map[string]any{"node": node.ID, "state": rs.State},
-			CreatedAt: time.Now(),
-		})
-
-		// Find next node
-		next := r.findNext(rs.CurrentNode, rs.State)
-		if next == EndNode || next == "" {
+		switch {
+		case fan != nil:
+			if err := r.runFanOut(ctx, rs, fan, rs.State, nil); err != nil {
+				if cancelled(ctx) {
+					return r.abort(ctx, rs, fan.From, unfinishedFanOut(fan))
+				}
+				rs.Status = failedStatus(err)
+				return rs, err
+			}
+			r.emit(StreamEvent{Type: "edge_transition", NodeID: fan.Join})
+			rs.CurrentNode = fan.Join
+		case next == EndNode:
 			rs.Status = RunStatusCompleted
 			r.emit(StreamEvent{Type: "completed", State: rs.State})
-		} else {
+		default:
 			r.emit(StreamEvent{Type: "edge_transition", NodeID: next})
 			rs.CurrentNode = next
 		}
 	}
 
-	defer close(r.stream)
 	return rs, nil
 }
 
-func (r *Runner) findNext(from string, state State) string {
-	edges := r.graph.AdjList[from]
-	for _, e := range edges {
-		if e.Condition != nil {
-			return e.Condition(state)
+// pause checkpoints rs as paused before nodeID. subgraphRun is set when the
+// pause comes from an interrupt inside the node's subgraph.
+func (r *Runner) pause(ctx context.Context, rs *RunState, nodeID string, prompt any, subgraphRun string) (*RunState, error) {
+	rs.Status = RunStatusPaused
+	rs.Interrupt = prompt
+	r.emit(StreamEvent{Type: "interrupt", NodeID: nodeID, State: rs.State, Payload: prompt})
+	meta := map[string]any{metaNext: nodeID, metaInterrupt: true}
+	if prompt != nil {
+		meta[metaPrompt] = prompt
+	}
+	if subgraphRun != "" {
+		meta[metaSubgraph] = subgraphRun
+	}
+	if _, err := r.checkpoint(ctx, rs, nodeID, rs.State, meta); err != nil {
+		return rs, fmt.Errorf("checkpoint on interrupt: %w", err)
+	}
+	return rs, nil
+}
+
+// invoke runs node on state and returns its update. For subgraph nodes, rp
+// resumes a paused subgraph run, and paused is the subgraph's run state when
+// it paused on an interrupt.
+func (r *Runner) invoke(ctx context.Context, rs *RunState, node *Node, state State, rp *resumePoint) (update State, paused *RunState, err error) {
+	switch {
+	case node.Map != nil:
+		if r.replay != nil {
+			return nil, nil, fmt.Errorf("replaying map node %q is not supported", node.ID)
+		}
+		var done map[int]any
+		if rp != nil {
+			done = rp.mapped
 		}
-		return e.To
+		update, err = r.runMap(ctx, rs, node, state, done)
+		return update, nil, err
+	case node.Subgraph == nil:
+		update, err = node.Fn(ctx, state)
+		return update, nil, err
 	}
-	return ""
+	if r.replay != nil {
+		return nil, nil, fmt.Errorf("replaying subgraph node %q is not supported", node.ID)
+	}
+	return r.runSubgraph(ctx, rs, node, state, rp)
+}
+
+// branch tracks one fan-out branch while it runs.
+type branch struct {
+	id    string // target node that starts the branch
+	next  string // next node to execute within the branch
+	state State  // full state as seen by the branch's nodes
+	delta State  // the branch's own updates, merged into the join
 }
 
-func (r *Runner) checkpoint(ctx context.Context, rs *RunState) error {
+func (b *branch) done(join string) bool {
+	return b.next == join || b.next == EndNode
+}
+
+// runFanOut executes the unfinished branches of fan concurrently, starting
+// from base, and stores their merged result in rs.State. Branches already
+// present in restored (rebuilt from checkpoints) are not re-run.
+func (r *Runner) runFanOut(ctx context.Context, rs *RunState, fan *Edge, base State, restored map[string]*branch) error {
+	r.emit(StreamEvent{Type: "fan_out", NodeID: fan.From, State: base})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	branches := make([]*branch, len(fan.Targets))
+	errs := make([]error, len(fan.Targets))
+	var wg sync.WaitGroup
+	for i, target := range fan.Targets {
+		b := restored[target]
+		if b == nil {
+			b = &branch{id: target, next: target, state: copyState(base), delta: State{}}
+		}
+		branches[i] = b
+		if b.done(fan.Join) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, b *branch) {
+			defer wg.Done()
+			if err := r.runBranch(ctx, rs, fan, b); err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i, b)
+	}
+	wg.Wait()
+
+	// Prefer the error that caused the cancellation over the cancellations.
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if firstErr == nil || errors.Is(firstErr, context.Canceled) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	merged, err := r.graph.conform(r.mergeBranches(fan, base, branches))
+	if err != nil {
+		return fmt.Errorf("join %q: %w", fan.Join, err)
+	}
+	rs.State = merged
+	r.emit(StreamEvent{Type: "join", NodeID: fan.Join, State: rs.State})
+	return nil
+}
+
+// runBranch executes one branch node by node until it reaches the join node
+// (or the end of the graph), checkpointing after every node.
+func (r *Runner) runBranch(ctx context.Context, rs *RunState, fan *Edge, b *branch) error {
+	for !b.done(fan.Join) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.checkLease(ctx); err != nil {
+			return err
+		}
+		node, ok := r.graph.Nodes[b.next]
+		if !ok {
+			return fmt.Errorf("branch %q: node %q not found", b.id, b.next)
+		}
+		if node.Interrupt {
+			return fmt.Errorf("branch %q: interrupt node %q cannot run inside a fan-out", b.id, node.ID)
+		}
+		if node.Wake != nil {
+			return fmt.Errorf("branch %q: timer node %q cannot run inside a fan-out", b.id, node.ID)
+		}
+		if node.Map != nil {
+			return fmt.Errorf("branch %q: map node %q cannot run inside a fan-out", b.id, node.ID)
+		}
+		if r.fanOut(node.ID) != nil {
+			return fmt.Errorf("branch %q: nested fan-out from %q is not supported", b.id, node.ID)
+		}
+
+		if err := r.step(rs, b.id, node, b.state); err != nil {
+			return err
+		}
+		rec, recorded, err := r.recorderFor(b.id, node)
+		if err != nil {
+			return err
+		}
+		r.emit(StreamEvent{Type: "node_start", NodeID: node.ID, Branch: b.id, State: b.state})
+		update, paused, attempts, err := r.runNode(withRecorder(ctx, rec), rs, node, b.state, nil, b.id)
+		if div := rec.divergence(); div != nil {
+			return div
+		}
+		if err == nil && paused != nil {
+			err = fmt.Errorf("subgraph paused on an interrupt inside fan-out branch %q", b.id)
+		}
+		routed := ""
+		if err != nil {
+			r.emit(StreamEvent{Type: "error", NodeID: node.ID, Branch: b.id, Error: err.Error()})
+			if node.OnError == "" || paused != nil {
+				return fmt.Errorf("node %q: %w", node.ID, err)
+			}
+			update, routed = errorUpdate(node.ID, err), node.OnError
+		}
+		if recorded != nil {
+			if div := recorded.compare(update); div != nil {
+				return div
+			}
+		}
+		if b.state, err = r.graph.conform(r.graph.Apply(b.state, update)); err != nil {
+			r.emit(StreamEvent{Type: "error", NodeID: node.ID, Branch: b.id, Error: err.Error()})
+			return fmt.Errorf("node %q: %w", node.ID, err)
+		}
+		applyUpdate(b.delta, update, r.graph.Reducers, nil)
+		if routed != "" {
+			b.next = routed
+		} else if b.next, err = r.findNext(node.ID, b.state); err != nil {
+			return err
+		}
+		r.emit(StreamEvent{Type: "node_end", NodeID: node.ID, Branch: b.id, State: b.state})
+
+		cp, err := r.checkpoint(ctx, rs, node.ID, b.state, map[string]any{
+			metaNext:   b.next,
+			metaBranch: b.id,
+			metaDelta:  copyState(b.delta),
+		})
+		if err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+		r.appendEvent(ctx, rs, cp.SeqNum, "node_executed", nodePayload(node.ID, b.id, update, b.state, attempts, rec.calls))
+	}
+	return nil
+}
+
+// mergeBranches applies each branch's updates to base, in declaration order.
+// The join node's reducers take precedence over the graph's; keys without
+// either take the value of the last branch that wrote them.
+func (r *Runner) mergeBranches(fan *Edge, base State, branches []*branch) State {
+	join := r.graph.Nodes[fan.Join]
+	merged := copyState(base)
+	for _, b := range branches {
+		applyUpdate(merged, b.delta, r.graph.Reducers, join.Reducers)
+	}
+	return merged
+}
+
+// resumeFanOut restores a run that stopped while fan-out branches were
+// executing. cp is a branch checkpoint; the fan-out itself starts at the last
+// non-branch checkpoint of the run before it.
+func (r *Runner) resumeFanOut(ctx context.Context, rs *RunState, cp *storage.Checkpoint) (*RunState, error) {
+	cps, err := r.store.ListCheckpoints(ctx, cp.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("resume fan-out: %w", err)
+	}
+	var base *storage.Checkpoint
+	var restored map[string]*branch
+	for _, c := range cps {
+		if c.RunID != cp.RunID || c.SeqNum > cp.SeqNum {
+			continue
+		}
+		if c, err = r.graph.migrate(c); err != nil {
+			return nil, fmt.Errorf("resume fan-out: %w", err)
+		}
+		if isTrue(c.Metadata[metaUnfinished]) {
+			// An earlier cancellation of this fan-out.
+			continue
+		}
+		id, ok := c.Metadata[metaBranch].(string)
+		if !ok {
+			base = c
+			restored = make(map[string]*branch)
+			continue
+		}
+		next, _ := c.Metadata[metaNext].(string)
+		delta, _ := c.Metadata[metaDelta].(map[string]any)
+		if delta == nil {
+			delta = map[string]any{}
+		}
+		state, err := r.graph.conform(State(c.State))
+		if err == nil {
+			delta, err = r.graph.conform(State(delta))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resume fan-out: checkpoint %q: %w", c.ID, err)
+		}
+		restored[id] = &branch{id: id, next: next, state: state, delta: State(delta)}
+	}
+	if base == nil {
+		return nil, fmt.Errorf("resume fan-out: no fan-out checkpoint before %q", cp.ID)
+	}
+	return r.continueFanOut(ctx, rs, base, restored)
+}
+
+// continueFanOut runs the fan-out leaving base's node, then continues the
+// main loop at its join node.
+func (r *Runner) continueFanOut(ctx context.Context, rs *RunState, base *storage.Checkpoint, restored map[string]*branch) (*RunState, error) {
+	fan := r.fanOut(base.NodeID)
+	if fan == nil {
+		rs.Status = RunStatusFailed
+		return rs, fmt.Errorf("resume: node %q has no fan-out edge", base.NodeID)
+	}
+	state, err := r.graph.conform(State(base.State))
+	if err != nil {
+		rs.Status = RunStatusFailed
+		return rs, fmt.Errorf("resume: checkpoint %q: %w", base.ID, err)
+	}
+	if err := r.runFanOut(ctx, rs, fan, state, restored); err != nil {
+		if cancelled(ctx) {
+			rs.State = state
+			return r.abort(ctx, rs, fan.From, unfinishedFanOut(fan))
+		}
+		rs.Status = failedStatus(err)
+		return rs, err
+	}
+	rs.CurrentNode = fan.Join
+	return r.execute(ctx, rs)
+}
+
+// unfinishedFanOut returns the metadata of the checkpoint written when a
+// run is cancelled during fan.
+func unfinishedFanOut(fan *Edge) map[string]any {
+	return map[string]any{metaFanOut: true, metaNext: fan.Join, metaUnfinished: true}
+}
+
+// fanOut returns the fan-out edge leaving the given node, if any.
+func (r *Runner) fanOut(from string) *Edge {
+	for _, e := range r.graph.AdjList[from] {
+		if len(e.Targets) > 0 {
+			return e
+		}
+	}
+	return nil
+}
+
+// findNext returns the node that follows from, or EndNode when the graph
+// ends there. A conditional edge that declared its routes may only return
+// one of them.
+func (r *Runner) findNext(from string, state State) (string, error) {
+	edges := r.graph.AdjList[from]
+	if len(edges) == 0 {
+		return EndNode, nil
+	}
+	e := edges[0]
+	if e.Condition == nil {
+		return e.To, nil
+	}
+	next := e.Condition(state)
+	if next == "" {
+		return EndNode, nil
+	}
+	if len(e.Routes) > 0 && !slices.Contains(e.Routes, next) {
+		return "", fmt.Errorf("conditional edge from %q returned undeclared route %q", from, next)
+	}
+	return next, nil
+}
+
+// checkpoint persists state after nodeID and returns the saved checkpoint.
+// The sequence number and timestamp are taken under the runner's lock so
+// concurrent branches are stored in a consistent order.
+func (r *Runner) checkpoint(ctx context.Context, rs *RunState, nodeID string, state State, meta map[string]any) (*storage.Checkpoint, error) {
+	if meta == nil {
+		meta = make(map[string]any)
+	}
+	meta[metaGraph] = r.graph.ID
+	if r.graph.Version != "" {
+		meta[metaVersion] = r.graph.Version
+	}
+	r.mu.Lock()
+	recordLimits(rs, meta)
+	rs.SeqNum++
+	rs.UpdatedAt = time.Now()
 	cp := &storage.Checkpoint{
 		ID:        fmt.Sprintf("cp_%s_%d", rs.RunID, rs.SeqNum),
 		SessionID: rs.SessionID,
 		RunID:     rs.RunID,
-		NodeID:    rs.CurrentNode,
-		State:     rs.State,
+		NodeID:    nodeID,
+		State:     state,
 		SeqNum:    rs.SeqNum,
+		Metadata:  meta,
+		CreatedAt: rs.UpdatedAt,
+	}
+	r.mu.Unlock()
+	if r.replay != nil {
+		return cp, nil
+	}
+	if err := r.checkLease(ctx); err != nil {
+		return nil, err
+	}
+	return cp, r.store.SaveCheckpoint(ctx, cp)
+}
+
+func newRunID() string {
+	return fmt.Sprintf("run_%d", time.Now().UnixNano())
+}
+
+// nextSeq allocates a sequence number for a ledger event that has no
+// checkpoint of its own.
+func (r *Runner) nextSeq(rs *RunState) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rs.SeqNum++
+	return rs.SeqNum
+}
+
+// nodePayload builds the ledger payload of a node_executed event.
+func nodePayload(nodeID, branchID string, update, state State, attempts int, calls []RecordedCall) map[string]any {
+	payload := map[string]any{"node": nodeID, "update": update, "state": state, "attempts": attempts}
+	if branchID != "" {
+		payload["branch"] = branchID
+	}
+	if len(calls) > 0 {
+		payload["calls"] = calls
+	}
+	return payload
+}
+
+// appendEvent records an event of the run in the session's event ledger.
+func (r *Runner) appendEvent(ctx context.Context, rs *RunState, seq int64, typ string, payload map[string]any) {
+	if r.replay != nil {
+		return
+	}
+	payload["run"] = rs.RunID
+	_ = r.store.AppendEvent(ctx, &storage.Event{
+		ID:        fmt.Sprintf("evt_%s_%d", rs.RunID, seq),
+		SessionID: rs.SessionID,
+		SeqNum:    seq,
+		Type:      typ,
+		Payload:   payload,
 		CreatedAt: time.Now(),
+	})
+}
+
+// copyState returns a shallow copy of s.
+func copyState(s State) State {
+	out := make(State, len(s))
+	for k, v := range s {
+		out[k] = v
 	}
-	return r.store.SaveCheckpoint(ctx, cp)
+	return out
 }
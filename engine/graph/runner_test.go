@@ -0,0 +1,1704 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spawn08/chronos/engine/model"
+	"github.com/spawn08/chronos/storage"
+	"github.com/spawn08/chronos/storage/adapters/sqlite"
+)
+
+func newTestStore(t *testing.T) *sqlite.Store {
+	t.Helper()
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatalf("New(:memory:): %v", err)
+	}
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// setKey returns a node whose update sets key to value.
+func setKey(key string, value any) NodeFunc {
+	return func(_ context.Context, _ State) (State, error) {
+		return State{key: value}, nil
+	}
+}
+
+func passthrough(_ context.Context, _ State) (State, error) { return nil, nil }
+
+func TestRunnerReducers(t *testing.T) {
+	g := New("reduce").
+		AddReducer("messages", AppendReducer).
+		AddReducer("count", SumReducer).
+		AddReducer("meta", MergeMapReducer).
+		AddNode("first", func(_ context.Context, _ State) (State, error) {
+			return State{"messages": "hello", "count": 1, "meta": map[string]any{"a": 1}}, nil
+		}).
+		AddNode("second", func(_ context.Context, _ State) (State, error) {
+			return State{"messages": []any{"world"}, "count": 2, "meta": map[string]any{"b": 2}}, nil
+		}).
+		SetEntryPoint("first").
+		AddEdge("first", "second").
+		SetFinishPoint("second")
+	compiled, err := g.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	rs, err := NewRunner(compiled, newTestStore(t)).Run(context.Background(), "s1", State{"messages": []any{"hi"}, "keep": "me"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := State{
+		"messages": []any{"hi", "hello", "world"},
+		"count":    3,
+		"meta":     map[string]any{"a": 1, "b": 2},
+		"keep":     "me",
+	}
+	if !reflect.DeepEqual(rs.State, want) {
+		t.Errorf("state = %v, want %v", rs.State, want)
+	}
+}
+
+func TestTypedReducerConvertsCheckpointValues(t *testing.T) {
+	add := TypedReducer(func(current, update int) int { return current + update })
+	// float64 is what an int becomes after a JSON round trip.
+	if got := add(float64(2), 3); got != 5 {
+		t.Errorf("add(2.0, 3) = %v (%T), want 5", got, got)
+	}
+	if got := add(nil, 4); got != 4 {
+		t.Errorf("add(nil, 4) = %v, want 4", got)
+	}
+}
+
+func TestRunnerFanOutJoin(t *testing.T) {
+	concat := func(current, update any) any {
+		cur, _ := current.(string)
+		return cur + update.(string)
+	}
+
+	g := New("fan").
+		AddNode("split", passthrough).
+		AddNode("a", setKey("log", "a")).
+		AddNode("b", setKey("b", true)).
+		AddNode("c", setKey("log", "c")).
+		AddJoinNode("join", passthrough, map[string]Reducer{"log": concat}).
+		SetEntryPoint("split").
+		AddFanOut("split", "join", "a", "b", "c").
+		AddEdge("a", "join").
+		AddEdge("b", "join").
+		AddEdge("c", "join").
+		SetFinishPoint("join")
+	compiled, err := g.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	rs, err := NewRunner(compiled, newTestStore(t)).Run(context.Background(), "s1", State{"log": ""})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusCompleted {
+		t.Fatalf("expected completed, got %s", rs.Status)
+	}
+	if rs.State["log"] != "ac" {
+		t.Errorf("expected reduced log %q, got %v", "ac", rs.State["log"])
+	}
+	if rs.State["b"] != true {
+		t.Errorf("expected branch b's key to be merged, got %v", rs.State["b"])
+	}
+}
+
+// signalStore notifies when a checkpoint for the given branch is saved.
+type signalStore struct {
+	storage.Storage
+	branch string
+	saved  chan struct{}
+}
+
+func (s *signalStore) SaveCheckpoint(ctx context.Context, cp *storage.Checkpoint) error {
+	err := s.Storage.SaveCheckpoint(ctx, cp)
+	if cp.Metadata[metaBranch] == s.branch {
+		close(s.saved)
+	}
+	return err
+}
+
+func TestRunnerFanOutResumeSkipsFinishedBranches(t *testing.T) {
+	store := &signalStore{Storage: newTestStore(t), branch: "a", saved: make(chan struct{})}
+
+	var aRuns, bRuns atomic.Int32
+	g := New("fan").
+		AddNode("split", passthrough).
+		AddNode("a", func(ctx context.Context, s State) (State, error) {
+			aRuns.Add(1)
+			return setKey("a", "done")(ctx, s)
+		}).
+		AddNode("b", func(ctx context.Context, s State) (State, error) {
+			if bRuns.Add(1) == 1 {
+				<-store.saved
+				return nil, errors.New("transient")
+			}
+			return setKey("b", "done")(ctx, s)
+		}).
+		AddJoinNode("join", passthrough, nil).
+		SetEntryPoint("split").
+		AddFanOut("split", "join", "a", "b").
+		AddEdge("a", "join").
+		AddEdge("b", "join").
+		SetFinishPoint("join")
+	compiled, err := g.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := NewRunner(compiled, store).Run(ctx, "s1", State{}); err == nil {
+		t.Fatal("expected first run to fail")
+	}
+
+	rs, err := NewRunner(compiled, store).Resume(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if rs.Status != RunStatusCompleted {
+		t.Fatalf("expected completed, got %s", rs.Status)
+	}
+	if got := aRuns.Load(); got != 1 {
+		t.Errorf("finished branch a ran %d times, want 1", got)
+	}
+	if rs.State["a"] != "done" || rs.State["b"] != "done" {
+		t.Errorf("unexpected merged state: %v", rs.State)
+	}
+}
+
+func TestRunnerSubgraph(t *testing.T) {
+	sub, err := New("answer").
+		AddNode("retrieve", func(_ context.Context, s State) (State, error) {
+			return State{"docs": "docs for " + s["question"].(string)}, nil
+		}).
+		AddNode("answer", func(_ context.Context, s State) (State, error) {
+			return State{"answer": "from " + s["docs"].(string)}, nil
+		}).
+		SetEntryPoint("retrieve").
+		AddEdge("retrieve", "answer").
+		SetFinishPoint("answer").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile subgraph: %v", err)
+	}
+	compiled, err := New("parent").
+		AddSubgraph("rag", sub, map[string]string{"question": "query"}, map[string]string{"reply": "answer"}).
+		SetEntryPoint("rag").
+		SetFinishPoint("rag").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{"query": "go", "secret": "x"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := State{"query": "go", "secret": "x", "reply": "from docs for go"}
+	if !reflect.DeepEqual(rs.State, want) {
+		t.Errorf("state = %v, want %v", rs.State, want)
+	}
+
+	cps, err := store.ListCheckpoints(ctx, subgraphSession("s1", "rag"))
+	if err != nil {
+		t.Fatalf("ListCheckpoints: %v", err)
+	}
+	if len(cps) != 2 {
+		t.Fatalf("expected 2 subgraph checkpoints, got %d", len(cps))
+	}
+	if _, ok := cps[0].State["secret"]; ok {
+		t.Errorf("unmapped parent key leaked into subgraph state: %v", cps[0].State)
+	}
+}
+
+func TestRunnerSubgraphInterruptPausesParent(t *testing.T) {
+	sub, err := New("approve").
+		AddInterruptNode("review", setKey("approved", true)).
+		SetEntryPoint("review").
+		SetFinishPoint("review").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile subgraph: %v", err)
+	}
+	compiled, err := New("parent").
+		AddNode("draft", setKey("draft", "v1")).
+		AddSubgraph("approval", sub, nil, nil).
+		SetEntryPoint("draft").
+		AddEdge("draft", "approval").
+		SetFinishPoint("approval").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusPaused || rs.CurrentNode != "approval" {
+		t.Fatalf("expected parent paused at approval, got %s at %s", rs.Status, rs.CurrentNode)
+	}
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	childRun, _ := cp.Metadata[metaSubgraph].(string)
+	child, err := store.GetLatestCheckpoint(ctx, subgraphSession("s1", "approval"))
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint(subgraph): %v", err)
+	}
+	if child.RunID != childRun || child.NodeID != "review" {
+		t.Errorf("parent checkpoint points at run %q, subgraph paused in %q at %q", childRun, child.RunID, child.NodeID)
+	}
+	if child.State["draft"] != "v1" {
+		t.Errorf("subgraph did not receive parent state: %v", child.State)
+	}
+
+	rs, err = NewRunner(compiled, store).ResumeWith(ctx, "s1", State{"reviewer": "ann"})
+	if err != nil {
+		t.Fatalf("ResumeWith: %v", err)
+	}
+	if rs.Status != RunStatusCompleted {
+		t.Fatalf("expected completed, got %s", rs.Status)
+	}
+	if rs.State["approved"] != true || rs.State["reviewer"] != "ann" {
+		t.Errorf("subgraph result or input missing from parent state: %v", rs.State)
+	}
+}
+
+func TestRunnerInterruptResumeWithInput(t *testing.T) {
+	var ran atomic.Int32
+	compiled, err := New("approve").
+		AddNode("draft", setKey("draft", "v1")).
+		AddInterruptNodeWithPrompt("publish", func(_ context.Context, s State) (State, error) {
+			ran.Add(1)
+			if s["approved"] != true {
+				return State{"published": false}, nil
+			}
+			return State{"published": s["draft"]}, nil
+		}, func(s State) any {
+			return map[string]any{"question": "Publish draft?", "draft": s["draft"]}
+		}).
+		SetEntryPoint("draft").
+		AddEdge("draft", "publish").
+		SetFinishPoint("publish").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	runner := NewRunner(compiled, store)
+	stream := runner.Stream()
+	rs, err := runner.Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusPaused || ran.Load() != 0 {
+		t.Fatalf("expected pause before publish, got %s (ran %d)", rs.Status, ran.Load())
+	}
+	prompt, _ := rs.Interrupt.(map[string]any)
+	if prompt["question"] != "Publish draft?" || prompt["draft"] != "v1" {
+		t.Errorf("unexpected interrupt payload: %v", rs.Interrupt)
+	}
+	var evt StreamEvent
+	for e := range stream {
+		if e.Type == "interrupt" {
+			evt = e
+		}
+	}
+	if evt.Type != "interrupt" || evt.Payload == nil {
+		t.Errorf("expected interrupt event with payload, got %+v", evt)
+	}
+
+	rs, err = NewRunner(compiled, store).ResumeWith(ctx, "s1", State{"approved": true})
+	if err != nil {
+		t.Fatalf("ResumeWith: %v", err)
+	}
+	if rs.Status != RunStatusCompleted || ran.Load() != 1 {
+		t.Fatalf("expected publish to run once and complete, got %s (ran %d)", rs.Status, ran.Load())
+	}
+	if rs.State["published"] != "v1" {
+		t.Errorf("expected published draft, got %v", rs.State)
+	}
+
+	events, err := store.ListEvents(ctx, "s1", 0)
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	last, _ := events[len(events)-1].Payload.(map[string]any)
+	if input, _ := last["input"].(map[string]any); input["approved"] != true {
+		t.Errorf("ledger did not record the resume input: %v", last)
+	}
+
+	if _, err := NewRunner(compiled, store).ResumeWith(ctx, "s1", State{"approved": false}); err == nil {
+		t.Error("expected ResumeWith on a completed run to fail")
+	}
+}
+
+func TestRunnerRetryPolicy(t *testing.T) {
+	var calls atomic.Int32
+	flaky := func(ctx context.Context, s State) (State, error) {
+		switch calls.Add(1) {
+		case 1:
+			s["partial"] = true // must not leak into the next attempt
+			return nil, errors.New("rate limited")
+		case 2:
+			<-ctx.Done() // exceeds the attempt timeout
+			return nil, ctx.Err()
+		}
+		return State{"answer": 42, "saw_partial": s["partial"]}, nil
+	}
+	compiled, err := New("retry").
+		AddNode("llm", flaky).
+		SetRetryPolicy("llm", RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Timeout: 10 * time.Millisecond}).
+		SetEntryPoint("llm").
+		SetFinishPoint("llm").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.State["answer"] != 42 || calls.Load() != 3 {
+		t.Fatalf("expected success on attempt 3, got %v after %d calls", rs.State, calls.Load())
+	}
+	if rs.State["partial"] != nil || rs.State["saw_partial"] != nil {
+		t.Errorf("expected a failed attempt's changes discarded, got %v", rs.State)
+	}
+
+	events, err := store.ListEvents(ctx, "s1", 0)
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	want := []string{"run_started", "node_attempt", "node_attempt", "node_executed"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("ledger events = %v, want %v", types, want)
+	}
+	if msg, _ := events[2].Payload.(map[string]any)["error"].(string); !strings.Contains(msg, "timed out") {
+		t.Errorf("expected timeout error on attempt 2, got %q", msg)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{BaseDelay: time.Second}, 1, time.Second},
+		{RetryPolicy{BaseDelay: time.Second}, 4, 8 * time.Second},
+		{RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}, 100, 5 * time.Second},
+		{RetryPolicy{BaseDelay: time.Second}, 100, math.MaxInt64},
+		{RetryPolicy{}, 3, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.delay(tt.attempt); got != tt.want {
+			t.Errorf("%+v: delay(%d) = %v, want %v", tt.policy, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRunnerErrorEdge(t *testing.T) {
+	permanent := errors.New("invalid request")
+	var calls atomic.Int32
+	compiled, err := New("fallback").
+		AddNode("llm", func(_ context.Context, _ State) (State, error) {
+			calls.Add(1)
+			return nil, permanent
+		}).
+		AddNode("recover", func(_ context.Context, s State) (State, error) {
+			failure, _ := s[ErrorKey].(map[string]any)
+			return State{"recovered_from": failure["node"]}, nil
+		}).
+		SetRetryPolicy("llm", RetryPolicy{
+			MaxAttempts:    5,
+			RetryableError: func(err error) bool { return !errors.Is(err, permanent) },
+		}).
+		AddErrorEdge("llm", "recover").
+		SetEntryPoint("llm").
+		SetFinishPoint("llm").
+		SetFinishPoint("recover").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	rs, err := NewRunner(compiled, newTestStore(t)).Run(context.Background(), "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusCompleted || rs.State["recovered_from"] != "llm" {
+		t.Errorf("expected recovery from llm, got %s with %v", rs.Status, rs.State)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("non-retryable error was attempted %d times, want 1", got)
+	}
+}
+
+func TestRunnerForkLeavesOriginalRunIntact(t *testing.T) {
+	compiled, err := New("fork").
+		AddNode("a", setKey("a", 1)).
+		AddNode("b", func(_ context.Context, s State) (State, error) {
+			return State{"b": s["a"]}, nil
+		}).
+		SetEntryPoint("a").
+		AddEdge("a", "b").
+		SetFinishPoint("b").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	original, err := NewRunner(compiled, store).Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	before, err := store.ListCheckpoints(ctx, "s1")
+	if err != nil {
+		t.Fatalf("ListCheckpoints: %v", err)
+	}
+
+	forked, err := NewRunner(compiled, store).Fork(ctx, before[0].ID, State{"a": 7})
+	if err != nil {
+		t.Fatalf("Fork: %v", err)
+	}
+	if forked.RunID == original.RunID {
+		t.Fatal("fork reused the original run ID")
+	}
+	if forked.State["b"] != 7 {
+		t.Errorf("fork did not continue from the patched state: %v", forked.State)
+	}
+
+	for _, cp := range before {
+		got, err := store.GetCheckpoint(ctx, cp.ID)
+		if err != nil {
+			t.Fatalf("GetCheckpoint(%s): %v", cp.ID, err)
+		}
+		if !reflect.DeepEqual(got.State, cp.State) {
+			t.Errorf("checkpoint %s of the original run changed: %v -> %v", cp.ID, cp.State, got.State)
+		}
+	}
+
+	tree, err := RunTree(ctx, store, "s1")
+	if err != nil {
+		t.Fatalf("RunTree: %v", err)
+	}
+	if len(tree) != 1 || tree[0].RunID != original.RunID || len(tree[0].Forks) != 1 {
+		t.Fatalf("unexpected run tree: %+v", tree)
+	}
+	fork := tree[0].Forks[0]
+	if fork.RunID != forked.RunID || fork.ParentCheckpointID != before[0].ID {
+		t.Errorf("fork recorded parent %q, want %q", fork.ParentCheckpointID, before[0].ID)
+	}
+}
+
+func TestRunnerForkOfPausedRunWaitsForInput(t *testing.T) {
+	var approved atomic.Int32
+	compiled, err := New("approval").
+		AddNode("draft", setKey("text", "hello")).
+		AddInterruptNode("approve", func(_ context.Context, _ State) (State, error) {
+			approved.Add(1)
+			return State{"approved_ran": true}, nil
+		}).
+		SetEntryPoint("draft").
+		AddEdge("draft", "approve").
+		SetFinishPoint("approve").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	if _, err := NewRunner(compiled, store).Run(ctx, "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	paused, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+
+	for _, fork := range []func() (*RunState, error){
+		func() (*RunState, error) {
+			return NewRunner(compiled, store).Fork(ctx, paused.ID, State{"text": "edited"})
+		},
+		func() (*RunState, error) { return NewRunner(compiled, store).ResumeFromCheckpoint(ctx, paused.ID) },
+	} {
+		rs, err := fork()
+		if err != nil {
+			t.Fatalf("fork: %v", err)
+		}
+		if rs.Status != RunStatusPaused || rs.CurrentNode != "approve" || rs.State["approved_ran"] != nil {
+			t.Errorf("expected the fork to pause at approve, got %s at %s with %v", rs.Status, rs.CurrentNode, rs.State)
+		}
+	}
+	if n := approved.Load(); n != 0 {
+		t.Fatalf("interrupt node ran %d times without human input", n)
+	}
+	rs, err := NewRunner(compiled, store).ResumeWith(ctx, "s1", State{"ok": true})
+	if err != nil || rs.Status != RunStatusCompleted || approved.Load() != 1 {
+		t.Errorf("expected the fork to complete once resumed, got %v, %+v", err, rs)
+	}
+}
+
+func TestRunnerReplayServesRecordedCalls(t *testing.T) {
+	var live atomic.Int32
+	callModel := func(ctx context.Context, prompt string) (string, error) {
+		return Recorded(ctx, "model", "fake", func(context.Context) (string, error) {
+			return fmt.Sprintf("answer %d to %s", live.Add(1), prompt), nil
+		})
+	}
+	build := func(suffix string) *CompiledGraph {
+		compiled, err := New("replay").
+			AddNode("ask", func(ctx context.Context, s State) (State, error) {
+				answer, err := callModel(ctx, s["question"].(string))
+				return State{"answer": answer}, err
+			}).
+			AddNode("format", func(_ context.Context, s State) (State, error) {
+				return State{"reply": s["answer"].(string) + suffix}, nil
+			}).
+			SetEntryPoint("ask").
+			AddEdge("ask", "format").
+			SetFinishPoint("format").
+			Compile()
+		if err != nil {
+			t.Fatalf("Compile: %v", err)
+		}
+		return compiled
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	recorded, err := NewRunner(build("."), store).Run(ctx, "s1", State{"question": "why"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	report, err := NewRunner(build("."), store).Replay(ctx, "s1", "")
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if report.Divergence != nil {
+		t.Fatalf("unexpected divergence: %v", report.Divergence)
+	}
+	if live.Load() != 1 {
+		t.Errorf("replay made %d live model calls, want 0", live.Load()-1)
+	}
+	if report.RunID != recorded.RunID || report.State["reply"] != recorded.State["reply"] {
+		t.Errorf("replayed %q to %v, recorded %q with %v", report.RunID, report.State, recorded.RunID, recorded.State)
+	}
+
+	report, err = NewRunner(build("!"), store).Replay(ctx, "s1", recorded.RunID)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if report.Divergence == nil || report.Divergence.NodeID != "format" {
+		t.Fatalf("expected divergence at format, got %+v", report.Divergence)
+	}
+
+	events, err := store.ListEvents(ctx, "s1", 0)
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	if len(events) != 3 {
+		t.Errorf("replays wrote to the ledger: %d events, want 3", len(events))
+	}
+}
+
+// fragmentedProvider streams a tool call the way OpenAI does: a chunk with
+// the ID and name, then chunks with pieces of the arguments, and usage as a
+// running total.
+type fragmentedProvider struct{}
+
+func (fragmentedProvider) Chat(context.Context, *model.ChatRequest) (*model.ChatResponse, error) {
+	return nil, errors.New("not supported")
+}
+
+func (fragmentedProvider) StreamChat(context.Context, *model.ChatRequest) (<-chan *model.ChatResponse, error) {
+	ch := make(chan *model.ChatResponse, 8)
+	ch <- &model.ChatResponse{Content: "Looking ", Delta: true, Usage: model.Usage{PromptTokens: 10, CompletionTokens: 1}}
+	ch <- &model.ChatResponse{Content: "it up.", Delta: true, Usage: model.Usage{PromptTokens: 10, CompletionTokens: 2}}
+	ch <- &model.ChatResponse{ToolCalls: []model.ToolCall{{ID: "call_1", Name: "search"}}, Delta: true}
+	ch <- &model.ChatResponse{ToolCalls: []model.ToolCall{{Arguments: `{"q":`}}, Delta: true}
+	ch <- &model.ChatResponse{ToolCalls: []model.ToolCall{{Arguments: `"go"}`}}, Delta: true, Usage: model.Usage{PromptTokens: 10, CompletionTokens: 6}}
+	close(ch)
+	return ch, nil
+}
+
+func (fragmentedProvider) Name() string  { return "fragmented" }
+func (fragmentedProvider) Model() string { return "fragmented" }
+
+func TestRecordedProviderAssemblesStreamedToolCalls(t *testing.T) {
+	provider := RecordedProvider(fragmentedProvider{})
+	var resp *model.ChatResponse
+	compiled, err := New("stream-tools").
+		AddNode("ask", func(ctx context.Context, _ State) (State, error) {
+			ch, err := provider.StreamChat(ctx, &model.ChatRequest{})
+			if err != nil {
+				return nil, err
+			}
+			for chunk := range ch {
+				resp = chunk
+			}
+			return nil, nil
+		}).
+		SetEntryPoint("ask").
+		SetFinishPoint("ask").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	runner := NewRunner(compiled, newTestStore(t))
+	events := runner.Stream()
+	if _, err := runner.Run(context.Background(), "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var text strings.Builder
+	for evt := range events {
+		if evt.Type == "token" {
+			text.WriteString(evt.Delta)
+		}
+	}
+	if text.String() != "Looking it up." {
+		t.Errorf("streamed %q, want the content as token events", text.String())
+	}
+	want := []model.ToolCall{{ID: "call_1", Name: "search", Arguments: `{"q":"go"}`}}
+	if resp == nil || !reflect.DeepEqual(resp.ToolCalls, want) {
+		t.Fatalf("expected one assembled tool call, got %+v", resp)
+	}
+	if resp.StopReason != model.StopReasonToolCall || resp.Usage != (model.Usage{PromptTokens: 10, CompletionTokens: 6}) {
+		t.Errorf("unexpected stop reason %q or usage %+v", resp.StopReason, resp.Usage)
+	}
+}
+
+func TestRunnerStreamWriterAndPolicy(t *testing.T) {
+	compiled, err := New("stream").
+		AddNode("write", func(ctx context.Context, _ State) (State, error) {
+			w := StreamWriterFrom(ctx)
+			w.Progress("half")
+			for _, tok := range []string{"hel", "lo"} {
+				w.Token(tok)
+			}
+			return nil, nil
+		}).
+		SetEntryPoint("write").
+		SetFinishPoint("write").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	StreamWriterFrom(context.Background()).Token("ignored")
+
+	ctx := context.Background()
+	runner := NewRunner(compiled, newTestStore(t))
+	events := runner.Stream()
+	if _, err := runner.Run(ctx, "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var text strings.Builder
+	var progress any
+	for evt := range events {
+		switch evt.Type {
+		case "token":
+			if evt.NodeID != "write" {
+				t.Errorf("token event from %q, want write", evt.NodeID)
+			}
+			text.WriteString(evt.Delta)
+		case "progress":
+			progress = evt.Payload
+		}
+	}
+	if text.String() != "hello" || progress != "half" {
+		t.Errorf("streamed %q with progress %v, want hello and half", text.String(), progress)
+	}
+
+	runner = NewRunner(compiled, newTestStore(t)).SetStreamBuffer(2, StreamDropOldest)
+	sub := runner.Subscribe("")
+	if _, err := runner.Run(ctx, "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var last []string
+	for evt := range sub.Events() {
+		last = append(last, evt.Type)
+	}
+	if !reflect.DeepEqual(last, []string{"node_end", "completed"}) || sub.Dropped() == 0 || runner.Dropped() != sub.Dropped() {
+		t.Errorf("drop-oldest kept %v and dropped %d, want the last two events", last, sub.Dropped())
+	}
+}
+
+func TestRunnerSubscriptionsPerRun(t *testing.T) {
+	compiled, err := New("subscribe").
+		AddNode("draft", setKey("draft", "v1")).
+		AddInterruptNode("publish", setKey("published", true)).
+		SetEntryPoint("draft").
+		AddEdge("draft", "publish").
+		SetFinishPoint("publish").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	collect := func(sub *Subscription) []string {
+		var types []string
+		for evt := range sub.Events() {
+			types = append(types, evt.Type)
+		}
+		return types
+	}
+
+	ctx := context.Background()
+	runner := NewRunner(compiled, newTestStore(t))
+	first, second, other := runner.Subscribe("s1"), runner.Subscribe(""), runner.Subscribe("s2")
+	if _, err := runner.Run(ctx, "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []string{"node_start", "node_end", "edge_transition", "interrupt"}
+	if got := collect(first); !reflect.DeepEqual(got, want) {
+		t.Errorf("first subscriber got %v, want %v", got, want)
+	}
+	if got := collect(second); !reflect.DeepEqual(got, want) {
+		t.Errorf("second subscriber got %v, want %v", got, want)
+	}
+
+	resumed := runner.Subscribe("s1")
+	if _, err := runner.Resume(ctx, "s1"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got := collect(resumed); len(got) == 0 || got[len(got)-1] != "completed" {
+		t.Errorf("resume subscriber got %v, want events ending with completed", got)
+	}
+
+	if _, err := runner.Run(ctx, "s2", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := collect(other); len(got) == 0 {
+		t.Error("s2 subscriber got no events")
+	}
+
+	closed := runner.Subscribe("")
+	closed.Close()
+	closed.Close()
+	if _, ok := <-closed.Events(); ok {
+		t.Error("closed subscription delivered an event")
+	}
+}
+
+func TestSubscriptionConcurrentClose(t *testing.T) {
+	compiled, err := New("close").
+		AddNode("write", func(ctx context.Context, _ State) (State, error) {
+			w := StreamWriterFrom(ctx)
+			for i := 0; i < 100; i++ {
+				w.Token("x")
+			}
+			return nil, nil
+		}).
+		SetEntryPoint("write").
+		SetFinishPoint("write").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	runner := NewRunner(compiled, newTestStore(t)).SetStreamBuffer(1, StreamBlock)
+	sub := runner.Subscribe("")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := runner.Run(context.Background(), "s1", State{}); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+	<-sub.Events()
+	start := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			sub.Close()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	for range sub.Events() {
+	}
+}
+
+func TestRunnerCancel(t *testing.T) {
+	var attempts atomic.Int32
+	compiled, err := New("cancel").
+		AddNode("prepare", setKey("prepared", true)).
+		AddNode("slow", func(ctx context.Context, _ State) (State, error) {
+			if attempts.Add(1) > 1 {
+				return State{"done": true}, nil
+			}
+			<-ctx.Done()
+			return nil, context.Cause(ctx)
+		}).
+		SetEntryPoint("prepare").
+		AddEdge("prepare", "slow").
+		SetFinishPoint("slow").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.CreateSession(ctx, &storage.Session{ID: "s1", Status: "running", CreatedAt: time.Now(), UpdatedAt: time.Now()}); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	runner := NewRunner(compiled, store)
+	if err := runner.Cancel("run_unknown"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Cancel of unknown run: got %v, want ErrNotRunning", err)
+	}
+	events := runner.Stream()
+	go func() {
+		for evt := range events {
+			if evt.Type == "node_start" && evt.NodeID == "slow" {
+				if err := NewRunner(compiled, store).Cancel(evt.RunID); !errors.Is(err, ErrNotRunning) {
+					t.Errorf("another runner cancelled the run: %v", err)
+				}
+				if err := runner.Cancel(evt.RunID); err != nil {
+					t.Errorf("Cancel: %v", err)
+				}
+			}
+		}
+	}()
+	rs, err := runner.Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusCancelled {
+		t.Fatalf("status = %s, want cancelled", rs.Status)
+	}
+
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	if cp.NodeID != "slow" || cp.Metadata[metaCancelled] != true || cp.State["prepared"] != true {
+		t.Errorf("unexpected cancel checkpoint: node %s, state %v, metadata %v", cp.NodeID, cp.State, cp.Metadata)
+	}
+	ledger, err := store.ListEvents(ctx, "s1", 0)
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	if last := ledger[len(ledger)-1]; last.Type != "run_cancelled" {
+		t.Errorf("last ledger event = %s, want run_cancelled", last.Type)
+	}
+	sess, err := store.GetSession(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if sess.Status != "cancelled" {
+		t.Errorf("session status = %q, want cancelled", sess.Status)
+	}
+
+	rs, err = runner.Resume(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if rs.Status != RunStatusCompleted || rs.State["done"] != true {
+		t.Errorf("resume: status %s, state %v", rs.Status, rs.State)
+	}
+}
+
+// cancelWhenReady cancels the run of runner once ready is closed.
+func cancelWhenReady(t *testing.T, runner *Runner, ready <-chan struct{}) {
+	t.Helper()
+	events := runner.Stream()
+	go func() {
+		var once sync.Once
+		for evt := range events {
+			once.Do(func() {
+				<-ready
+				if err := runner.Cancel(evt.RunID); err != nil {
+					t.Errorf("Cancel: %v", err)
+				}
+			})
+		}
+	}()
+}
+
+func TestRunnerCancelDuringFanOut(t *testing.T) {
+	store := &signalStore{Storage: newTestStore(t), branch: "a", saved: make(chan struct{})}
+	var aRuns, bRuns atomic.Int32
+	compiled, err := New("fan").
+		AddNode("split", setKey("split", true)).
+		AddNode("a", func(ctx context.Context, s State) (State, error) {
+			aRuns.Add(1)
+			return setKey("a", "done")(ctx, s)
+		}).
+		AddNode("b", func(ctx context.Context, s State) (State, error) {
+			if bRuns.Add(1) == 1 {
+				<-ctx.Done()
+				return nil, context.Cause(ctx)
+			}
+			return setKey("b", "done")(ctx, s)
+		}).
+		AddJoinNode("join", passthrough, nil).
+		SetEntryPoint("split").
+		AddFanOut("split", "join", "a", "b").
+		AddEdge("a", "join").
+		AddEdge("b", "join").
+		SetFinishPoint("join").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	ctx := context.Background()
+	runner := NewRunner(compiled, store)
+	cancelWhenReady(t, runner, store.saved)
+	rs, err := runner.Run(ctx, "s1", State{})
+	if err != nil || rs.Status != RunStatusCancelled {
+		t.Fatalf("Run: status %s, err %v", rs.Status, err)
+	}
+
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	if cp.NodeID != "split" || cp.Metadata[metaCancelled] != true || cp.State["split"] != true || cp.State["a"] != nil {
+		t.Errorf("unexpected cancel checkpoint: node %s, state %v, metadata %v", cp.NodeID, cp.State, cp.Metadata)
+	}
+	runs, err := RunTree(ctx, store, "s1")
+	if err != nil || len(runs) != 1 || runs[0].LastNode != "split" {
+		t.Errorf("RunTree: %v, %+v", err, runs)
+	}
+	if stranded, err := compiled.CheckRuns(ctx, store.Storage.(*sqlite.Store)); err != nil || len(stranded) != 0 {
+		t.Errorf("CheckRuns: %v, %+v", err, stranded)
+	}
+
+	rs, err = NewRunner(compiled, store).Resume(ctx, "s1")
+	if err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("Resume: status %s, err %v", rs.Status, err)
+	}
+	if aRuns.Load() != 1 || bRuns.Load() != 2 {
+		t.Errorf("expected only the cancelled branch to run again, got a=%d b=%d", aRuns.Load(), bRuns.Load())
+	}
+	if rs.State["a"] != "done" || rs.State["b"] != "done" {
+		t.Errorf("unexpected merged state: %v", rs.State)
+	}
+}
+
+func TestRunnerCancelDuringMapNode(t *testing.T) {
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	ready := make(chan struct{})
+	child, err := New("summarize").
+		AddNode("summarize", func(ctx context.Context, s State) (State, error) {
+			doc := s["doc"].(string)
+			mu.Lock()
+			runs[doc]++
+			first := runs[doc] == 1
+			mu.Unlock()
+			if doc == "c" && first {
+				close(ready)
+				<-ctx.Done()
+				return nil, context.Cause(ctx)
+			}
+			return State{"summary": strings.ToUpper(doc)}, nil
+		}).
+		SetEntryPoint("summarize").
+		SetFinishPoint("summarize").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile child: %v", err)
+	}
+	compiled, err := New("docs").
+		AddMapNode("each", &MapNode{Graph: child, Items: "docs", ItemKey: "doc", Input: map[string]string{},
+			Output: "summary", Into: "summaries", Concurrency: 1}).
+		SetEntryPoint("each").
+		SetFinishPoint("each").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	runner := NewRunner(compiled, store)
+	cancelWhenReady(t, runner, ready)
+	rs, err := runner.Run(ctx, "s1", State{"docs": []string{"a", "b", "c", "d"}})
+	if err != nil || rs.Status != RunStatusCancelled {
+		t.Fatalf("Run: status %s, err %v", rs.Status, err)
+	}
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	if cp.NodeID != "each" || cp.Metadata[metaCancelled] != true || cp.State["summaries"] != nil {
+		t.Errorf("unexpected cancel checkpoint: node %s, state %v, metadata %v", cp.NodeID, cp.State, cp.Metadata)
+	}
+
+	rs, err = NewRunner(compiled, store).Resume(ctx, "s1")
+	if err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("Resume: status %s, err %v", rs.Status, err)
+	}
+	if want := []any{"A", "B", "C", "D"}; !reflect.DeepEqual(rs.State["summaries"], want) {
+		t.Errorf("expected summaries %v, got %v", want, rs.State["summaries"])
+	}
+	if runs["a"] != 1 || runs["b"] != 1 || runs["c"] != 2 || runs["d"] != 1 {
+		t.Errorf("expected only unfinished items to run again, got %v", runs)
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	loop := func(counting bool) *StateGraph {
+		step := passthrough
+		if counting {
+			step = func(_ context.Context, s State) (State, error) {
+				n, _ := s["n"].(int)
+				return State{"n": n + 1}, nil
+			}
+		}
+		return New("loop").
+			AddNode("plan", step).
+			AddNode("act", passthrough).
+			SetEntryPoint("plan").
+			AddEdge("plan", "act").
+			AddConditionalEdge("act", func(State) string { return "plan" }, "plan")
+	}
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		graph *StateGraph
+		kind  string
+		steps int
+	}{
+		{"max steps", loop(true).SetMaxSteps(5), LimitMaxSteps, 6},
+		{"max visits", loop(true).SetMaxVisits("act", 2), LimitMaxVisits, 6},
+		{"fixpoint", loop(false).DetectFixpoints(), LimitFixpoint, 3},
+	}
+	for _, tt := range tests {
+		compiled, err := tt.graph.Compile()
+		if err != nil {
+			t.Fatalf("%s: Compile: %v", tt.name, err)
+		}
+		rs, err := NewRunner(compiled, newTestStore(t)).Run(ctx, "s1", State{})
+		var limit *LimitError
+		if !errors.As(err, &limit) || limit.Kind != tt.kind {
+			t.Fatalf("%s: expected %s limit error, got %v", tt.name, tt.kind, err)
+		}
+		if rs.Status != RunStatusLimitExceeded || rs.Steps != tt.steps {
+			t.Errorf("%s: status %s after %d steps, want limit_exceeded after %d", tt.name, rs.Status, rs.Steps, tt.steps)
+		}
+		if last := limit.Trail[len(limit.Trail)-1]; last != limit.NodeID || !strings.Contains(err.Error(), "plan -> act") {
+			t.Errorf("%s: unexpected trail in %q", tt.name, err)
+		}
+	}
+
+	// Steps and visits made before a resume count against the limits.
+	approval := func() *StateGraph {
+		return New("approval").
+			AddNode("plan", passthrough).
+			AddInterruptNode("approve", passthrough).
+			SetEntryPoint("plan").
+			AddEdge("plan", "approve").
+			AddConditionalEdge("approve", func(State) string { return "plan" }, "plan")
+	}
+	for _, tt := range []struct {
+		name  string
+		graph *StateGraph
+		kind  string
+		steps int
+	}{
+		{"max steps", approval().SetMaxSteps(5), LimitMaxSteps, 6},
+		{"max visits", approval().SetMaxVisits("plan", 2), LimitMaxVisits, 5},
+	} {
+		compiled, err := tt.graph.Compile()
+		if err != nil {
+			t.Fatalf("%s: Compile: %v", tt.name, err)
+		}
+		runner := NewRunner(compiled, newTestStore(t))
+		rs, err := runner.Run(ctx, "s1", State{})
+		for i := 0; err == nil && rs.Status == RunStatusPaused && i < 5; i++ {
+			rs, err = runner.ResumeWith(ctx, "s1", State{})
+		}
+		var limit *LimitError
+		if !errors.As(err, &limit) || limit.Kind != tt.kind || rs.Steps != tt.steps {
+			t.Errorf("%s: expected %s limit after %d steps across resumes, got %v after %d", tt.name, tt.kind, tt.steps, err, rs.Steps)
+		}
+	}
+
+	if _, err := loop(true).SetMaxVisits("missing", 1).Compile(); err == nil {
+		t.Error("expected a validation error for a visit limit on an unknown node")
+	}
+}
+
+func TestRunnerSchemaConformsResumedState(t *testing.T) {
+	type profile struct {
+		Name string `json:"name"`
+	}
+	type state struct {
+		Count   int     `json:"count"`
+		Profile profile `json:"profile"`
+	}
+	var seen []string
+	check := func(_ context.Context, s State) (State, error) {
+		_, isInt := s["count"].(int)
+		_, isProfile := s["profile"].(profile)
+		seen = append(seen, fmt.Sprint(isInt, isProfile))
+		return nil, nil
+	}
+	compiled, err := New("schema").
+		SetSchema(StructSchema[state]()).
+		AddNode("load", setKey("profile", map[string]any{"name": "Ada"})).
+		AddInterruptNode("review", check).
+		SetEntryPoint("load").
+		AddEdge("load", "review").
+		SetFinishPoint("review").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{"count": 2})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if p, ok := rs.State["profile"].(profile); !ok || p.Name != "Ada" {
+		t.Errorf("profile after node = %#v, want a profile struct", rs.State["profile"])
+	}
+	if _, err := NewRunner(compiled, store).Resume(ctx, "s1"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if !reflect.DeepEqual(seen, []string{"true true"}) {
+		t.Errorf("resumed node saw typed state %v, want count int and profile struct", seen)
+	}
+
+	if _, err := NewRunner(compiled, store).Run(ctx, "s2", State{"count": "many"}); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("Run with invalid count: got %v, want ErrInvalidState", err)
+	}
+
+	schema, err := JSONSchema([]byte(`{"type": "object", "properties": {
+		"count": {"type": "integer"},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"mode": {"enum": ["fast", "slow"]}}}`))
+	if err != nil {
+		t.Fatalf("JSONSchema: %v", err)
+	}
+	got, err := schema.Conform(State{"count": float64(3), "tags": []string{"a"}, "mode": "fast", "other": 1.5})
+	if err != nil {
+		t.Fatalf("Conform: %v", err)
+	}
+	if want := (State{"count": 3, "tags": []any{"a"}, "mode": "fast", "other": 1.5}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Conform = %#v, want %#v", got, want)
+	}
+	for _, bad := range []State{{"count": 2.5}, {"tags": []any{1}}, {"mode": "medium"}} {
+		if _, err := schema.Conform(bad); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("Conform(%v): got %v, want ErrInvalidState", bad, err)
+		}
+	}
+}
+
+func TestRunnerMapNodeResumesUnfinishedItems(t *testing.T) {
+	var mu sync.Mutex
+	runs := make(map[string]int)
+	failOnce := true
+	child, err := New("summarize").
+		AddNode("summarize", func(_ context.Context, s State) (State, error) {
+			doc := s["doc"].(string)
+			mu.Lock()
+			defer mu.Unlock()
+			runs[doc]++
+			if doc == "c" && failOnce {
+				failOnce = false
+				return nil, errors.New("model unavailable")
+			}
+			return State{"summary": strings.ToUpper(doc)}, nil
+		}).
+		SetEntryPoint("summarize").
+		SetFinishPoint("summarize").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile child: %v", err)
+	}
+	compiled, err := New("docs").
+		AddMapNode("each", &MapNode{Graph: child, Items: "docs", ItemKey: "doc", Input: map[string]string{},
+			Output: "summary", Into: "summaries", Concurrency: 1}).
+		SetEntryPoint("each").
+		SetFinishPoint("each").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	store := newTestStore(t)
+	ctx := context.Background()
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{"docs": []string{"a", "b", "c", "d"}})
+	if err == nil || rs.Status != RunStatusFailed {
+		t.Fatalf("expected the failing item to fail the run, got %v", err)
+	}
+	rs, err = NewRunner(compiled, store).Resume(ctx, "s1")
+	if err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("Resume: %v", err)
+	}
+	want := []any{"A", "B", "C", "D"}
+	if !reflect.DeepEqual(rs.State["summaries"], want) {
+		t.Errorf("expected summaries %v in item order, got %v", want, rs.State["summaries"])
+	}
+	if runs["a"] != 1 || runs["b"] != 1 || runs["c"] != 2 || runs["d"] != 1 {
+		t.Errorf("expected only unfinished items to run again, got %v", runs)
+	}
+	if cps, _ := store.ListCheckpoints(ctx, "s1/each/0"); len(cps) == 0 {
+		t.Errorf("expected item runs to checkpoint under their own session")
+	}
+}
+
+func TestRunnerMigratesPausedRun(t *testing.T) {
+	v1, err := New("publish").SetVersion("1").
+		AddNode("draft", setKey("text", "hello")).
+		AddInterruptNode("review", passthrough).
+		SetEntryPoint("draft").
+		AddEdge("draft", "review").
+		SetFinishPoint("review").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile v1: %v", err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	if rs, err := NewRunner(v1, store).Run(ctx, "s1", State{}); err != nil || rs.Status != RunStatusPaused {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// Version 2 renames the review node and the text key.
+	build := func(migrations ...Migration) *CompiledGraph {
+		g := New("publish").SetVersion("2").
+			AddNode("draft", setKey("body", "hello")).
+			AddInterruptNode("approve", func(_ context.Context, s State) (State, error) {
+				return State{"published": s["body"]}, nil
+			}).
+			SetEntryPoint("draft").
+			AddEdge("draft", "approve").
+			SetFinishPoint("approve")
+		for _, m := range migrations {
+			g.AddMigration(m)
+		}
+		compiled, err := g.Compile()
+		if err != nil {
+			t.Fatalf("Compile v2: %v", err)
+		}
+		return compiled
+	}
+
+	unmigrated := build()
+	stranded, err := unmigrated.CheckRuns(ctx, store)
+	if err != nil {
+		t.Fatalf("CheckRuns: %v", err)
+	}
+	if len(stranded) != 1 || stranded[0].SessionID != "s1" || stranded[0].Version != "1" || !errors.Is(stranded[0].Err, ErrNoMigration) {
+		t.Fatalf("expected the paused run reported without a migration, got %+v", stranded)
+	}
+	if _, err := NewRunner(unmigrated, store).Resume(ctx, "s1"); !errors.Is(err, ErrNoMigration) {
+		t.Fatalf("expected ErrNoMigration on resume, got %v", err)
+	}
+
+	v2 := build(Migration{
+		From:  "1",
+		To:    "2",
+		Nodes: map[string]string{"review": "approve"},
+		State: func(s State) (State, error) {
+			s["body"] = s["text"]
+			delete(s, "text")
+			return s, nil
+		},
+	})
+	if stranded, err := v2.CheckRuns(ctx, store); err != nil || len(stranded) != 0 {
+		t.Fatalf("expected no stranded runs with the migration, got %+v, %v", stranded, err)
+	}
+	// A worker taking the run over reports it paused in the new version.
+	latest, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	if _, err := NewRunner(unmigrated, store).takeOver(ctx, latest); !errors.Is(err, ErrNoMigration) {
+		t.Fatalf("expected ErrNoMigration on take-over, got %v", err)
+	}
+	rs, err := NewRunner(v2, store).takeOver(ctx, latest)
+	if err != nil || rs.Status != RunStatusPaused || rs.State["body"] != "hello" || rs.State["text"] != nil {
+		t.Fatalf("expected take-over to report the migrated run paused, got %+v, %v", rs, err)
+	}
+
+	rs, err = NewRunner(v2, store).Resume(ctx, "s1")
+	if err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("Resume: %v", err)
+	}
+	if rs.State["published"] != "hello" || rs.State["text"] != nil {
+		t.Errorf("expected migrated state to be published, got %v", rs.State)
+	}
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil || cp.Metadata[metaVersion] != "2" {
+		t.Fatalf("expected the new checkpoint to record version 2, got %v (%v)", cp, err)
+	}
+}
+
+func TestCompactCheckpoints(t *testing.T) {
+	compiled, err := New("compact").
+		AddNode("a", setKey("a", 1)).
+		AddNode("b", setKey("b", 2)).
+		AddInterruptNode("publish", setKey("published", true)).
+		SetEntryPoint("a").
+		AddEdge("a", "b").
+		AddEdge("b", "publish").
+		SetFinishPoint("publish").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	runner := NewRunner(compiled, store)
+	if _, err := runner.Run(ctx, "s1", State{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := runner.Resume(ctx, "s1"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	before, err := store.ListCheckpoints(ctx, "s1")
+	if err != nil {
+		t.Fatalf("ListCheckpoints: %v", err)
+	}
+	var paused *storage.Checkpoint
+	for _, cp := range before {
+		if cp.Metadata[metaInterrupt] == true {
+			paused = cp
+		}
+	}
+	if paused == nil || len(before) < 3 {
+		t.Fatalf("expected an interrupt among several checkpoints, got %d", len(before))
+	}
+
+	report, err := CompactCheckpoints(ctx, store, RetentionPolicy{KeepLast: 1, KeepInterrupts: true})
+	if err != nil {
+		t.Fatalf("CompactCheckpoints: %v", err)
+	}
+	if report.Sessions != 1 || report.Kept != 2 || report.Deleted != len(before)-2 {
+		t.Fatalf("expected the latest and the interrupt checkpoint kept, got %+v", report)
+	}
+	got, err := store.GetCheckpoint(ctx, paused.ID)
+	if err != nil || !reflect.DeepEqual(got.State, paused.State) {
+		t.Fatalf("expected interrupt checkpoint to keep state %v, got %v (%v)", paused.State, got, err)
+	}
+	rs, err := NewRunner(compiled, store).ResumeFromCheckpoint(ctx, paused.ID)
+	if err != nil || rs.Status != RunStatusPaused {
+		t.Fatalf("expected resume from the kept interrupt to pause again, got %v", err)
+	}
+	if rs, err = NewRunner(compiled, store).ResumeWith(ctx, "s1", State{}); err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("expected the forked run to complete, got %v", err)
+	}
+
+	// Both runs went past their interrupts, so expiry spares only the
+	// latest checkpoint.
+	latest, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	report, err = CompactCheckpoints(ctx, store, RetentionPolicy{MaxAge: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("CompactCheckpoints: %v", err)
+	}
+	cps, _ := store.ListCheckpoints(ctx, "s1")
+	if report.Deleted == 0 || len(cps) != 1 || cps[0].ID != latest.ID {
+		t.Fatalf("expected only the latest checkpoint kept, got %d left (%+v)", len(cps), report)
+	}
+}
+
+func TestCompactCheckpointsKeepsResumableRuns(t *testing.T) {
+	ctx := context.Background()
+	paused, err := New("review").
+		AddNode("draft", setKey("text", "hello")).
+		AddNode("edit", setKey("edited", true)).
+		AddInterruptNode("publish", setKey("published", true)).
+		SetEntryPoint("draft").
+		AddEdge("draft", "edit").
+		AddEdge("edit", "publish").
+		SetFinishPoint("publish").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	wake := time.Now().Add(50 * time.Millisecond)
+	waiting, err := New("follow").
+		AddNode("send", setKey("sent", true)).
+		AddNode("log", setKey("logged", true)).
+		AddTimerNode("follow_up", func(State) time.Time { return wake }, setKey("followed_up", true)).
+		SetEntryPoint("send").
+		AddEdge("send", "log").
+		AddEdge("log", "follow_up").
+		SetFinishPoint("follow_up").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+	if rs, err := NewRunner(paused, store).Run(ctx, "paused", State{}); err != nil || rs.Status != RunStatusPaused {
+		t.Fatalf("Run paused: %v", err)
+	}
+	if rs, err := NewRunner(waiting, store).Run(ctx, "waiting", State{}); err != nil || rs.Status != RunStatusWaiting {
+		t.Fatalf("Run waiting: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	report, err := CompactCheckpoints(ctx, store, RetentionPolicy{MaxAge: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("CompactCheckpoints: %v", err)
+	}
+	if report.Kept != 2 || report.Deleted == 0 {
+		t.Fatalf("expected only the checkpoints the runs resume from kept, got %+v", report)
+	}
+
+	rs, err := NewRunner(paused, store).ResumeWith(ctx, "paused", State{"approved": true})
+	if err != nil || rs.Status != RunStatusCompleted || rs.State["published"] != true || rs.State["edited"] != true {
+		t.Errorf("expected the paused run to resume, got %v, %+v", err, rs)
+	}
+	time.Sleep(time.Until(wake))
+	rs, err = NewRunner(waiting, store).Resume(ctx, "waiting")
+	if err != nil || rs.Status != RunStatusCompleted || rs.State["followed_up"] != true || rs.State["logged"] != true {
+		t.Errorf("expected the waiting run to resume, got %v, %+v", err, rs)
+	}
+}
+
+func TestRunnerTimerNodeSuspendsUntilDue(t *testing.T) {
+	ctx := context.Background()
+	var wake time.Time
+	g := New("timer").
+		AddNode("send", setKey("sent", true)).
+		AddTimerNode("follow_up", func(State) time.Time { return wake }, setKey("followed_up", true)).
+		SetEntryPoint("send").
+		AddEdge("send", "follow_up").
+		SetFinishPoint("follow_up")
+	compiled, err := g.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+
+	wake = time.Now().Add(50 * time.Millisecond)
+	rs, err := NewRunner(compiled, store).Run(ctx, "s1", State{})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != RunStatusWaiting || !rs.WakeAt.Equal(wake) || rs.State["followed_up"] != nil {
+		t.Fatalf("expected run waiting until %v, got %q until %v with %v", wake, rs.Status, rs.WakeAt, rs.State)
+	}
+	if _, err := NewRunner(compiled, store).Resume(ctx, "s1"); !errors.Is(err, ErrNotDue) {
+		t.Fatalf("expected ErrNotDue before the wake-up time, got %v", err)
+	}
+	if due, err := ListDueRuns(ctx, store, time.Now()); err != nil || len(due) != 0 {
+		t.Fatalf("expected no due runs yet, got %v, %v", due, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	due, err := ListDueRuns(ctx, store, time.Now())
+	if err != nil {
+		t.Fatalf("ListDueRuns: %v", err)
+	}
+	if len(due) != 1 || due[0].RunID != rs.RunID || due[0].GraphID != "timer" || due[0].NodeID != "follow_up" {
+		t.Fatalf("expected the waiting run to be due, got %+v", due)
+	}
+	rs, err = NewRunner(compiled, store).Resume(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if rs.Status != RunStatusCompleted || rs.State["followed_up"] != true || rs.State["sent"] != true {
+		t.Fatalf("expected completed run after the timer, got %q with %v", rs.Status, rs.State)
+	}
+	if due, _ := ListDueRuns(ctx, store, time.Now()); len(due) != 0 {
+		t.Errorf("expected no due runs after resuming, got %+v", due)
+	}
+
+	// A wake-up time already past does not suspend the run.
+	wake = time.Now().Add(-time.Second)
+	rs, err = NewRunner(compiled, store).Run(ctx, "s2", State{})
+	if err != nil || rs.Status != RunStatusCompleted {
+		t.Fatalf("expected run to complete without waiting, got %v, %v", rs.Status, err)
+	}
+}
+
+func TestWorkerStopsRunCancelledElsewhere(t *testing.T) {
+	ctx := context.Background()
+	started, proceed := make(chan struct{}), make(chan struct{})
+	var cRuns atomic.Int32
+	compiled, err := New("jobs").
+		AddNode("a", setKey("a", true)).
+		AddNode("b", func(_ context.Context, _ State) (State, error) {
+			close(started)
+			<-proceed
+			return State{"b": true}, nil
+		}).
+		AddNode("c", func(_ context.Context, _ State) (State, error) {
+			cRuns.Add(1)
+			return State{"c": true}, nil
+		}).
+		SetEntryPoint("a").
+		AddEdge("a", "b").
+		AddEdge("b", "c").
+		SetFinishPoint("c").
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+
+	// A run that no runner of this process executes is cancelled through
+	// the store.
+	if err := RequestCancel(ctx, store, "run_elsewhere"); err != nil {
+		t.Fatalf("RequestCancel: %v", err)
+	}
+	if ok, err := store.CancelRequested(ctx, "run_elsewhere"); err != nil || !ok {
+		t.Errorf("expected the request to be recorded, got %v, %v", ok, err)
+	}
+
+	id, err := Enqueue(ctx, store, "jobs", "s1", State{})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	w, err := NewWorker("w1", store)
+	if err != nil {
+		t.Fatalf("NewWorker: %v", err)
+	}
+	w.Register(compiled)
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Next(ctx)
+		done <- err
+	}()
+
+	<-started
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	// Another replica records the request, as RequestCancel does there.
+	if err := store.RequestCancel(ctx, cp.RunID); err != nil {
+		t.Fatalf("RequestCancel: %v", err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+
+	q, err := store.GetQueuedRun(ctx, id)
+	if err != nil {
+		t.Fatalf("GetQueuedRun: %v", err)
+	}
+	if q.Status != string(RunStatusCancelled) || cRuns.Load() != 0 {
+		t.Errorf("expected the run cancelled before c, got status %s and %d runs of c", q.Status, cRuns.Load())
+	}
+	if cp, err = store.GetLatestCheckpoint(ctx, "s1"); err != nil || cp.NodeID != "c" || cp.Metadata[metaCancelled] != true {
+		t.Errorf("unexpected cancel checkpoint: %v, %+v", err, cp)
+	}
+	if ok, _ := store.CancelRequested(ctx, cp.RunID); ok {
+		t.Error("expected the handled request to be cleared")
+	}
+}
+
+func TestWorkerTakesOverExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	var first, second, third atomic.Int32
+	g := New("jobs").
+		AddNode("a", func(_ context.Context, _ State) (State, error) {
+			first.Add(1)
+			return State{"a": true}, nil
+		}).
+		AddNode("b", func(_ context.Context, _ State) (State, error) {
+			if second.Add(1) == 1 {
+				return nil, errors.New("worker died")
+			}
+			return State{"b": true}, nil
+		}).
+		AddNode("c", func(_ context.Context, _ State) (State, error) {
+			third.Add(1)
+			return State{"c": true}, nil
+		}).
+		SetEntryPoint("a").
+		AddEdge("a", "b").
+		AddEdge("b", "c").
+		SetFinishPoint("c")
+	compiled, err := g.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	store := newTestStore(t)
+
+	id, err := Enqueue(ctx, store, "jobs", "s1", State{"job": 1})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	// A worker leases the run and stops after node "a" without finishing it.
+	if q, err := store.LeaseRun(ctx, "dead", []string{"jobs"}, 20*time.Millisecond); err != nil || q == nil {
+		t.Fatalf("LeaseRun: %v, %v", q, err)
+	}
+	NewRunner(compiled, store).Run(ctx, "s1", State{"job": 1})
+
+	w, err := NewWorker("w1", store)
+	if err != nil {
+		t.Fatalf("NewWorker: %v", err)
+	}
+	w.Register(compiled)
+	if leased, err := w.Next(ctx); err != nil || leased {
+		t.Fatalf("expected no run while the lease is held, got %v, %v", leased, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if leased, err := w.Next(ctx); err != nil || !leased {
+		t.Fatalf("expected to take over the expired run, got %v, %v", leased, err)
+	}
+
+	q, err := store.GetQueuedRun(ctx, id)
+	if err != nil {
+		t.Fatalf("GetQueuedRun: %v", err)
+	}
+	if q.Status != string(RunStatusCompleted) || q.Worker != "w1" || q.Attempts != 2 {
+		t.Errorf("expected run completed by w1 on the second lease, got %+v", q)
+	}
+	if first.Load() != 1 || second.Load() != 2 || third.Load() != 1 {
+		t.Errorf("expected a and c to run once, got a=%d b=%d c=%d", first.Load(), second.Load(), third.Load())
+	}
+	cp, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetLatestCheckpoint: %v", err)
+	}
+	if cp.State["a"] != true || cp.State["c"] != true {
+		t.Errorf("expected the final checkpoint to carry both runs' state, got %v", cp.State)
+	}
+}
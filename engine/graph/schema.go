@@ -0,0 +1,260 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrInvalidState is wrapped by the errors of a Schema.
+var ErrInvalidState = errors.New("invalid state")
+
+// Schema declares the types of state keys. The runner conforms the state to
+// the graph's schema after every node and whenever state is loaded from a
+// checkpoint, so that resumed runs see the same types as fresh ones. Keys
+// the schema does not declare are left as they are, and declared keys may
+// be missing.
+type Schema interface {
+	// Conform returns state with its declared keys converted to their
+	// types, or an error wrapping ErrInvalidState if a value cannot be
+	// converted. state itself is not modified.
+	Conform(state State) (State, error)
+}
+
+// SetSchema sets the schema the graph's state must conform to.
+func (g *StateGraph) SetSchema(s Schema) *StateGraph {
+	g.schema = s
+	return g
+}
+
+// conform applies the graph's schema, if any, to s.
+func (c *CompiledGraph) conform(s State) (State, error) {
+	if c.Schema == nil || s == nil {
+		return s, nil
+	}
+	return c.Schema.Conform(s)
+}
+
+// StructSchema returns a schema declaring the fields of the struct T as
+// state keys, named like their JSON encoding. Values are converted to the
+// field types through JSON, so a float64 read back from a checkpoint
+// becomes an int again and a map becomes a struct.
+func StructSchema[T any]() Schema {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	s := structSchema{}
+	if t.Kind() == reflect.Struct {
+		s.addFields(t)
+	}
+	return s
+}
+
+// structSchema maps state keys to Go types.
+type structSchema map[string]reflect.Type
+
+func (s structSchema) addFields(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.addFields(ft)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s[name] = f.Type
+	}
+}
+
+func (s structSchema) Conform(state State) (State, error) {
+	var out State
+	for _, k := range sortedKeys(s) {
+		v, ok := state[k]
+		if !ok || v == nil || reflect.TypeOf(v).AssignableTo(s[k]) {
+			continue
+		}
+		p := reflect.New(s[k])
+		data, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(data, p.Interface())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: cannot use %T as %s", ErrInvalidState, k, v, s[k])
+		}
+		if out == nil {
+			out = copyState(state)
+		}
+		out[k] = p.Elem().Interface()
+	}
+	if out == nil {
+		return state, nil
+	}
+	return out, nil
+}
+
+// JSONSchema parses a JSON Schema for the state. It supports the keywords
+// type, properties, items and enum. Values take their JSON types: integers
+// become int, numbers float64, objects map[string]any and arrays []any.
+func JSONSchema(data []byte) (Schema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse state schema: %w", err)
+	}
+	if len(s.Properties) == 0 {
+		return nil, errors.New("parse state schema: no properties declared")
+	}
+	return &s, nil
+}
+
+type jsonSchema struct {
+	Type       any                    `json:"type"` // a type name or a list of them
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []any                  `json:"enum"`
+}
+
+func (s *jsonSchema) Conform(state State) (State, error) {
+	out := copyState(state)
+	for _, k := range sortedKeys(s.Properties) {
+		v, ok := state[k]
+		if !ok {
+			continue
+		}
+		conformed, err := s.Properties[k].conform(k, v)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = conformed
+	}
+	return out, nil
+}
+
+func (s *jsonSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, v := range t {
+			if name, ok := v.(string); ok {
+				out = append(out, name)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// conform converts v, found at path, to the first of the schema's types it
+// can take.
+func (s *jsonSchema) conform(path string, v any) (any, error) {
+	if s == nil {
+		return v, nil
+	}
+	types := s.types()
+	out, ok := v, len(types) == 0
+	for _, t := range types {
+		var err error
+		if out, ok, err = s.convert(path, t, v); err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: key %q: want %s, got %T", ErrInvalidState, path, strings.Join(types, " or "), v)
+	}
+	if len(s.Enum) > 0 && !s.inEnum(out) {
+		return nil, fmt.Errorf("%w: key %q: %v is not one of the allowed values", ErrInvalidState, path, v)
+	}
+	return out, nil
+}
+
+// convert converts v to the JSON type t. ok is false if v is not of type t.
+func (s *jsonSchema) convert(path, t string, v any) (out any, ok bool, err error) {
+	if v == nil {
+		return nil, t == "null", nil
+	}
+	rv := reflect.ValueOf(v)
+	switch t {
+	case "string":
+		if rv.Kind() == reflect.String {
+			return rv.String(), true, nil
+		}
+	case "boolean":
+		if rv.Kind() == reflect.Bool {
+			return rv.Bool(), true, nil
+		}
+	case "integer":
+		if isInt(rv) {
+			return int(rv.Int()), true, nil
+		}
+		if f, isNum := toFloat(rv); isNum && f == float64(int(f)) {
+			return int(f), true, nil
+		}
+	case "number":
+		if f, isNum := toFloat(rv); isNum {
+			return f, true, nil
+		}
+	case "object":
+		m, isMap := toStringMap(v)
+		if !isMap {
+			if rv.Kind() != reflect.Struct && !(rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Struct) {
+				return nil, false, nil
+			}
+			if err := convertValue(v, &m); err != nil {
+				return nil, false, nil
+			}
+		}
+		obj := make(map[string]any, len(m))
+		for k, val := range m {
+			if obj[k], err = s.Properties[k].conform(path+"."+k, val); err != nil {
+				return nil, false, err
+			}
+		}
+		return obj, true, nil
+	case "array":
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, false, nil
+		}
+		arr := make([]any, rv.Len())
+		for i := range arr {
+			if arr[i], err = s.Items.conform(fmt.Sprintf("%s[%d]", path, i), rv.Index(i).Interface()); err != nil {
+				return nil, false, err
+			}
+		}
+		return arr, true, nil
+	}
+	return nil, false, nil
+}
+
+// inEnum reports whether v equals one of the schema's enum values in its
+// JSON encoding.
+func (s *jsonSchema) inEnum(v any) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	for _, e := range s.Enum {
+		if want, err := json.Marshal(e); err == nil && bytes.Equal(data, want) {
+			return true
+		}
+	}
+	return false
+}
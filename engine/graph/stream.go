@@ -0,0 +1,259 @@
+package graph
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// StreamPolicy decides what happens to an event sent to a subscription
+// whose buffer is full.
+type StreamPolicy int
+
+const (
+	// StreamDrop discards the new event and counts it; see
+	// Subscription.Dropped. This is the default.
+	StreamDrop StreamPolicy = iota
+	// StreamDropOldest discards the oldest buffered event to make room, so
+	// a slow consumer sees the latest events. Discarded events are counted.
+	StreamDropOldest
+	// StreamBlock waits until the consumer reads an event. The subscription
+	// must be drained while the graph runs, or the run stalls.
+	StreamBlock
+)
+
+// defaultStreamBuffer is the number of events a subscription buffers by
+// default.
+const defaultStreamBuffer = 256
+
+// Subscription receives the events of one run. Its channel is closed when
+// the run stops: when it completes, fails, pauses at an interrupt or waits
+// on a timer.
+type Subscription struct {
+	sessionID string
+	hub       *streamHub
+	ch        chan StreamEvent
+	policy    StreamPolicy
+	dropped   atomic.Int64
+
+	mu     sync.Mutex   // serialises drop-oldest sends
+	state  sync.RWMutex // guards closed against in-flight sends
+	closed bool
+	done   chan struct{} // closed by Close to release blocked sends
+	once   sync.Once
+}
+
+// Events returns the subscription's events. The channel is closed when the
+// run stops or the subscription is closed.
+func (s *Subscription) Events() <-chan StreamEvent {
+	return s.ch
+}
+
+// Dropped returns the number of events discarded because the subscription's
+// buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes its channel. It may be called more
+// than once, and while a run is sending to the subscription.
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+	s.once.Do(func() {
+		close(s.done)
+		s.state.Lock()
+		defer s.state.Unlock()
+		s.closed = true
+		close(s.ch)
+	})
+}
+
+func (s *Subscription) send(evt StreamEvent) {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case StreamBlock:
+		select {
+		case s.ch <- evt:
+		case <-s.done:
+		}
+	case StreamDropOldest:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for {
+			select {
+			case s.ch <- evt:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- evt:
+		default:
+			s.drop()
+		}
+	}
+}
+
+func (s *Subscription) drop() {
+	s.dropped.Add(1)
+	s.hub.dropped.Add(1)
+}
+
+// streamHub holds a runner's subscriptions until the run they subscribe to
+// begins. It is shared by all runs of the runner.
+type streamHub struct {
+	mu      sync.Mutex
+	size    int
+	policy  StreamPolicy
+	pending []*Subscription
+	dropped atomic.Int64
+}
+
+// claim hands the subscriptions pending for sessionID to a new run.
+func (h *streamHub) claim(sessionID string) *runStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := &runStream{}
+	h.pending = slices.DeleteFunc(h.pending, func(s *Subscription) bool {
+		if s.sessionID != "" && s.sessionID != sessionID {
+			return false
+		}
+		out.subs = append(out.subs, s)
+		return true
+	})
+	return out
+}
+
+func (h *streamHub) remove(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = slices.DeleteFunc(h.pending, func(p *Subscription) bool { return p == s })
+}
+
+// runStream sends the events of one run to its subscriptions. Subgraph
+// runners share their parent's run stream.
+type runStream struct {
+	subs []*Subscription
+}
+
+func (rs *runStream) send(evt StreamEvent) {
+	for _, s := range rs.subs {
+		s.send(evt)
+	}
+}
+
+func (rs *runStream) close() {
+	for _, s := range rs.subs {
+		s.Close()
+	}
+}
+
+// SetStreamBuffer sets the buffer size of subscriptions created afterwards
+// and the policy they apply when it is full.
+func (r *Runner) SetStreamBuffer(size int, policy StreamPolicy) *Runner {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+	r.hub.size, r.hub.policy = size, policy
+	return r
+}
+
+// Subscribe returns a subscription to the events of the next run the runner
+// starts or resumes in sessionID, or in any session if sessionID is empty.
+// Events are only delivered to subscriptions made before the run begins. A
+// subscription receives the events of a single run, including those of its
+// subgraphs, and is closed when the run stops.
+func (r *Runner) Subscribe(sessionID string) *Subscription {
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+	s := &Subscription{
+		sessionID: sessionID,
+		hub:       r.hub,
+		ch:        make(chan StreamEvent, r.hub.size),
+		policy:    r.hub.policy,
+		done:      make(chan struct{}),
+	}
+	r.hub.pending = append(r.hub.pending, s)
+	return s
+}
+
+// Dropped returns the number of events the runner's subscriptions discarded
+// because their buffers were full.
+func (r *Runner) Dropped() int64 {
+	return r.hub.dropped.Load()
+}
+
+// begin returns the runner that executes a run in sessionID, streaming to
+// the subscriptions waiting for it, and a function that closes them once
+// the run stops. A runner that already executes a run, such as a
+// subgraph's, is returned as it is.
+func (r *Runner) begin(sessionID string) (*Runner, func()) {
+	if r.stream != nil {
+		return r, func() {}
+	}
+	run := &Runner{
+		graph:  r.graph,
+		store:  r.store,
+		hub:    r.hub,
+		stream: r.hub.claim(sessionID),
+		ns:     r.ns,
+		replay: r.replay,
+		guard:  r.guard,
+	}
+	return run, run.stream.close
+}
+
+type streamWriterKey struct{}
+
+// StreamWriter emits events from inside a running node, such as progress
+// updates or the tokens of a model response, on the runner's stream. Events
+// are tagged with the node, its fan-out branch and subgraph namespace.
+type StreamWriter struct {
+	r      *Runner
+	node   string
+	branch string
+}
+
+// StreamWriterFrom returns the stream writer of the graph node running with
+// ctx. Outside a graph node it returns a writer that discards events.
+func StreamWriterFrom(ctx context.Context) *StreamWriter {
+	if w, ok := ctx.Value(streamWriterKey{}).(*StreamWriter); ok {
+		return w
+	}
+	return &StreamWriter{}
+}
+
+func withStreamWriter(ctx context.Context, r *Runner, nodeID, branchID string) context.Context {
+	return context.WithValue(ctx, streamWriterKey{}, &StreamWriter{r: r, node: nodeID, branch: branchID})
+}
+
+// Emit sends an event of a custom type with payload.
+func (w *StreamWriter) Emit(eventType string, payload any) {
+	if w.r == nil {
+		return
+	}
+	w.r.emit(StreamEvent{Type: eventType, NodeID: w.node, Branch: w.branch, Payload: payload})
+}
+
+// Progress sends a "progress" event with payload.
+func (w *StreamWriter) Progress(payload any) {
+	w.Emit("progress", payload)
+}
+
+// Token sends a "token" event carrying a delta of streamed model output.
+func (w *StreamWriter) Token(delta string) {
+	if w.r == nil || delta == "" {
+		return
+	}
+	w.r.emit(StreamEvent{Type: "token", NodeID: w.node, Branch: w.branch, Delta: delta})
+}
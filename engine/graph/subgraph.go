@@ -0,0 +1,127 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// metaSubgraph records, on the checkpoint of a parent run paused by a
+// subgraph interrupt, the ID of the paused subgraph run.
+const metaSubgraph = "subgraph_run"
+
+// Subgraph embeds a compiled graph as a single node of another graph.
+type Subgraph struct {
+	Graph *CompiledGraph
+	// Input maps subgraph state keys to the parent keys they are read from.
+	// A nil Input passes a copy of the whole parent state.
+	Input map[string]string
+	// Output maps parent state keys to the subgraph keys they are set from
+	// once the subgraph completes. A nil Output returns the whole final
+	// subgraph state as the node's update.
+	Output map[string]string
+}
+
+// input builds the subgraph's initial state from the parent state.
+func (s *Subgraph) input(parent State) State {
+	if s.Input == nil {
+		return copyState(parent)
+	}
+	in := make(State, len(s.Input))
+	for key, from := range s.Input {
+		if v, ok := parent[from]; ok {
+			in[key] = v
+		}
+	}
+	return in
+}
+
+// output builds the parent update from the subgraph's final state.
+func (s *Subgraph) output(final State) State {
+	if s.Output == nil {
+		return final
+	}
+	out := make(State, len(s.Output))
+	for key, from := range s.Output {
+		if v, ok := final[from]; ok {
+			out[key] = v
+		}
+	}
+	return out
+}
+
+// subgraphSession returns the session the subgraph run by nodeID checkpoints
+// under, nested inside the parent's session.
+func subgraphSession(parent, nodeID string) string {
+	return parent + "/" + nodeID
+}
+
+// runSubgraph executes node's subgraph on state. If rp names a paused
+// subgraph run, that run is resumed with rp's input instead of starting a
+// new one. When the subgraph pauses on an interrupt, paused is its run state
+// and update is nil.
+func (r *Runner) runSubgraph(ctx context.Context, rs *RunState, node *Node, state State, rp *resumePoint) (update State, paused *RunState, err error) {
+	sub := node.Subgraph
+	if sub.Graph == nil {
+		return nil, nil, fmt.Errorf("subgraph node %q has no graph", node.ID)
+	}
+	ns := node.ID
+	if r.ns != "" {
+		ns = r.ns + "/" + node.ID
+	}
+	child := &Runner{graph: sub.Graph, store: r.store, stream: r.stream, runID: r.runID, ns: ns, guard: r.guard}
+	session := subgraphSession(rs.SessionID, node.ID)
+
+	var crs *RunState
+	if rp != nil && rp.subgraph != "" {
+		cp, err := latestRunCheckpoint(ctx, r.store, session, rp.subgraph)
+		if err != nil {
+			return nil, nil, fmt.Errorf("subgraph %q: %w", node.ID, err)
+		}
+		crs, err = child.resume(ctx, cp, rp.input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("subgraph %q: %w", node.ID, err)
+		}
+	} else {
+		crs, err = child.execute(ctx, &RunState{
+			RunID:       newRunID(),
+			SessionID:   session,
+			GraphID:     sub.Graph.ID,
+			CurrentNode: sub.Graph.Entry,
+			Status:      RunStatusRunning,
+			State:       sub.input(state),
+			StartedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("subgraph %q: %w", node.ID, err)
+		}
+	}
+	if crs.Status == RunStatusPaused {
+		return nil, crs, nil
+	}
+	if crs.Status == RunStatusWaiting {
+		return nil, nil, fmt.Errorf("subgraph %q: timer nodes inside subgraphs are not supported", node.ID)
+	}
+	return sub.output(crs.State), nil, nil
+}
+
+// latestRunCheckpoint returns the most recent checkpoint of runID in session.
+func latestRunCheckpoint(ctx context.Context, store storage.Storage, session, runID string) (*storage.Checkpoint, error) {
+	cps, err := store.ListCheckpoints(ctx, session)
+	if err != nil {
+		return nil, fmt.Errorf("list checkpoints: %w", err)
+	}
+	var latest *storage.Checkpoint
+	for _, cp := range cps {
+		if cp.RunID == runID && (latest == nil || cp.SeqNum > latest.SeqNum) {
+			latest = cp
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no checkpoint found for run %q", runID)
+	}
+	return latest, nil
+}
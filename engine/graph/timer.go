@@ -0,0 +1,101 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Checkpoint metadata keys written when a run suspends on a timer node.
+const (
+	metaWakeAt = storage.WakeAtKey // time the run wakes up, in storage.WakeAtFormat
+	metaGraph  = "graph"           // graph the waiting run belongs to
+)
+
+// WakeFunc returns the time a timer node wakes up at, given the state the
+// run reached it with.
+type WakeFunc func(state State) time.Time
+
+// ErrNotDue is returned when a run suspended on a timer is resumed before
+// its wake-up time.
+var ErrNotDue = errors.New("timer is not due")
+
+// AddTimerNode registers a node that suspends the run until the time
+// returned by wake, then runs fn (which may be nil). The wait is recorded in
+// a checkpoint, so it survives process restarts; a scheduler resumes the
+// run once it is due. A wake-up time in the past runs fn immediately.
+func (g *StateGraph) AddTimerNode(id string, wake WakeFunc, fn NodeFunc) *StateGraph {
+	if fn == nil {
+		fn = func(context.Context, State) (State, error) { return nil, nil }
+	}
+	g.nodes[id] = &Node{ID: id, Fn: fn, Wake: wake}
+	return g
+}
+
+// AddSleepNode registers a timer node that suspends the run for d each
+// time it is reached, then runs fn (which may be nil).
+func (g *StateGraph) AddSleepNode(id string, d time.Duration, fn NodeFunc) *StateGraph {
+	return g.AddTimerNode(id, func(State) time.Time { return time.Now().Add(d) }, fn)
+}
+
+// wait checkpoints rs as suspended before the timer node nodeID until at.
+func (r *Runner) wait(ctx context.Context, rs *RunState, nodeID string, at time.Time) (*RunState, error) {
+	rs.Status = RunStatusWaiting
+	rs.WakeAt = at
+	r.emit(StreamEvent{Type: "timer", NodeID: nodeID, State: rs.State, Payload: at})
+	meta := map[string]any{
+		metaNext:   nodeID,
+		metaWakeAt: at.UTC().Format(storage.WakeAtFormat),
+		metaGraph:  r.graph.ID,
+	}
+	if _, err := r.checkpoint(ctx, rs, nodeID, rs.State, meta); err != nil {
+		return rs, fmt.Errorf("checkpoint on timer: %w", err)
+	}
+	return rs, nil
+}
+
+// wakeAt returns the wake-up time recorded in cp, if the run was suspended
+// on a timer there.
+func wakeAt(cp *storage.Checkpoint) (time.Time, bool) {
+	s, ok := cp.Metadata[metaWakeAt].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(storage.WakeAtFormat, s)
+	return t, err == nil
+}
+
+// DueRun is a run suspended on a timer node whose wake-up time has passed.
+type DueRun struct {
+	SessionID string
+	RunID     string
+	GraphID   string
+	NodeID    string
+	WakeAt    time.Time
+}
+
+// ListDueRuns returns the runs in store whose timers are due at t. The store
+// must implement storage.TimerStore.
+func ListDueRuns(ctx context.Context, store storage.Storage, t time.Time) ([]DueRun, error) {
+	ts, ok := store.(storage.TimerStore)
+	if !ok {
+		return nil, errors.New("list due runs: storage does not support durable timers")
+	}
+	cps, err := ts.ListDueCheckpoints(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("list due runs: %w", err)
+	}
+	out := make([]DueRun, 0, len(cps))
+	for _, cp := range cps {
+		at, ok := wakeAt(cp)
+		if !ok {
+			continue
+		}
+		graphID, _ := cp.Metadata[metaGraph].(string)
+		out = append(out, DueRun{SessionID: cp.SessionID, RunID: cp.RunID, GraphID: graphID, NodeID: cp.NodeID, WakeAt: at})
+	}
+	return out, nil
+}
@@ -10,19 +10,48 @@ import (
 type State map[string]any
 
 // NodeFunc is the function signature for a graph node.
-// It receives the current state and returns updated state.
+// It receives the current state and returns an update: the keys it sets are
+// merged into the state (through the graph's reducers, if any); keys it
+// omits keep their current value.
 type NodeFunc func(ctx context.Context, state State) (State, error)
 
 // EdgeCondition decides which node to transition to based on state.
 // Returns the target node ID.
 type EdgeCondition func(state State) string
 
+// PromptFunc builds the payload shown to a human when the run pauses at an
+// interrupt node, such as a question or the action awaiting approval.
+type PromptFunc func(state State) any
+
 // Node represents a node in the state graph.
 type Node struct {
 	ID string
 	Fn NodeFunc
 	// Interrupt, if true, causes the runner to checkpoint and pause before executing this node.
 	Interrupt bool
+	// Prompt, if set, builds the payload carried by the interrupt event.
+	Prompt PromptFunc
+	// Join, if true, marks the node as the merge point of a fan-out: it runs
+	// once every branch has reached it.
+	Join bool
+	// Reducers merge branch results per key when the node is a join. They
+	// take precedence over the graph's reducers for the same key.
+	Reducers map[string]Reducer
+	// Wake, if set, makes the node a timer: the run is suspended until the
+	// returned time before Fn executes.
+	Wake WakeFunc
+	// Subgraph, if set, runs a nested compiled graph instead of Fn.
+	Subgraph *Subgraph
+	// Map, if set, runs a compiled graph for every item of a list instead
+	// of Fn.
+	Map *MapNode
+	// Retry controls how failed executions of the node are retried.
+	Retry *RetryPolicy
+	// OnError, if set, is the node the run continues at when the node still
+	// fails after its retries, instead of failing the run.
+	OnError string
+	// MaxVisits, if positive, limits how often a run executes the node.
+	MaxVisits int
 }
 
 // Edge represents a transition between nodes.
@@ -30,6 +59,13 @@ type Edge struct {
 	From      string
 	To        string        // static target (mutually exclusive with Condition)
 	Condition EdgeCondition // dynamic routing (mutually exclusive with To)
+	Routes    []string      // declared results of Condition; empty means undeclared
+
+	// Targets lists fan-out branches that run concurrently (mutually exclusive
+	// with To and Condition). Each branch follows its own edges until it
+	// reaches Join, where the results are merged.
+	Targets []string
+	Join    string
 }
 
 // RunStatus represents the status of a graph run.
@@ -38,8 +74,12 @@ type RunStatus string
 const (
 	RunStatusRunning   RunStatus = "running"
 	RunStatusPaused    RunStatus = "paused"
+	RunStatusWaiting   RunStatus = "waiting" // suspended on a timer node until WakeAt
 	RunStatusCompleted RunStatus = "completed"
 	RunStatusFailed    RunStatus = "failed"
+	RunStatusCancelled RunStatus = "cancelled" // stopped with Runner.Cancel; resumable
+
+	RunStatusLimitExceeded RunStatus = "limit_exceeded" // stopped by a step, visit or fixpoint limit
 )
 
 // RunState captures the full runtime state for a single graph execution.
@@ -51,6 +91,7 @@ type RunState struct {
 	Status      RunStatus `json:"status"`
 	State       State     `json:"state"`
 	SeqNum      int64     `json:"seq_num"`
+	Steps       int       `json:"steps"` // nodes executed, including those before the run was resumed
 	StartedAt   time.Time `json:"started_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 
@@ -58,6 +99,24 @@ type RunState struct {
 	Messages   []Message        `json:"messages,omitempty"`
 	ToolCalls  []ToolCallRecord `json:"tool_calls,omitempty"`
 	TotalUsage UsageStats       `json:"total_usage"`
+
+	// Interrupt is the prompt payload of the interrupt the run is paused at.
+	Interrupt any `json:"interrupt,omitempty"`
+	// WakeAt is the time a run suspended on a timer node wakes up.
+	WakeAt time.Time `json:"wake_at,omitempty"`
+
+	// resumed is set when execution continues at a paused interrupt or
+	// subgraph node.
+	resumed *resumePoint
+	// limits tracks the run's steps against the graph's limits.
+	limits *limitTracker
+}
+
+// resumePoint describes how a paused node continues on resume.
+type resumePoint struct {
+	subgraph string      // paused subgraph run to resume
+	input    State       // human input given on resume
+	mapped   map[int]any // outputs of the map node's completed items
 }
 
 // Message records a message exchanged during the run.
@@ -83,9 +142,14 @@ type UsageStats struct {
 
 // StreamEvent is emitted during graph execution for real-time observability.
 type StreamEvent struct {
-	Type      string    `json:"type"` // node_start, node_end, edge_transition, checkpoint, interrupt, error
+	Type      string    `json:"type"`             // node_start, node_end, edge_transition, fan_out, join, interrupt, timer, retry, error, completed, token, progress or a custom type
+	RunID     string    `json:"run_id,omitempty"` // top-level run, also for subgraph events
 	NodeID    string    `json:"node_id,omitempty"`
+	Branch    string    `json:"branch,omitempty"`
+	Namespace string    `json:"namespace,omitempty"` // subgraph node path, e.g. "research/retrieve"
 	State     State     `json:"state,omitempty"`
+	Payload   any       `json:"payload,omitempty"` // interrupt prompt, wake-up time or custom payload
+	Delta     string    `json:"delta,omitempty"`   // streamed model output of a token event
 	Error     string    `json:"error,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
@@ -0,0 +1,264 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IssueKind classifies a problem found while compiling a graph.
+type IssueKind string
+
+const (
+	IssueNoEntry       IssueKind = "no_entry"       // SetEntryPoint was never called
+	IssueMissingNode   IssueKind = "missing_node"   // an edge refers to a node that does not exist
+	IssueMultipleEdges IssueKind = "multiple_edges" // a node has more than one outgoing edge
+	IssueDeadEnd       IssueKind = "dead_end"       // a node has no outgoing edge
+	IssueUnreachable   IssueKind = "unreachable"    // a node cannot be reached from the entry point
+	IssueInvalidFanOut IssueKind = "invalid_fan_out"
+
+	IssueInvalidMigration IssueKind = "invalid_migration" // a migration does not lead to the graph's version
+)
+
+// Issue is a single problem found by Compile.
+type Issue struct {
+	Kind    IssueKind `json:"kind"`
+	NodeID  string    `json:"node_id,omitempty"` // node the issue is about (edge source for edge issues)
+	Target  string    `json:"target,omitempty"`  // referenced node, for edge issues
+	Message string    `json:"message"`
+}
+
+// ValidationError is returned by Compile and lists every problem found in
+// the graph. Use errors.As to inspect the individual issues.
+type ValidationError struct {
+	GraphID string
+	Issues  []Issue
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Issues) == 1 {
+		return fmt.Sprintf("graph %q: %s", e.GraphID, e.Issues[0].Message)
+	}
+	msgs := make([]string, len(e.Issues))
+	for i, is := range e.Issues {
+		msgs[i] = is.Message
+	}
+	return fmt.Sprintf("graph %q: %d problems: %s", e.GraphID, len(e.Issues), strings.Join(msgs, "; "))
+}
+
+// validate checks the graph structure and returns every problem found.
+func (g *StateGraph) validate(entry string, adj map[string][]*Edge) []Issue {
+	if entry == "" {
+		return []Issue{{Kind: IssueNoEntry, Message: "no entry point set"}}
+	}
+	if _, ok := g.nodes[entry]; !ok {
+		return []Issue{{Kind: IssueMissingNode, NodeID: StartNode, Target: entry,
+			Message: fmt.Sprintf("entry node %q not found", entry)}}
+	}
+
+	var issues []Issue
+	for _, e := range g.edges {
+		issues = append(issues, g.validateEdge(e)...)
+	}
+	for _, from := range sortedKeys(g.onError) {
+		to := g.onError[from]
+		if _, ok := g.nodes[from]; !ok {
+			issues = append(issues, Issue{Kind: IssueMissingNode, NodeID: from, Target: from,
+				Message: fmt.Sprintf("error edge source %q not found", from)})
+		}
+		if !g.isTarget(to) {
+			issues = append(issues, Issue{Kind: IssueMissingNode, NodeID: from, Target: to,
+				Message: fmt.Sprintf("error edge target %q not found", to)})
+		}
+	}
+	for _, id := range sortedKeys(g.retries) {
+		if _, ok := g.nodes[id]; !ok {
+			issues = append(issues, Issue{Kind: IssueMissingNode, NodeID: id, Target: id,
+				Message: fmt.Sprintf("retry policy set for unknown node %q", id)})
+		}
+	}
+	for _, id := range sortedKeys(g.maxVisits) {
+		if _, ok := g.nodes[id]; !ok {
+			issues = append(issues, Issue{Kind: IssueMissingNode, NodeID: id, Target: id,
+				Message: fmt.Sprintf("visit limit set for unknown node %q", id)})
+		}
+	}
+
+	issues = append(issues, g.validateMigrations()...)
+
+	for _, from := range sortedKeys(adj) {
+		if n := len(adj[from]); n > 1 {
+			issues = append(issues, Issue{Kind: IssueMultipleEdges, NodeID: from,
+				Message: fmt.Sprintf("node %q has %d outgoing edges; only one is allowed (use a conditional edge or a fan-out)", from, n)})
+		}
+	}
+
+	ids := sortedKeys(g.nodes)
+	for _, id := range ids {
+		if len(adj[id]) == 0 {
+			issues = append(issues, Issue{Kind: IssueDeadEnd, NodeID: id,
+				Message: fmt.Sprintf("node %q has no outgoing edge (use SetFinishPoint to end the graph there)", id)})
+		}
+	}
+
+	if reached, complete := g.reachable(entry, adj); complete {
+		for _, id := range ids {
+			if !reached[id] {
+				issues = append(issues, Issue{Kind: IssueUnreachable, NodeID: id,
+					Message: fmt.Sprintf("node %q is unreachable from the entry point", id)})
+			}
+		}
+	}
+	return issues
+}
+
+// validateEdge checks that every node an edge refers to exists.
+func (g *StateGraph) validateEdge(e *Edge) []Issue {
+	var issues []Issue
+	missing := func(target, msg string) {
+		issues = append(issues, Issue{Kind: IssueMissingNode, NodeID: e.From, Target: target, Message: msg})
+	}
+	if _, ok := g.nodes[e.From]; !ok && e.From != StartNode {
+		missing(e.From, fmt.Sprintf("edge source %q not found", e.From))
+	}
+	if e.To != "" && !g.isTarget(e.To) {
+		missing(e.To, fmt.Sprintf("edge target %q not found", e.To))
+	}
+	for _, route := range e.Routes {
+		if !g.isTarget(route) {
+			missing(route, fmt.Sprintf("conditional edge from %q: route %q not found", e.From, route))
+		}
+	}
+	if len(e.Targets) > 0 {
+		issues = append(issues, g.validateFanOut(e)...)
+	}
+	return issues
+}
+
+func (g *StateGraph) validateFanOut(e *Edge) []Issue {
+	invalid := func(target, msg string) []Issue {
+		return []Issue{{Kind: IssueInvalidFanOut, NodeID: e.From, Target: target,
+			Message: fmt.Sprintf("fan-out from %q: %s", e.From, msg)}}
+	}
+	join, ok := g.nodes[e.Join]
+	if !ok {
+		return invalid(e.Join, fmt.Sprintf("join node %q not found", e.Join))
+	}
+	if !join.Join {
+		return invalid(e.Join, fmt.Sprintf("node %q is not a join node", e.Join))
+	}
+	var issues []Issue
+	seen := make(map[string]bool, len(e.Targets))
+	for _, t := range e.Targets {
+		if _, ok := g.nodes[t]; !ok {
+			issues = append(issues, invalid(t, fmt.Sprintf("target %q not found", t))...)
+		}
+		if seen[t] {
+			issues = append(issues, invalid(t, fmt.Sprintf("duplicate target %q", t))...)
+		}
+		seen[t] = true
+	}
+	return issues
+}
+
+// reachable returns the nodes reachable from entry. complete is false when a
+// reachable conditional edge does not declare its routes, in which case any
+// node may be reachable and the result must not be used to report orphans.
+func (g *StateGraph) reachable(entry string, adj map[string][]*Edge) (reached map[string]bool, complete bool) {
+	reached = map[string]bool{entry: true}
+	queue := []string{entry}
+	visit := func(id string) {
+		if _, ok := g.nodes[id]; ok && !reached[id] {
+			reached[id] = true
+			queue = append(queue, id)
+		}
+	}
+	complete = true
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		visit(g.onError[id])
+		for _, e := range adj[id] {
+			if e.Condition != nil && len(e.Routes) == 0 {
+				complete = false
+			}
+			visit(e.To)
+			for _, t := range e.Routes {
+				visit(t)
+			}
+			for _, t := range e.Targets {
+				visit(t)
+			}
+			if e.Join != "" {
+				visit(e.Join)
+			}
+		}
+	}
+	return reached, complete
+}
+
+// isTarget reports whether id can be the target of an edge.
+func (g *StateGraph) isTarget(id string) bool {
+	if id == EndNode {
+		return true
+	}
+	_, ok := g.nodes[id]
+	return ok
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateMigrations checks that every migration leads to the graph's
+// version and that the last one renames nodes to nodes of the graph.
+func (g *StateGraph) validateMigrations() []Issue {
+	var issues []Issue
+	invalid := func(m Migration, msg string) {
+		issues = append(issues, Issue{Kind: IssueInvalidMigration,
+			Message: fmt.Sprintf("migration from version %q: %s", m.From, msg)})
+	}
+	byFrom := make(map[string]Migration, len(g.migrations))
+	for _, m := range g.migrations {
+		if _, dup := byFrom[m.From]; dup {
+			invalid(m, "more than one migration from this version")
+			continue
+		}
+		byFrom[m.From] = m
+	}
+	for _, m := range g.migrations {
+		switch {
+		case g.version == "":
+			invalid(m, "the graph has no version; use SetVersion")
+			continue
+		case m.From == g.version:
+			invalid(m, "migrates from the graph's own version")
+			continue
+		}
+		// Follow the chain; it must end at the graph's version.
+		seen := map[string]bool{m.From: true}
+		v := m.To
+		for v != g.version {
+			next, ok := byFrom[v]
+			if !ok || seen[v] {
+				invalid(m, fmt.Sprintf("does not lead to version %q", g.version))
+				break
+			}
+			seen[v] = true
+			v = next.To
+		}
+		if m.To == g.version {
+			for _, old := range sortedKeys(m.Nodes) {
+				if to := m.Nodes[old]; !g.isTarget(to) {
+					invalid(m, fmt.Sprintf("node %q is renamed to unknown node %q", old, to))
+				}
+			}
+		}
+	}
+	return issues
+}
@@ -0,0 +1,278 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spawn08/chronos/storage"
+)
+
+// Kinds of queued runs.
+const (
+	queueKindRun    = "run"    // start a new run with the queued input
+	queueKindResume = "resume" // resume the session's paused or waiting run
+)
+
+// Enqueue queues a new run of the graph graphID in sessionID for a pool of
+// workers and returns the queued run's ID. store must implement
+// storage.RunQueue.
+func Enqueue(ctx context.Context, store storage.Storage, graphID, sessionID string, input State) (string, error) {
+	q := &storage.QueuedRun{
+		ID:        fmt.Sprintf("q_%d", time.Now().UnixNano()),
+		Kind:      queueKindRun,
+		SessionID: sessionID,
+		GraphID:   graphID,
+		Input:     input,
+		CreatedAt: time.Now(),
+	}
+	if cp, err := store.GetLatestCheckpoint(ctx, sessionID); err == nil {
+		q.CheckpointID = cp.ID
+	}
+	if err := enqueue(ctx, store, q); err != nil {
+		return "", err
+	}
+	return q.ID, nil
+}
+
+// EnqueueResume queues the resumption of the run paused or waiting in
+// sessionID, with input as the human response to an interrupt (see
+// Runner.ResumeWith). The queued run is keyed by the checkpoint the run
+// stopped at, so enqueueing the same resumption twice queues it once.
+func EnqueueResume(ctx context.Context, store storage.Storage, graphID, sessionID string, input State) (string, error) {
+	cp, err := store.GetLatestCheckpoint(ctx, sessionID)
+	if err != nil {
+		return "", fmt.Errorf("enqueue resume: no checkpoint found: %w", err)
+	}
+	q := &storage.QueuedRun{
+		ID:           "q_" + cp.ID,
+		Kind:         queueKindResume,
+		SessionID:    sessionID,
+		GraphID:      graphID,
+		CheckpointID: cp.ID,
+		Input:        input,
+		CreatedAt:    time.Now(),
+	}
+	if err := enqueue(ctx, store, q); err != nil {
+		return "", err
+	}
+	return q.ID, nil
+}
+
+func enqueue(ctx context.Context, store storage.Storage, q *storage.QueuedRun) error {
+	queue, ok := store.(storage.RunQueue)
+	if !ok {
+		return errors.New("enqueue: storage does not support run queues")
+	}
+	if err := queue.EnqueueRun(ctx, q); err != nil {
+		return fmt.Errorf("enqueue: %w", err)
+	}
+	return nil
+}
+
+// Worker executes runs leased from a storage.RunQueue. Any number of
+// workers, in one process or many, can share a queue: a run is leased to one
+// worker at a time, and the lease is renewed in the background and before
+// every node and checkpoint. When a worker dies, its lease expires and
+// another worker continues the run from its latest checkpoint, so nodes
+// that completed are not run again. A worker that loses its lease stops
+// before running another node.
+type Worker struct {
+	ID    string
+	Lease time.Duration // lease duration, renewed every third of it (default 30s)
+	Poll  time.Duration // wait between polls of an empty queue (default 1s)
+
+	store storage.Storage
+	queue storage.RunQueue
+
+	mu     sync.RWMutex
+	graphs map[string]*CompiledGraph
+}
+
+// NewWorker creates a worker that leases runs from store, which must
+// implement storage.RunQueue. Only runs of registered graphs are leased.
+func NewWorker(id string, store storage.Storage) (*Worker, error) {
+	queue, ok := store.(storage.RunQueue)
+	if !ok {
+		return nil, errors.New("worker: storage does not support run queues")
+	}
+	return &Worker{
+		ID:     id,
+		Lease:  30 * time.Second,
+		Poll:   time.Second,
+		store:  store,
+		queue:  queue,
+		graphs: make(map[string]*CompiledGraph),
+	}, nil
+}
+
+// Register lets the worker lease runs of g.
+func (w *Worker) Register(g *CompiledGraph) *Worker {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.graphs[g.ID] = g
+	return w
+}
+
+func (w *Worker) graphIDs() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	ids := make([]string, 0, len(w.graphs))
+	for id := range w.graphs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Run leases and executes runs until ctx is done.
+func (w *Worker) Run(ctx context.Context) error {
+	for {
+		leased, err := w.Next(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("worker %s: %v", w.ID, err)
+		}
+		if leased {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.Poll):
+		}
+	}
+}
+
+// Next leases one queued run and executes it until it completes, fails,
+// pauses or waits on a timer. It reports whether a run was leased. If ctx
+// is done before the run stops, the run is handed back to the queue.
+func (w *Worker) Next(ctx context.Context) (bool, error) {
+	q, err := w.queue.LeaseRun(ctx, w.ID, w.graphIDs(), w.Lease)
+	if err != nil || q == nil {
+		return false, err
+	}
+	w.mu.RLock()
+	g := w.graphs[q.GraphID]
+	w.mu.RUnlock()
+	if g == nil {
+		return true, w.queue.FinishRun(ctx, q.ID, w.ID, "queued", "")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var lost atomic.Bool
+	renew := func(ctx context.Context) error {
+		err := w.queue.RenewLease(ctx, q.ID, w.ID, w.Lease)
+		if errors.Is(err, storage.ErrLeaseLost) {
+			lost.Store(true)
+			cancel()
+		}
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(w.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = renew(runCtx)
+			}
+		}
+	}()
+
+	r := NewRunner(g, w.store)
+	r.guard = renew
+	rs, err := w.execute(runCtx, r, q)
+	close(done)
+
+	switch {
+	case lost.Load() || errors.Is(err, storage.ErrLeaseLost):
+		// Another worker has taken the run over.
+		return true, nil
+	case ctx.Err() != nil:
+		return true, w.queue.FinishRun(context.Background(), q.ID, w.ID, "queued", "")
+	}
+	status, errMsg := string(RunStatusFailed), ""
+	if rs != nil {
+		status = string(rs.Status)
+	}
+	if err != nil {
+		errMsg = err.Error()
+		if rs == nil || rs.Status != RunStatusLimitExceeded {
+			status = string(RunStatusFailed)
+		}
+	}
+	if ferr := w.queue.FinishRun(ctx, q.ID, w.ID, status, errMsg); ferr != nil {
+		return true, fmt.Errorf("finish run %s: %w", q.ID, ferr)
+	}
+	return true, nil
+}
+
+// execute starts the queued run, or continues it if an earlier worker
+// checkpointed progress before its lease expired.
+func (w *Worker) execute(ctx context.Context, r *Runner, q *storage.QueuedRun) (*RunState, error) {
+	cp, err := w.store.GetLatestCheckpoint(ctx, q.SessionID)
+	if err != nil && q.CheckpointID != "" {
+		return nil, fmt.Errorf("latest checkpoint: %w", err)
+	}
+	if err != nil || cp.ID == q.CheckpointID {
+		if q.Kind == queueKindResume {
+			return r.ResumeWith(ctx, q.SessionID, State(q.Input))
+		}
+		return r.Run(ctx, q.SessionID, State(q.Input))
+	}
+	return r.takeOver(ctx, cp)
+}
+
+// takeOver continues the run recorded in cp on behalf of a worker whose
+// lease expired. A run that stopped at an interrupt, or at a timer that is
+// not due, is left as it is.
+func (r *Runner) takeOver(ctx context.Context, cp *storage.Checkpoint) (*RunState, error) {
+	r, end := r.begin(cp.SessionID)
+	defer end()
+	cp, err := r.graph.migrate(cp)
+	if err != nil {
+		return nil, fmt.Errorf("take over: %w", err)
+	}
+	state, err := r.graph.conform(State(cp.State))
+	if err != nil {
+		return nil, fmt.Errorf("take over: checkpoint %q: %w", cp.ID, err)
+	}
+	rs := &RunState{
+		RunID:       cp.RunID,
+		SessionID:   cp.SessionID,
+		GraphID:     r.graph.ID,
+		CurrentNode: cp.NodeID,
+		State:       state,
+		SeqNum:      cp.SeqNum,
+		UpdatedAt:   time.Now(),
+	}
+	restoreLimits(rs, cp)
+	if r.interrupted(cp) {
+		rs.Status = RunStatusPaused
+		rs.Interrupt = cp.Metadata[metaPrompt]
+		return rs, nil
+	}
+	if at, ok := wakeAt(cp); ok && time.Now().Before(at) {
+		rs.Status, rs.WakeAt = RunStatusWaiting, at
+		return rs, nil
+	}
+	return r.resume(ctx, cp, nil)
+}
+
+// checkLease fails if the runner executes a leased run whose lease was
+// lost, renewing the lease otherwise.
+func (r *Runner) checkLease(ctx context.Context) error {
+	if r.guard == nil {
+		return nil
+	}
+	return r.guard(ctx)
+}
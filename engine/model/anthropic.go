@@ -62,7 +62,7 @@ func (a *Anthropic) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse,
 	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
 		return nil, fmt.Errorf("anthropic chat decode: %w", err)
 	}
-	return a.convertResponse(&raw), nil
+	return a.convertResponse(&raw, req.ResponseSchema != nil), nil
 }
 
 func (a *Anthropic) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
@@ -83,7 +83,7 @@ func (a *Anthropic) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *C
 	go func() {
 		defer resp.Body.Close()
 		defer close(ch)
-		a.readSSEStream(resp, ch)
+		a.readSSEStream(resp, ch, req.ResponseSchema != nil)
 	}()
 	return ch, nil
 }
@@ -163,13 +163,30 @@ func (a *Anthropic) buildRequestBody(req *ChatRequest, stream bool) map[string]a
 		}
 		body["tools"] = tools
 	}
+	if req.ResponseSchema != nil {
+		// Anthropic has no JSON mode: the answer is forced through a tool
+		// whose input is the response, and converted back to text.
+		tools, _ := body["tools"].([]map[string]any)
+		body["tools"] = append(tools, map[string]any{
+			"name":         StructuredOutputName,
+			"description":  "Give your final answer. Call this tool instead of answering in text.",
+			"input_schema": req.ResponseSchema,
+		})
+		if len(req.Tools) == 0 {
+			body["tool_choice"] = map[string]any{"type": "tool", "name": StructuredOutputName}
+		} else {
+			body["tool_choice"] = map[string]any{"type": "any"}
+		}
+	}
 	if stream {
 		body["stream"] = true
 	}
 	return body
 }
 
-func (a *Anthropic) convertResponse(raw *anthropicResponse) *ChatResponse {
+// convertResponse converts a response. When structured, a call of the
+// structured output tool becomes the response's content.
+func (a *Anthropic) convertResponse(raw *anthropicResponse, structured bool) *ChatResponse {
 	cr := &ChatResponse{
 		ID:   raw.ID,
 		Role: RoleAssistant,
@@ -180,12 +197,17 @@ func (a *Anthropic) convertResponse(raw *anthropicResponse) *ChatResponse {
 	}
 
 	var textParts []string
+	var output string
 	for _, block := range raw.Content {
 		switch block.Type {
 		case "text":
 			textParts = append(textParts, block.Text)
 		case "tool_use":
 			argsJSON, _ := json.Marshal(block.Input)
+			if structured && block.Name == StructuredOutputName {
+				output = string(argsJSON)
+				continue
+			}
 			cr.ToolCalls = append(cr.ToolCalls, ToolCall{
 				ID:        block.ID,
 				Name:      block.Name,
@@ -194,21 +216,29 @@ func (a *Anthropic) convertResponse(raw *anthropicResponse) *ChatResponse {
 		}
 	}
 	cr.Content = strings.Join(textParts, "")
-
-	switch raw.StopReason {
-	case "end_turn", "stop_sequence":
+	cr.StopReason = mapAnthropicStopReason(raw.StopReason)
+	if output != "" && len(cr.ToolCalls) == 0 {
+		cr.Content = output
 		cr.StopReason = StopReasonEnd
+	}
+	return cr
+}
+
+func mapAnthropicStopReason(reason string) StopReason {
+	switch reason {
 	case "max_tokens":
-		cr.StopReason = StopReasonMaxTokens
+		return StopReasonMaxTokens
 	case "tool_use":
-		cr.StopReason = StopReasonToolCall
+		return StopReasonToolCall
 	default:
-		cr.StopReason = StopReasonEnd
+		return StopReasonEnd
 	}
-	return cr
 }
 
-func (a *Anthropic) readSSEStream(resp *http.Response, ch chan<- *ChatResponse) {
+// readSSEStream reads a streamed response. When structured, the input of
+// the structured output tool is streamed as the response's content.
+func (a *Anthropic) readSSEStream(resp *http.Response, ch chan<- *ChatResponse, structured bool) {
+	outputBlock, toolCalls := -1, false
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -220,8 +250,10 @@ func (a *Anthropic) readSSEStream(resp *http.Response, ch chan<- *ChatResponse)
 		var event struct {
 			Type  string `json:"type"`
 			Delta struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
+				Type        string `json:"type"`
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+				StopReason  string `json:"stop_reason"`
 			} `json:"delta"`
 			ContentBlock struct {
 				Type  string `json:"type"`
@@ -229,21 +261,55 @@ func (a *Anthropic) readSSEStream(resp *http.Response, ch chan<- *ChatResponse)
 				Name  string `json:"name"`
 				Input any    `json:"input"`
 			} `json:"content_block"`
+			Message struct {
+				Usage struct {
+					InputTokens int `json:"input_tokens"`
+				} `json:"usage"`
+			} `json:"message"`
+			Usage struct {
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
 			Index int `json:"index"`
 		}
 		if err := json.Unmarshal([]byte(data), &event); err != nil {
 			continue
 		}
 
+		cr := &ChatResponse{Role: RoleAssistant, Delta: true}
 		switch event.Type {
+		case "message_start":
+			cr.Usage.PromptTokens = event.Message.Usage.InputTokens
+			ch <- cr
+		case "content_block_start":
+			if event.ContentBlock.Type != "tool_use" {
+				continue
+			}
+			if structured && event.ContentBlock.Name == StructuredOutputName {
+				outputBlock = event.Index
+				continue
+			}
+			toolCalls = true
+			cr.ToolCalls = []ToolCall{{ID: event.ContentBlock.ID, Name: event.ContentBlock.Name}}
+			ch <- cr
 		case "content_block_delta":
-			if event.Delta.Type == "text_delta" {
-				ch <- &ChatResponse{
-					Content: event.Delta.Text,
-					Role:    RoleAssistant,
-					Delta:   true,
-				}
+			switch {
+			case event.Delta.Type == "text_delta":
+				cr.Content = event.Delta.Text
+				ch <- cr
+			case event.Delta.Type == "input_json_delta" && event.Index == outputBlock:
+				cr.Content = event.Delta.PartialJSON
+				ch <- cr
+			case event.Delta.Type == "input_json_delta":
+				cr.ToolCalls = []ToolCall{{Arguments: event.Delta.PartialJSON}}
+				ch <- cr
+			}
+		case "message_delta":
+			cr.StopReason = mapAnthropicStopReason(event.Delta.StopReason)
+			if outputBlock >= 0 && !toolCalls {
+				cr.StopReason = StopReasonEnd
 			}
+			cr.Usage.CompletionTokens = event.Usage.OutputTokens
+			ch <- cr
 		case "message_stop":
 			return
 		}
@@ -44,6 +44,7 @@ func NewAzureOpenAIWithConfig(cfg AzureConfig) *AzureOpenAI {
 	if cfg.APIVersion == "" {
 		cfg.APIVersion = "2024-10-21"
 	}
+	cfg.StreamUsage, cfg.JSONSchema = true, true
 	headers := map[string]string{
 		"api-key": cfg.APIKey,
 	}
@@ -63,7 +64,7 @@ func (a *AzureOpenAI) chatPath() string {
 }
 
 func (a *AzureOpenAI) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, a.deployment, false)
+	body := buildOpenAIRequestBody(req, a.config, false)
 	delete(body, "model") // Azure uses the deployment name in the URL
 
 	resp, err := a.http.post(ctx, a.chatPath(), body)
@@ -84,7 +85,7 @@ func (a *AzureOpenAI) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse
 }
 
 func (a *AzureOpenAI) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, a.deployment, true)
+	body := buildOpenAIRequestBody(req, a.config, true)
 	delete(body, "model")
 
 	resp, err := a.http.post(ctx, a.chatPath(), body)
@@ -47,7 +47,7 @@ func (c *OpenAICompatible) Name() string  { return c.providerName }
 func (c *OpenAICompatible) Model() string { return c.config.Model }
 
 func (c *OpenAICompatible) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, c.config.Model, false)
+	body := buildOpenAIRequestBody(req, c.config, false)
 
 	resp, err := c.http.post(ctx, "/chat/completions", body)
 	if err != nil {
@@ -67,7 +67,7 @@ func (c *OpenAICompatible) Chat(ctx context.Context, req *ChatRequest) (*ChatRes
 }
 
 func (c *OpenAICompatible) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, c.config.Model, true)
+	body := buildOpenAIRequestBody(req, c.config, true)
 
 	resp, err := c.http.post(ctx, "/chat/completions", body)
 	if err != nil {
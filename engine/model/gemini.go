@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -148,9 +149,6 @@ func (g *Gemini) buildRequestBody(req *ChatRequest) map[string]any {
 	body := map[string]any{
 		"contents": contents,
 	}
-	if systemInstruction != nil {
-		body["systemInstruction"] = systemInstruction
-	}
 
 	genConfig := map[string]any{}
 	if req.MaxTokens > 0 {
@@ -165,8 +163,28 @@ func (g *Gemini) buildRequestBody(req *ChatRequest) map[string]any {
 	if len(req.Stop) > 0 {
 		genConfig["stopSequences"] = req.Stop
 	}
-	if req.ResponseFormat == "json_object" {
-		genConfig["responseMimeType"] = "application/json"
+	// Gemini does not combine JSON mode with function calling. With tools,
+	// the schema is left to the caller to check, as Agent.OutputSchema does.
+	if len(req.Tools) == 0 {
+		if req.ResponseFormat == "json_object" || req.ResponseSchema != nil {
+			genConfig["responseMimeType"] = "application/json"
+		}
+		switch {
+		case req.ResponseSchema == nil:
+		case geminiExpressible(req.ResponseSchema):
+			genConfig["responseSchema"] = geminiSchema(req.ResponseSchema)
+		default:
+			// Gemini rejects objects without properties, such as maps, so
+			// the schema goes in the prompt instead.
+			if systemInstruction == nil {
+				systemInstruction = map[string]any{"parts": []map[string]string{}}
+			}
+			parts := systemInstruction["parts"].([]map[string]string)
+			systemInstruction["parts"] = append(parts, map[string]string{"text": schemaPrompt(req.ResponseSchema)})
+		}
+	}
+	if systemInstruction != nil {
+		body["systemInstruction"] = systemInstruction
 	}
 	if len(genConfig) > 0 {
 		body["generationConfig"] = genConfig
@@ -273,3 +291,84 @@ type geminiResponse struct {
 		CandidatesTokenCount int `json:"candidatesTokenCount"`
 	} `json:"usageMetadata"`
 }
+
+// geminiSchemaKeys are the JSON Schema keywords Gemini's responseSchema
+// accepts; it rejects the others.
+var geminiSchemaKeys = map[string]bool{
+	"type": true, "format": true, "description": true, "nullable": true, "enum": true,
+	"properties": true, "required": true, "items": true, "minItems": true, "maxItems": true,
+	"minimum": true, "maximum": true, "anyOf": true, "propertyOrdering": true,
+}
+
+// geminiExpressible reports whether geminiSchema can convert schema without
+// losing its meaning: Gemini has no additionalProperties, so an object
+// schema must list its properties.
+func geminiExpressible(schema map[string]any) bool {
+	props, _ := schema["properties"].(map[string]any)
+	if slices.Contains(schemaTypes(schema["type"]), "object") && len(props) == 0 {
+		return false
+	}
+	for _, p := range props {
+		if sub, ok := p.(map[string]any); ok && !geminiExpressible(sub) {
+			return false
+		}
+	}
+	if sub, ok := schema["items"].(map[string]any); ok && !geminiExpressible(sub) {
+		return false
+	}
+	subs, _ := schema["anyOf"].([]any)
+	for _, s := range subs {
+		if sub, ok := s.(map[string]any); ok && !geminiExpressible(sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// geminiSchema converts a JSON Schema to the OpenAPI subset of Gemini's
+// responseSchema: unsupported keywords are dropped, type names are upper
+// case, and a "null" type becomes nullable.
+func geminiSchema(schema map[string]any) map[string]any {
+	out := make(map[string]any, len(schema))
+	for k, v := range schema {
+		if !geminiSchemaKeys[k] {
+			continue
+		}
+		switch k {
+		case "type":
+			types := schemaTypes(v)
+			for _, t := range types {
+				if t == "null" {
+					out["nullable"] = true
+				} else if _, set := out["type"]; !set {
+					out["type"] = strings.ToUpper(t)
+				}
+			}
+		case "properties":
+			props, _ := v.(map[string]any)
+			converted := make(map[string]any, len(props))
+			for name, p := range props {
+				if sub, ok := p.(map[string]any); ok {
+					converted[name] = geminiSchema(sub)
+				}
+			}
+			out[k] = converted
+		case "items":
+			if sub, ok := v.(map[string]any); ok {
+				out[k] = geminiSchema(sub)
+			}
+		case "anyOf":
+			subs, _ := v.([]any)
+			converted := make([]any, 0, len(subs))
+			for _, s := range subs {
+				if sub, ok := s.(map[string]any); ok {
+					converted = append(converted, geminiSchema(sub))
+				}
+			}
+			out[k] = converted
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -31,6 +31,7 @@ func NewMistralWithConfig(cfg ProviderConfig) *Mistral {
 	if cfg.Model == "" {
 		cfg.Model = "mistral-large-latest"
 	}
+	cfg.JSONSchema = true
 	headers := map[string]string{
 		"Authorization": "Bearer " + cfg.APIKey,
 	}
@@ -44,7 +45,7 @@ func (m *Mistral) Name() string  { return "mistral" }
 func (m *Mistral) Model() string { return m.config.Model }
 
 func (m *Mistral) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, m.config.Model, false)
+	body := buildOpenAIRequestBody(req, m.config, false)
 
 	resp, err := m.http.post(ctx, "/chat/completions", body)
 	if err != nil {
@@ -64,7 +65,7 @@ func (m *Mistral) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, er
 }
 
 func (m *Mistral) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, m.config.Model, true)
+	body := buildOpenAIRequestBody(req, m.config, true)
 
 	resp, err := m.http.post(ctx, "/chat/completions", body)
 	if err != nil {
@@ -42,7 +42,7 @@ func (o *Ollama) Name() string  { return "ollama" }
 func (o *Ollama) Model() string { return o.config.Model }
 
 func (o *Ollama) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, o.config.Model, false)
+	body := buildOpenAIRequestBody(req, o.config, false)
 
 	resp, err := o.http.post(ctx, "/v1/chat/completions", body)
 	if err != nil {
@@ -62,7 +62,7 @@ func (o *Ollama) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, err
 }
 
 func (o *Ollama) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, o.config.Model, true)
+	body := buildOpenAIRequestBody(req, o.config, true)
 
 	resp, err := o.http.post(ctx, "/v1/chat/completions", body)
 	if err != nil {
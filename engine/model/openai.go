@@ -33,6 +33,7 @@ func NewOpenAIWithConfig(cfg ProviderConfig) *OpenAI {
 	if cfg.Model == "" {
 		cfg.Model = "gpt-4o"
 	}
+	cfg.StreamUsage, cfg.JSONSchema = true, true
 	headers := map[string]string{
 		"Authorization": "Bearer " + cfg.APIKey,
 	}
@@ -49,7 +50,7 @@ func (o *OpenAI) Name() string  { return "openai" }
 func (o *OpenAI) Model() string { return o.config.Model }
 
 func (o *OpenAI) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, o.config.Model, false)
+	body := buildOpenAIRequestBody(req, o.config, false)
 
 	resp, err := o.http.post(ctx, "/chat/completions", body)
 	if err != nil {
@@ -70,7 +71,7 @@ func (o *OpenAI) Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, err
 }
 
 func (o *OpenAI) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error) {
-	body := buildOpenAIRequestBody(req, o.config.Model, true)
+	body := buildOpenAIRequestBody(req, o.config, true)
 
 	resp, err := o.http.post(ctx, "/chat/completions", body)
 	if err != nil {
@@ -93,11 +94,12 @@ func (o *OpenAI) StreamChat(ctx context.Context, req *ChatRequest) (<-chan *Chat
 }
 
 // buildOpenAIRequestBody converts a ChatRequest into the OpenAI API JSON body.
-// Shared by OpenAI, AzureOpenAI, and OpenAICompatible providers.
-func buildOpenAIRequestBody(req *ChatRequest, defaultModel string, stream bool) map[string]any {
+// Shared by OpenAI, AzureOpenAI, and OpenAICompatible providers; cfg.Model is
+// the default model.
+func buildOpenAIRequestBody(req *ChatRequest, cfg ProviderConfig, stream bool) map[string]any {
 	modelID := req.Model
 	if modelID == "" {
-		modelID = defaultModel
+		modelID = cfg.Model
 	}
 
 	messages := make([]map[string]any, 0, len(req.Messages))
@@ -145,15 +147,45 @@ func buildOpenAIRequestBody(req *ChatRequest, defaultModel string, stream bool)
 	if len(req.Tools) > 0 {
 		body["tools"] = req.Tools
 	}
-	if req.ResponseFormat == "json_object" {
+	switch {
+	case req.ResponseSchema != nil && cfg.JSONSchema:
+		body["response_format"] = map[string]any{
+			"type": "json_schema",
+			"json_schema": map[string]any{
+				"name":   StructuredOutputName,
+				"schema": req.ResponseSchema,
+			},
+		}
+	case req.ResponseSchema != nil:
+		// Without json_schema the endpoint gets JSON mode and the schema in
+		// the system prompt; the caller checks the answer against it.
+		body["response_format"] = map[string]string{"type": "json_object"}
+		body["messages"] = withSystemPrompt(messages, schemaPrompt(req.ResponseSchema))
+	case req.ResponseFormat == "json_object":
 		body["response_format"] = map[string]string{"type": "json_object"}
 	}
 	if stream {
 		body["stream"] = true
+		if cfg.StreamUsage {
+			// Without it OpenAI reports no usage in streams.
+			body["stream_options"] = map[string]any{"include_usage": true}
+		}
 	}
 	return body
 }
 
+// withSystemPrompt adds text to the system message that starts messages, or
+// starts them with a new one.
+func withSystemPrompt(messages []map[string]any, text string) []map[string]any {
+	if len(messages) > 0 && messages[0]["role"] == RoleSystem {
+		if content, ok := messages[0]["content"].(string); ok {
+			messages[0]["content"] = content + "\n\n" + text
+			return messages
+		}
+	}
+	return append([]map[string]any{{"role": RoleSystem, "content": text}}, messages...)
+}
+
 // convertOpenAIResponse maps the raw API response to a ChatResponse.
 // Shared by OpenAI, AzureOpenAI, and OpenAICompatible.
 func convertOpenAIResponse(oai *openAIChatResponse) *ChatResponse {
@@ -214,15 +246,26 @@ func readOpenAISSEStream(resp *http.Response, ch chan<- *ChatResponse) {
 		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
 			continue
 		}
+		cr := &ChatResponse{
+			ID:    chunk.ID,
+			Role:  RoleAssistant,
+			Delta: true,
+			Usage: Usage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+			},
+		}
 		if len(chunk.Choices) == 0 {
+			// The usage of the whole response comes in a chunk of its own.
+			if cr.Usage != (Usage{}) {
+				ch <- cr
+			}
 			continue
 		}
 		delta := chunk.Choices[0].Delta
-		cr := &ChatResponse{
-			ID:      chunk.ID,
-			Content: delta.Content,
-			Role:    RoleAssistant,
-			Delta:   true,
+		cr.Content = delta.Content
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			cr.StopReason = mapOpenAIFinishReason(reason)
 		}
 		if len(delta.ToolCalls) > 0 {
 			for _, tc := range delta.ToolCalls {
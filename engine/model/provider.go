@@ -62,8 +62,19 @@ type ChatRequest struct {
 	Stop        []string         `json:"stop,omitempty"`
 	// ResponseFormat optionally forces JSON output. Set to "json_object" for JSON mode.
 	ResponseFormat string `json:"response_format,omitempty"`
+	// ResponseSchema optionally constrains the response to JSON matching a
+	// JSON Schema, through the provider's native structured output mode, or
+	// JSON mode and a prompt where it has none. It takes precedence over
+	// ResponseFormat. Providers do not all enforce every keyword, so check
+	// the response with ValidateSchema.
+	ResponseSchema map[string]any `json:"response_schema,omitempty"`
 }
 
+// StructuredOutputName names the schema of ChatRequest.ResponseSchema in
+// provider requests: the json_schema of OpenAI and the output tool of
+// Anthropic.
+const StructuredOutputName = "structured_output"
+
 // ChatResponse is the output of a chat completion.
 type ChatResponse struct {
 	ID         string     `json:"id"`
@@ -87,7 +98,9 @@ type Provider interface {
 	// Chat sends a request and returns a complete response.
 	Chat(ctx context.Context, req *ChatRequest) (*ChatResponse, error)
 	// StreamChat returns a channel of partial responses for streaming.
-	// The channel is closed when the response is complete.
+	// The channel is closed when the response is complete. Chunks follow the
+	// conventions of StreamAccumulator, which assembles them into the
+	// complete response.
 	StreamChat(ctx context.Context, req *ChatRequest) (<-chan *ChatResponse, error)
 	// Name returns a human-readable name for this provider.
 	Name() string
@@ -104,4 +117,14 @@ type ProviderConfig struct {
 	TimeoutSec    int    `json:"timeout_sec,omitempty"`
 	OrgID         string `json:"org_id,omitempty"`
 	ContextWindow int    `json:"context_window,omitempty"` // override default context window size for the model
+	// StreamUsage asks OpenAI-compatible endpoints to report token usage at
+	// the end of a stream (stream_options.include_usage). Endpoints that do
+	// not support the option may reject the request. The OpenAI and Azure
+	// providers always set it.
+	StreamUsage bool `json:"stream_usage,omitempty"`
+	// JSONSchema sends ChatRequest.ResponseSchema to OpenAI-compatible
+	// endpoints as a json_schema response format. Without it they get JSON
+	// mode, with the schema in the system prompt. The OpenAI, Azure and
+	// Mistral providers always set it.
+	JSONSchema bool `json:"json_schema,omitempty"`
 }
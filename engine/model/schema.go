@@ -0,0 +1,190 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SchemaError lists the ways a value does not match a JSON Schema.
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "does not match schema: " + strings.Join(e.Problems, "; ")
+}
+
+// schemaPrompt asks for an answer matching schema, for requests that cannot
+// carry the schema itself.
+func schemaPrompt(schema map[string]any) string {
+	data, _ := json.Marshal(schema)
+	return "Reply with only a JSON value matching this JSON Schema:\n" + string(data)
+}
+
+// ValidateSchema checks v, a value decoded from JSON, against a JSON Schema.
+// It supports the keywords type, properties, required,
+// additionalProperties, items and enum; others are ignored. The error is a
+// *SchemaError describing every mismatch, worded so that it can be shown to
+// a model to correct its output.
+func ValidateSchema(schema map[string]any, v any) error {
+	var problems []string
+	validate(schema, "$", v, &problems)
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+	return nil
+}
+
+func validate(schema map[string]any, path string, v any, problems *[]string) {
+	if schema == nil {
+		return
+	}
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if hasJSONType(v, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			*problems = append(*problems, fmt.Sprintf("%s: want %s, got %s", path, strings.Join(types, " or "), jsonTypeOf(v)))
+			return
+		}
+	}
+	if enum := enumValues(schema["enum"]); enum != nil && !inEnum(enum, v) {
+		*problems = append(*problems, fmt.Sprintf("%s: %s is not one of %s", path, encode(v), encode(enum)))
+	}
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, name := range stringList(schema["required"]) {
+			if _, ok := val[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if sub, ok := props[k].(map[string]any); ok {
+				validate(sub, path+"."+k, val[k], problems)
+				continue
+			}
+			if _, declared := props[k]; declared {
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*problems = append(*problems, fmt.Sprintf("%s: unexpected property %q", path, k))
+				}
+			case map[string]any:
+				validate(extra, path+"."+k, val[k], problems)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				validate(items, fmt.Sprintf("%s[%d]", path, i), item, problems)
+			}
+		}
+	}
+}
+
+// schemaTypes returns the type names of a type keyword, a name or a list.
+func schemaTypes(t any) []string {
+	switch t := t.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		return stringList(t)
+	case []string:
+		return t
+	}
+	return nil
+}
+
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func hasJSONType(v any, t string) bool {
+	switch t {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return jsonTypeOf(v) == t
+}
+
+// jsonTypeOf names the JSON type of a value decoded by encoding/json.
+func jsonTypeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// enumValues returns the values of an enum keyword, also when written in Go
+// as a []string.
+func enumValues(v any) []any {
+	switch v := v.(type) {
+	case []any:
+		return v
+	case []string:
+		out := make([]any, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out
+	}
+	return nil
+}
+
+func inEnum(enum []any, v any) bool {
+	data := encode(v)
+	for _, e := range enum {
+		if bytes.Equal([]byte(encode(e)), []byte(data)) {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
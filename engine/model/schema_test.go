@@ -0,0 +1,179 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var reportSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"city", "temp"},
+	"properties": map[string]any{
+		"city": map[string]any{"type": "string"},
+		"temp": map[string]any{"type": "integer"},
+		"sky":  map[string]any{"enum": []any{"clear", "cloudy"}},
+		"tags": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+	},
+	"additionalProperties": false,
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		json string
+		want []string
+	}{
+		{`{"city":"Paris","temp":21,"sky":"clear","tags":["warm"]}`, nil},
+		{`{"city":"Paris"}`, []string{`$: missing required property "temp"`}},
+		{`{"city":"Paris","temp":21.5,"sky":"rainy","tags":["warm",3],"wind":4}`, []string{
+			`$.sky: "rainy" is not one of ["clear","cloudy"]`,
+			`$.tags[1]: want string, got number`,
+			`$.temp: want integer, got number`,
+			`$: unexpected property "wind"`,
+		}},
+		{`["Paris"]`, []string{`$: want object, got array`}},
+	}
+	for _, tt := range tests {
+		var v any
+		if err := json.Unmarshal([]byte(tt.json), &v); err != nil {
+			t.Fatal(err)
+		}
+		err := ValidateSchema(reportSchema, v)
+		var se *SchemaError
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.json, err)
+			}
+			continue
+		}
+		if !errors.As(err, &se) || strings.Join(se.Problems, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %v, want %q", tt.json, err, tt.want)
+		}
+	}
+}
+
+func TestAnthropicStructuredOutput(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"m1","role":"assistant","stop_reason":"tool_use","content":[
+			{"type":"tool_use","id":"tu_1","name":"structured_output","input":{"city":"Paris","temp":21}}]}`))
+	}))
+	defer srv.Close()
+
+	p := NewAnthropicWithConfig(ProviderConfig{APIKey: "k", BaseURL: srv.URL})
+	resp, err := p.Chat(context.Background(), &ChatRequest{
+		Messages:       []Message{{Role: RoleUser, Content: "Weather in Paris?"}},
+		ResponseSchema: reportSchema,
+	})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	choice, _ := body["tool_choice"].(map[string]any)
+	if choice["type"] != "tool" || choice["name"] != StructuredOutputName {
+		t.Errorf("expected the output tool forced, got %v", body["tool_choice"])
+	}
+	if resp.Content != `{"city":"Paris","temp":21}` || resp.StopReason != StopReasonEnd || len(resp.ToolCalls) != 0 {
+		t.Errorf("expected the tool input as the answer, got %+v", resp)
+	}
+}
+
+func TestGeminiStructuredOutputWithTools(t *testing.T) {
+	g := NewGeminiWithConfig(ProviderConfig{APIKey: "k"})
+	req := &ChatRequest{
+		Messages:       []Message{{Role: RoleUser, Content: "Weather in Paris?"}},
+		ResponseSchema: reportSchema,
+	}
+	config, _ := g.buildRequestBody(req)["generationConfig"].(map[string]any)
+	if config["responseMimeType"] != "application/json" || config["responseSchema"] == nil {
+		t.Errorf("expected JSON mode with the schema, got %v", config)
+	}
+
+	req.Tools = []ToolDefinition{{Type: "function", Function: FunctionDef{Name: "weather",
+		Parameters: map[string]any{"type": "object"}}}}
+	body := g.buildRequestBody(req)
+	config, _ = body["generationConfig"].(map[string]any)
+	if _, ok := config["responseMimeType"]; ok {
+		t.Errorf("expected no JSON mode alongside tools, got %v", config)
+	}
+	if _, ok := config["responseSchema"]; ok {
+		t.Errorf("expected no response schema alongside tools, got %v", config)
+	}
+	if body["tools"] == nil {
+		t.Error("expected the tools to be sent")
+	}
+}
+
+func TestOpenAIStructuredOutputFallback(t *testing.T) {
+	req := &ChatRequest{
+		Messages: []Message{
+			{Role: RoleSystem, Content: "You report the weather."},
+			{Role: RoleUser, Content: "Weather in Paris?"},
+		},
+		ResponseSchema: reportSchema,
+	}
+	format := func(body map[string]any) string {
+		data, _ := json.Marshal(body["response_format"])
+		return string(data)
+	}
+
+	body := buildOpenAIRequestBody(req, NewOpenAIWithConfig(ProviderConfig{APIKey: "k"}).config, false)
+	if f := format(body); !strings.Contains(f, `"type":"json_schema"`) || !strings.Contains(f, StructuredOutputName) {
+		t.Errorf("expected a json_schema response format for OpenAI, got %s", f)
+	}
+	if msgs := body["messages"].([]map[string]any); len(msgs) != 2 || msgs[0]["content"] != "You report the weather." {
+		t.Errorf("expected the messages unchanged, got %v", msgs)
+	}
+
+	body = buildOpenAIRequestBody(req, NewOpenAICompatible("vllm", "http://localhost", "", "m").config, false)
+	if f := format(body); f != `{"type":"json_object"}` {
+		t.Errorf("expected JSON mode for a compatible endpoint, got %s", f)
+	}
+	msgs := body["messages"].([]map[string]any)
+	system, _ := msgs[0]["content"].(string)
+	if len(msgs) != 2 || !strings.HasPrefix(system, "You report the weather.") || !strings.Contains(system, `"required":["city","temp"]`) {
+		t.Errorf("expected the schema added to the system prompt, got %v", msgs)
+	}
+	if req.Messages[0].Content != "You report the weather." {
+		t.Errorf("expected the request left unchanged, got %q", req.Messages[0].Content)
+	}
+
+	req.Messages = req.Messages[1:]
+	msgs = buildOpenAIRequestBody(req, ProviderConfig{}, false)["messages"].([]map[string]any)
+	if len(msgs) != 2 || msgs[0]["role"] != RoleSystem || !strings.Contains(msgs[0]["content"].(string), "JSON Schema") {
+		t.Errorf("expected a system message with the schema, got %v", msgs)
+	}
+}
+
+func TestGeminiStructuredOutputWithMap(t *testing.T) {
+	g := NewGeminiWithConfig(ProviderConfig{APIKey: "k"})
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"city", "temps"},
+		"properties": map[string]any{
+			"city":  map[string]any{"type": "string"},
+			"temps": map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "integer"}},
+		},
+	}
+	body := g.buildRequestBody(&ChatRequest{
+		Messages: []Message{
+			{Role: RoleSystem, Content: "You report the weather."},
+			{Role: RoleUser, Content: "Temperatures in Paris?"},
+		},
+		ResponseSchema: schema,
+	})
+	config, _ := body["generationConfig"].(map[string]any)
+	if _, ok := config["responseSchema"]; ok || config["responseMimeType"] != "application/json" {
+		t.Errorf("expected JSON mode without a response schema, got %v", config)
+	}
+	system, _ := body["systemInstruction"].(map[string]any)
+	parts, _ := system["parts"].([]map[string]string)
+	if len(parts) != 2 || parts[0]["text"] != "You report the weather." || !strings.Contains(parts[1]["text"], `"additionalProperties":{"type":"integer"}`) {
+		t.Errorf("expected the schema in the system instruction, got %v", body["systemInstruction"])
+	}
+}
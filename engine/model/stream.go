@@ -0,0 +1,58 @@
+package model
+
+// StreamAccumulator assembles the chunks of a StreamChat response into the
+// complete response.
+//
+// The Content of each chunk is appended to the text. A tool call with an ID
+// starts a new call; one without continues the name and arguments of the
+// last call. The last stop reason wins, as does the last non-zero count of
+// each kind of token, since providers report usage either once at the end
+// or as running totals.
+type StreamAccumulator struct {
+	resp ChatResponse
+}
+
+// Add folds a chunk into the response.
+func (a *StreamAccumulator) Add(chunk *ChatResponse) {
+	if chunk == nil {
+		return
+	}
+	if chunk.ID != "" {
+		a.resp.ID = chunk.ID
+	}
+	a.resp.Content += chunk.Content
+	if chunk.StopReason != "" {
+		a.resp.StopReason = chunk.StopReason
+	}
+	if chunk.Usage.PromptTokens > 0 {
+		a.resp.Usage.PromptTokens = chunk.Usage.PromptTokens
+	}
+	if chunk.Usage.CompletionTokens > 0 {
+		a.resp.Usage.CompletionTokens = chunk.Usage.CompletionTokens
+	}
+	for _, tc := range chunk.ToolCalls {
+		n := len(a.resp.ToolCalls)
+		if tc.ID != "" || n == 0 {
+			a.resp.ToolCalls = append(a.resp.ToolCalls, tc)
+			continue
+		}
+		a.resp.ToolCalls[n-1].Name += tc.Name
+		a.resp.ToolCalls[n-1].Arguments += tc.Arguments
+	}
+}
+
+// Response returns the response assembled so far. A response that asks for
+// tools and ends normally stops with StopReasonToolCall, as not every
+// provider reports it when streaming.
+func (a *StreamAccumulator) Response() *ChatResponse {
+	resp := a.resp
+	resp.Role = RoleAssistant
+	resp.ToolCalls = append([]ToolCall(nil), a.resp.ToolCalls...)
+	if resp.StopReason == "" || resp.StopReason == StopReasonEnd {
+		resp.StopReason = StopReasonEnd
+		if len(resp.ToolCalls) > 0 {
+			resp.StopReason = StopReasonToolCall
+		}
+	}
+	return &resp
+}
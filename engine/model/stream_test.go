@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sseServer(t *testing.T, events ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func collect(t *testing.T, p Provider) *ChatResponse {
+	t.Helper()
+	ch, err := p.StreamChat(context.Background(), &ChatRequest{Messages: []Message{{Role: RoleUser, Content: "hi"}}})
+	if err != nil {
+		t.Fatalf("StreamChat: %v", err)
+	}
+	var acc StreamAccumulator
+	for chunk := range ch {
+		acc.Add(chunk)
+	}
+	return acc.Response()
+}
+
+func TestAnthropicStreamToolUse(t *testing.T) {
+	srv := sseServer(t,
+		`{"type":"message_start","message":{"usage":{"input_tokens":12}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"tu_1","name":"weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}`,
+		`{"type":"message_stop"}`,
+	)
+	resp := collect(t, NewAnthropicWithConfig(ProviderConfig{APIKey: "k", BaseURL: srv.URL}))
+
+	if resp.Content != "Let me check." {
+		t.Errorf("unexpected content %q", resp.Content)
+	}
+	if resp.StopReason != StopReasonToolCall {
+		t.Errorf("expected tool_call stop, got %q", resp.StopReason)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].ID != "tu_1" || resp.ToolCalls[0].Name != "weather" ||
+		resp.ToolCalls[0].Arguments != `{"city":"Paris"}` {
+		t.Errorf("unexpected tool calls %+v", resp.ToolCalls)
+	}
+	if resp.Usage != (Usage{PromptTokens: 12, CompletionTokens: 7}) {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestOpenAIStreamToolCalls(t *testing.T) {
+	chunk := func(delta, finish string) string {
+		return fmt.Sprintf(`{"id":"c1","choices":[{"index":0,"delta":%s,"finish_reason":%s}]}`, delta, finish)
+	}
+	srv := sseServer(t,
+		chunk(`{"role":"assistant","tool_calls":[{"index":0,"id":"call_a","function":{"name":"search","arguments":""}}]}`, "null"),
+		chunk(`{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":\"go\"}"}}]}`, "null"),
+		chunk(`{"tool_calls":[{"index":1,"id":"call_b","function":{"name":"search","arguments":"{\"q\":"}}]}`, "null"),
+		chunk(`{"tool_calls":[{"index":1,"function":{"arguments":"\"rust\"}"}}]}`, "null"),
+		chunk(`{}`, `"tool_calls"`),
+		`{"id":"c1","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":9}}`,
+		"[DONE]",
+	)
+	resp := collect(t, NewOpenAIWithConfig(ProviderConfig{APIKey: "k", BaseURL: srv.URL}))
+
+	var calls []string
+	for _, tc := range resp.ToolCalls {
+		calls = append(calls, tc.ID+" "+tc.Name+" "+tc.Arguments)
+	}
+	if got := strings.Join(calls, "; "); got != `call_a search {"q":"go"}; call_b search {"q":"rust"}` {
+		t.Errorf("unexpected tool calls %s", got)
+	}
+	if resp.StopReason != StopReasonToolCall || resp.Usage.CompletionTokens != 9 {
+		t.Errorf("unexpected stop %q or usage %+v", resp.StopReason, resp.Usage)
+	}
+}
+
+func TestOpenAIStreamRequestsUsage(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	collect(t, NewOpenAIWithConfig(ProviderConfig{APIKey: "k", BaseURL: srv.URL}))
+
+	if body["stream"] != true {
+		t.Errorf("expected a streaming request, got %v", body)
+	}
+	if opts, _ := body["stream_options"].(map[string]any); opts["include_usage"] != true {
+		t.Errorf("expected stream_options.include_usage, got %v", body["stream_options"])
+	}
+	if _, ok := buildOpenAIRequestBody(&ChatRequest{}, ProviderConfig{StreamUsage: true}, false)["stream_options"]; ok {
+		t.Error("expected no stream_options on a non-streaming request")
+	}
+
+	// Other OpenAI-compatible endpoints are only asked when configured to.
+	body = nil
+	collect(t, NewMistralWithConfig(ProviderConfig{APIKey: "k", BaseURL: srv.URL}))
+	if _, ok := body["stream_options"]; ok || body["stream"] != true {
+		t.Errorf("expected Mistral to stream without stream_options, got %v", body)
+	}
+	body = nil
+	collect(t, NewOpenAICompatibleWithConfig("vllm", ProviderConfig{BaseURL: srv.URL, StreamUsage: true}))
+	if opts, _ := body["stream_options"].(map[string]any); opts["include_usage"] != true {
+		t.Errorf("expected stream_options when StreamUsage is set, got %v", body["stream_options"])
+	}
+}
@@ -71,6 +71,18 @@ func (r *Registry) List() []*Definition {
 
 // Execute runs a tool by name, enforcing permissions and approval.
 func (r *Registry) Execute(ctx context.Context, name string, args map[string]any) (any, error) {
+	def, err := r.Authorize(ctx, name, args)
+	if err != nil {
+		return nil, err
+	}
+	return def.Handler(ctx, args)
+}
+
+// Authorize looks up a tool and enforces its permission, asking the approval
+// handler if the tool requires it, without running it. Callers that run
+// several tools at once authorize them one by one first, so that approval
+// prompts come in a predictable order.
+func (r *Registry) Authorize(ctx context.Context, name string, args map[string]any) (*Definition, error) {
 	r.mu.RLock()
 	def, ok := r.tools[name]
 	r.mu.RUnlock()
@@ -93,6 +105,5 @@ func (r *Registry) Execute(ctx context.Context, name string, args map[string]any
 			return nil, fmt.Errorf("tool %q: approval denied", name)
 		}
 	}
-
-	return def.Handler(ctx, args)
+	return def, nil
 }
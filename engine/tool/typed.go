@@ -0,0 +1,285 @@
+package tool
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spawn08/chronos/engine/model"
+)
+
+// FromFunc builds an allowed tool from a typed handler. The parameters
+// schema is derived from the struct In with SchemaOf, and the handler is
+// only called with arguments that match it, decoded into In. Arguments
+// that do not match are reported back to the model as a tool error naming
+// each problem, so that it can correct the call.
+func FromFunc[In, Out any](name, description string, fn func(context.Context, In) (Out, error)) *Definition {
+	schema := SchemaOf[In]()
+	return &Definition{
+		Name:        name,
+		Description: description,
+		Parameters:  schema,
+		Permission:  PermAllow,
+		Handler: func(ctx context.Context, args map[string]any) (any, error) {
+			in, err := decodeArgs[In](schema, args)
+			if err != nil {
+				return nil, err
+			}
+			return fn(ctx, in)
+		},
+	}
+}
+
+// decodeArgs validates args against schema and decodes them into an In.
+func decodeArgs[In any](schema map[string]any, args map[string]any) (In, error) {
+	var in In
+	if args == nil {
+		args = map[string]any{}
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return in, fmt.Errorf("invalid arguments: %w", err)
+	}
+	// Validate the JSON form, whatever Go types the caller used.
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return in, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if err := model.ValidateSchema(schema, v); err != nil {
+		return in, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return in, fmt.Errorf("invalid arguments: %w", err)
+	}
+	return in, nil
+}
+
+// SchemaOf returns the JSON Schema of T as encoding/json encodes it. Struct
+// fields are named by their json tag and are required unless tagged
+// omitempty or of pointer type; pointer fields may also be null. Two more
+// tags document a field for the model, its description and the values it
+// may take, parsed as the field's type:
+//
+//	City  string `json:"city" description:"City name, e.g. Paris"`
+//	Units string `json:"units,omitempty" enum:"celsius,fahrenheit"`
+//
+// The schema also suits Agent.OutputSchema, to have a model answer with a
+// struct.
+func SchemaOf[T any]() map[string]any {
+	return schemaOf(reflect.TypeOf((*T)(nil)).Elem(), map[reflect.Type]bool{})
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOf returns the schema of t. seen holds the structs being described,
+// so that recursive types end in an unconstrained object.
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string"} // base64, as encoding/json writes []byte
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]any{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		props := map[string]any{}
+		required := []any{}
+		addFields(t, props, &required, seen)
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]any{}
+}
+
+// field is a struct field encoding/json encodes.
+type field struct {
+	sf     reflect.StructField
+	name   string
+	opts   string
+	index  []int // path through embedded structs
+	tagged bool  // named by its json tag
+}
+
+// structFields returns the fields encoding/json encodes for struct t, in
+// field order. The fields of embedded structs are promoted, and a name
+// claimed by several fields goes to the least deeply embedded one, or, at
+// equal depth, to the only one with a json tag; otherwise to none.
+func structFields(t reflect.Type) []field {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []field
+	var next []embedded
+	count := map[reflect.Type]int{}
+	visited := map[reflect.Type]bool{}
+	for level := []embedded{{t: t}}; len(level) > 0; level, next = next, nil {
+		levelCount := count
+		count = map[reflect.Type]int{}
+		for _, e := range level {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && !sf.IsExported() && ft.Kind() != reflect.Struct || !sf.Anonymous && !sf.IsExported() {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int(nil), e.index...), i)
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					count[ft]++
+					if count[ft] == 1 {
+						next = append(next, embedded{t: ft, index: index})
+					}
+					continue
+				}
+				f := field{sf: sf, name: name, opts: opts, index: index, tagged: name != ""}
+				if f.name == "" {
+					f.name = sf.Name
+				}
+				fields = append(fields, f)
+				if levelCount[e.t] > 1 {
+					// The struct is embedded twice at this depth, so its
+					// fields annihilate each other.
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+
+	byName := map[string][]field{}
+	for _, f := range fields {
+		byName[f.name] = append(byName[f.name], f)
+	}
+	var out []field
+	for _, fs := range byName {
+		if f, ok := dominantField(fs); ok {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return slices.Compare(out[i].index, out[j].index) < 0
+	})
+	return out
+}
+
+// dominantField returns the field that claims a name shared by fs, if any.
+func dominantField(fs []field) (field, bool) {
+	depth := len(fs[0].index)
+	for _, f := range fs {
+		depth = min(depth, len(f.index))
+	}
+	var top []field
+	for _, f := range fs {
+		if len(f.index) == depth {
+			top = append(top, f)
+		}
+	}
+	if len(top) == 1 {
+		return top[0], true
+	}
+	var tagged []field
+	for _, f := range top {
+		if f.tagged {
+			tagged = append(tagged, f)
+		}
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return field{}, false
+}
+
+// addFields adds the fields of struct t, and those promoted from its
+// embedded structs, to props.
+func addFields(t reflect.Type, props map[string]any, required *[]any, seen map[reflect.Type]bool) {
+	for _, f := range structFields(t) {
+		s := schemaOf(f.sf.Type, seen)
+		if desc := f.sf.Tag.Get("description"); desc != "" {
+			s["description"] = desc
+		}
+		if enum := f.sf.Tag.Get("enum"); enum != "" {
+			s["enum"] = enumValues(s, strings.Split(enum, ","))
+		}
+		if f.sf.Type.Kind() == reflect.Pointer {
+			if t, ok := s["type"].(string); ok {
+				s["type"] = []any{t, "null"}
+			}
+		} else if !strings.Contains(","+f.opts+",", ",omitempty,") {
+			*required = append(*required, f.name)
+		}
+		props[f.name] = s
+	}
+}
+
+// enumValues converts the values of an enum tag to the type of schema s:
+// numbers for integer and number fields, and booleans for boolean ones.
+// Values that do not parse are kept as strings.
+func enumValues(s map[string]any, values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+		var err error
+		switch s["type"] {
+		case "integer":
+			if out[i], err = strconv.ParseInt(v, 10, 64); err != nil {
+				out[i], err = strconv.ParseUint(v, 10, 64)
+			}
+		case "number":
+			out[i], err = strconv.ParseFloat(v, 64)
+		case "boolean":
+			out[i], err = strconv.ParseBool(v)
+		}
+		if err != nil {
+			out[i] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spawn08/chronos/engine/model"
+)
+
+type forecastArgs struct {
+	City  string   `json:"city" description:"City name"`
+	Days  int      `json:"days"`
+	Units string   `json:"units,omitempty" enum:"celsius,fahrenheit"`
+	Tags  []string `json:"tags,omitempty"`
+	Near  *struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"near"`
+	internal string
+}
+
+func TestSchemaOf(t *testing.T) {
+	got, _ := json.Marshal(SchemaOf[forecastArgs]())
+	want := `{"properties":{` +
+		`"city":{"description":"City name","type":"string"},` +
+		`"days":{"type":"integer"},` +
+		`"near":{"properties":{"lat":{"type":"number"},"lon":{"type":"number"}},"required":["lat","lon"],"type":["object","null"]},` +
+		`"tags":{"items":{"type":"string"},"type":"array"},` +
+		`"units":{"enum":["celsius","fahrenheit"],"type":"string"}},` +
+		`"required":["city","days"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("unexpected schema:\n got %s\nwant %s", got, want)
+	}
+}
+
+type pageArgs struct {
+	Page  int    `json:"page"`
+	Query string `json:"query"`
+}
+
+type sortArgs struct {
+	Page  string `json:"page"`
+	Order string `json:"order"`
+}
+
+type auditArgs struct {
+	Actor string `json:"User"`
+	User  string
+}
+
+type searchArgs struct {
+	*pageArgs
+	sortArgs
+	auditArgs
+	Order  string  `json:"order" enum:"asc,desc"`
+	Limit  int     `json:"limit,omitempty" enum:"10,50,100"`
+	Ratio  float64 `json:"ratio,omitempty" enum:"0.5,1"`
+	Strict *bool   `json:"strict" enum:"true"`
+}
+
+func TestSchemaOfEmbeddedAndEnums(t *testing.T) {
+	schema := SchemaOf[searchArgs]()
+	got, _ := json.Marshal(schema)
+	// page is claimed by two fields at the same depth and dropped, order
+	// is shadowed by the outer field, and the tagged User dominates the
+	// untagged one.
+	want := `{"properties":{` +
+		`"User":{"type":"string"},` +
+		`"limit":{"enum":[10,50,100],"type":"integer"},` +
+		`"order":{"enum":["asc","desc"],"type":"string"},` +
+		`"query":{"type":"string"},` +
+		`"ratio":{"enum":[0.5,1],"type":"number"},` +
+		`"strict":{"enum":[true],"type":["boolean","null"]}},` +
+		`"required":["query","User","order"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("unexpected schema:\n got %s\nwant %s", got, want)
+	}
+
+	// The properties are the keys encoding/json writes.
+	strict := true
+	data, _ := json.Marshal(searchArgs{pageArgs: &pageArgs{}, Order: "asc", Limit: 50, Ratio: 0.5, Strict: &strict})
+	var v map[string]any
+	json.Unmarshal(data, &v)
+	props := schema["properties"].(map[string]any)
+	for k := range v {
+		if props[k] == nil {
+			t.Errorf("encoding/json writes %q, which the schema lacks", k)
+		}
+	}
+	if len(v) != len(props) {
+		t.Errorf("expected %d keys in %s", len(props), data)
+	}
+	if err := model.ValidateSchema(schema, v); err != nil {
+		t.Errorf("expected %s to match its schema: %v", data, err)
+	}
+}
+
+func TestFromFunc(t *testing.T) {
+	r := NewRegistry()
+	r.Register(FromFunc("forecast", "Weather forecast", func(_ context.Context, in forecastArgs) (string, error) {
+		return strings.Repeat(in.City+" sunny; ", in.Days), nil
+	}))
+
+	out, err := r.Execute(context.Background(), "forecast", map[string]any{"city": "Paris", "days": float64(2)})
+	if err != nil || out != "Paris sunny; Paris sunny; " {
+		t.Errorf("unexpected result %v, %v", out, err)
+	}
+
+	_, err = r.Execute(context.Background(), "forecast", map[string]any{"days": "two", "units": "kelvin"})
+	if err == nil {
+		t.Fatal("expected invalid arguments to fail")
+	}
+	for _, want := range []string{
+		`missing required property "city"`,
+		`$.days: want integer, got string`,
+		`$.units: "kelvin" is not one of ["celsius","fahrenheit"]`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
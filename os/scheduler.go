@@ -0,0 +1,165 @@
+package chronosos
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spawn08/chronos/engine/graph"
+	"github.com/spawn08/chronos/storage"
+)
+
+// Scheduler resumes graph runs suspended on timer nodes once they are due.
+// Waits are read back from checkpoints, so runs wake up on time even after
+// the process restarts. If the store is a storage.RunQueue, due runs are
+// enqueued for the worker pool instead, so that replicas sharing the store
+// resume each run once. A run whose resume fails while still waiting is
+// retried after a delay that doubles with each failure, up to
+// maxResumeBackoff.
+type Scheduler struct {
+	Store    storage.Storage
+	Interval time.Duration // how often to scan for due runs (default 5s)
+
+	lookup func(graphID string) *graph.CompiledGraph
+
+	mu      sync.Mutex
+	running map[string]bool           // sessions being resumed
+	failed  map[string]*resumeFailure // sessions whose last resume failed
+	wg      sync.WaitGroup
+}
+
+// maxResumeBackoff is the longest a scheduler waits before resuming a run
+// whose resume failed again.
+const maxResumeBackoff = time.Hour
+
+// resumeFailure records the failed resumes of one timer of a session.
+type resumeFailure struct {
+	runID    string
+	wakeAt   time.Time
+	failures int
+	retryAt  time.Time
+}
+
+// NewScheduler creates a scheduler that resumes runs of the graphs returned
+// by lookup. Runs of graphs lookup does not know are left waiting.
+func NewScheduler(store storage.Storage, lookup func(graphID string) *graph.CompiledGraph) *Scheduler {
+	return &Scheduler{
+		Store:    store,
+		Interval: 5 * time.Second,
+		lookup:   lookup,
+		running:  make(map[string]bool),
+		failed:   make(map[string]*resumeFailure),
+	}
+}
+
+// Run scans for due runs every Interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Tick(ctx); err != nil {
+			log.Printf("scheduler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick starts resuming every run that is due now and returns how many were
+// started. Each run is resumed in its own goroutine, or enqueued; a run
+// still being resumed from an earlier tick, or backing off after a failed
+// resume, is skipped.
+func (s *Scheduler) Tick(ctx context.Context) (int, error) {
+	now := time.Now()
+	due, err := graph.ListDueRuns(ctx, s.Store, now)
+	if err != nil {
+		return 0, err
+	}
+	s.forgetFailures(due)
+	_, queued := s.Store.(storage.RunQueue)
+	started := 0
+	for _, d := range due {
+		g := s.lookup(d.GraphID)
+		if g == nil {
+			continue
+		}
+		if queued {
+			if _, err := graph.EnqueueResume(ctx, s.Store, d.GraphID, d.SessionID, nil); err != nil {
+				return started, err
+			}
+			started++
+			continue
+		}
+		s.mu.Lock()
+		if f := s.failed[d.SessionID]; s.running[d.SessionID] || f != nil && now.Before(f.retryAt) {
+			s.mu.Unlock()
+			continue
+		}
+		s.running[d.SessionID] = true
+		s.mu.Unlock()
+
+		started++
+		s.wg.Add(1)
+		go func(d graph.DueRun) {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.running, d.SessionID)
+				s.mu.Unlock()
+			}()
+			_, err := graph.NewRunner(g, s.Store).Resume(ctx, d.SessionID)
+			s.recordResume(d, err)
+		}(d)
+	}
+	return started, nil
+}
+
+// recordResume records the outcome of resuming d, and when it failed,
+// when to try again.
+func (s *Scheduler) recordResume(d graph.DueRun, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failed, d.SessionID)
+		return
+	}
+	f := s.failed[d.SessionID]
+	if f == nil || f.runID != d.RunID || !f.wakeAt.Equal(d.WakeAt) {
+		f = &resumeFailure{runID: d.RunID, wakeAt: d.WakeAt}
+		s.failed[d.SessionID] = f
+	}
+	f.failures++
+	backoff := s.Interval
+	for i := 1; i < f.failures && backoff < maxResumeBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxResumeBackoff)
+	f.retryAt = time.Now().Add(backoff)
+	log.Printf("scheduler: resume session %s (run %s) failed %d times, retrying in %s: %v",
+		d.SessionID, d.RunID, f.failures, backoff, err)
+}
+
+// forgetFailures drops the failures recorded for timers that are no longer
+// due: their runs have moved on, or wait on another timer.
+func (s *Scheduler) forgetFailures(due []graph.DueRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sessionID, f := range s.failed {
+		if !slices.ContainsFunc(due, func(d graph.DueRun) bool {
+			return d.SessionID == sessionID && d.RunID == f.runID && d.WakeAt.Equal(f.wakeAt)
+		}) {
+			delete(s.failed, sessionID)
+		}
+	}
+}
+
+// Wait blocks until the runs started by earlier ticks have returned.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
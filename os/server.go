@@ -4,11 +4,17 @@ package chronosos
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/spawn08/chronos/engine/graph"
 	"github.com/spawn08/chronos/engine/stream"
 	"github.com/spawn08/chronos/os/approval"
 	"github.com/spawn08/chronos/os/auth"
@@ -18,13 +24,18 @@ import (
 
 // Server is the ChronosOS control plane.
 type Server struct {
-	Addr     string
-	Store    storage.Storage
-	Broker   *stream.Broker
-	Auth     *auth.Service
-	Trace    *trace.Collector
-	Approval *approval.Service
-	mux      *http.ServeMux
+	Addr      string
+	Store     storage.Storage
+	Broker    *stream.Broker
+	Auth      *auth.Service
+	Trace     *trace.Collector
+	Approval  *approval.Service
+	Scheduler *Scheduler
+	Worker    *graph.Worker // nil unless Store implements storage.RunQueue
+	mux       *http.ServeMux
+
+	mu     sync.RWMutex
+	graphs map[string]*graph.CompiledGraph
 }
 
 // New creates a new ChronosOS server.
@@ -37,6 +48,12 @@ func New(addr string, store storage.Storage) *Server {
 		Trace:    trace.NewCollector(store),
 		Approval: approval.NewService(),
 		mux:      http.NewServeMux(),
+		graphs:   make(map[string]*graph.CompiledGraph),
+	}
+	s.Scheduler = NewScheduler(store, s.graph)
+	if _, ok := store.(storage.RunQueue); ok {
+		host, _ := os.Hostname()
+		s.Worker, _ = graph.NewWorker(fmt.Sprintf("%s-%d", host, os.Getpid()), store)
 	}
 	s.routes()
 	return s
@@ -52,6 +69,161 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("/api/events/stream", s.Broker.SSEHandler("dashboard"))
 	s.mux.HandleFunc("/api/approval/pending", s.Approval.HandlePending)
 	s.mux.HandleFunc("/api/approval/respond", s.Approval.HandleRespond)
+	s.mux.HandleFunc("/api/graphs", s.handleListGraphs)
+	s.mux.HandleFunc("/api/graphs/render", s.handleRenderGraph)
+	s.mux.HandleFunc("/api/runs", s.handleRuns)
+	s.mux.HandleFunc("/api/runs/cancel", s.handleCancelRun)
+}
+
+// RegisterGraph makes a compiled graph available to the graph endpoints,
+// lets the scheduler resume its runs suspended on timers and lets the
+// worker execute its queued runs.
+func (s *Server) RegisterGraph(g *graph.CompiledGraph) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.graphs[g.ID] = g
+	if s.Worker != nil {
+		s.Worker.Register(g)
+	}
+}
+
+// graph returns the registered graph with the given ID, or nil.
+func (s *Server) graph(id string) *graph.CompiledGraph {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.graphs[id]
+}
+
+func (s *Server) handleListGraphs(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.graphs))
+	for id := range s.graphs {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"graphs": ids})
+}
+
+// handleRenderGraph renders a registered graph as Mermaid or DOT. With a
+// session_id (and optionally a run_id), the run's path is overlaid.
+func (s *Server) handleRenderGraph(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.mu.RLock()
+	g, ok := s.graphs[q.Get("graph_id")]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"error":"graph %q not found"}`, q.Get("graph_id")), http.StatusNotFound)
+		return
+	}
+	var path *graph.RunPath
+	if sessionID := q.Get("session_id"); sessionID != "" {
+		var err error
+		path, err = graph.LoadRunPath(r.Context(), s.Store, sessionID, q.Get("run_id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusNotFound)
+			return
+		}
+	}
+	out, err := g.Render(q.Get("format"), path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, out)
+}
+
+// handleRuns enqueues a run of a registered graph for the worker pool on
+// POST, and reports a queued run's status on GET ?id=.
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	queue, ok := s.Store.(storage.RunQueue)
+	if !ok {
+		http.Error(w, `{"error":"storage does not support run queues"}`, http.StatusNotImplemented)
+		return
+	}
+	if r.Method == http.MethodGet {
+		q, err := queue.GetQueuedRun(r.Context(), r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(q)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		GraphID   string         `json:"graph_id"`
+		SessionID string         `json:"session_id"`
+		Input     map[string]any `json:"input"`
+		Resume    bool           `json:"resume"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if s.graph(req.GraphID) == nil {
+		http.Error(w, fmt.Sprintf(`{"error":"graph %q not found"}`, req.GraphID), http.StatusNotFound)
+		return
+	}
+	if req.SessionID == "" {
+		sess := &storage.Session{
+			ID:        fmt.Sprintf("sess_%d", time.Now().UnixNano()),
+			AgentID:   req.GraphID,
+			Status:    "running",
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if err := s.Store.CreateSession(r.Context(), sess); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		req.SessionID = sess.ID
+	}
+	enqueue := graph.Enqueue
+	if req.Resume {
+		enqueue = graph.EnqueueResume
+	}
+	id, err := enqueue(r.Context(), s.Store, req.GraphID, req.SessionID, req.Input)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "session_id": req.SessionID})
+}
+
+// handleCancelRun cancels a graph run on POST {"run_id": ...}. A run that
+// another replica's worker executes is cancelled through the store.
+func (s *Server) handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		RunID string `json:"run_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RunID == "" {
+		http.Error(w, `{"error":"run_id required"}`, http.StatusBadRequest)
+		return
+	}
+	if err := graph.RequestCancel(r.Context(), s.Store, req.RunID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, graph.ErrNotRunning) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"run_id": req.RunID, "status": "cancelling"})
 }
 
 func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
@@ -93,8 +265,13 @@ func (s *Server) handleListTraces(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]any{"traces": traces})
 }
 
-// Start begins serving the control plane.
-func (s *Server) Start(_ context.Context) error {
+// Start begins serving the control plane and runs the timer scheduler
+// until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
 	log.Printf("ChronosOS starting on %s", s.Addr)
+	go s.Scheduler.Run(ctx)
+	if s.Worker != nil {
+		go s.Worker.Run(ctx)
+	}
 	return http.ListenAndServe(s.Addr, s.mux)
 }
@@ -41,9 +41,19 @@ type Agent struct {
 	Guardrails     *guardrails.Engine
 	SessionState   map[string]any // persistent cross-turn state
 	OutputSchema   map[string]any // JSON Schema for structured output
+	OutputRepairs  int            // re-prompts to correct an answer not matching OutputSchema; 0 means DefaultOutputRepairs, negative none
 	NumHistoryRuns int            // number of past runs to inject into context
 	ContextCfg     ContextConfig  // context window management and summarization
 
+	// Tool loop
+	MaxToolIterations int // rounds of tool calls per chat turn; 0 means DefaultMaxToolIterations
+	ToolTokenBudget   int // tokens the model calls of a chat turn may use; 0 means no limit
+	ToolConcurrency   int // tool calls of one response run at once; 0 means DefaultToolConcurrency
+
+	// Streaming
+	Stream              bool // reply with ChatStream where the caller supports it, as the CLI does
+	StreamCheckInterval int  // streamed characters between output guardrail checks; 0 checks only the answer
+
 	// System prompt and instructions
 	SystemPrompt string
 	Instructions []string
@@ -90,9 +100,15 @@ func (b *Builder) WithMemory(m *memory.Store) *Builder          { b.agent.Memory
 func (b *Builder) WithKnowledge(k knowledge.Knowledge) *Builder { b.agent.Knowledge = k; return b }
 func (b *Builder) WithMemoryManager(m *memory.Manager) *Builder { b.agent.MemoryManager = m; return b }
 func (b *Builder) WithOutputSchema(s map[string]any) *Builder   { b.agent.OutputSchema = s; return b }
+func (b *Builder) WithOutputRepairs(n int) *Builder             { b.agent.OutputRepairs = n; return b }
 func (b *Builder) WithHistoryRuns(n int) *Builder               { b.agent.NumHistoryRuns = n; return b }
 func (b *Builder) WithContextConfig(cfg ContextConfig) *Builder { b.agent.ContextCfg = cfg; return b }
 func (b *Builder) WithSystemPrompt(prompt string) *Builder      { b.agent.SystemPrompt = prompt; return b }
+func (b *Builder) WithMaxToolIterations(n int) *Builder         { b.agent.MaxToolIterations = n; return b }
+func (b *Builder) WithToolTokenBudget(n int) *Builder           { b.agent.ToolTokenBudget = n; return b }
+func (b *Builder) WithToolConcurrency(n int) *Builder           { b.agent.ToolConcurrency = n; return b }
+func (b *Builder) WithStream(on bool) *Builder                  { b.agent.Stream = on; return b }
+func (b *Builder) WithStreamCheckInterval(n int) *Builder       { b.agent.StreamCheckInterval = n; return b }
 
 func (b *Builder) AddInstruction(instruction string) *Builder {
 	b.agent.Instructions = append(b.agent.Instructions, instruction)
@@ -153,40 +169,25 @@ func (b *Builder) Build() (*Agent, error) {
 
 // Chat sends a single user message to the agent's model and returns the response.
 // This is a convenience method for agents that have a model but no graph.
+// When the model calls tools, Chat runs them and sends the results back,
+// with the tools offered again, until the model answers or the agent's
+// MaxToolIterations or ToolTokenBudget is used up.
 func (a *Agent) Chat(ctx context.Context, userMessage string) (*model.ChatResponse, error) {
-	if a.Model == nil {
-		return nil, fmt.Errorf("agent %q has no model", a.ID)
-	}
-
-	messages := make([]model.Message, 0, 8)
-	if a.SystemPrompt != "" {
-		messages = append(messages, model.Message{Role: model.RoleSystem, Content: a.SystemPrompt})
-	}
-	for _, inst := range a.Instructions {
-		messages = append(messages, model.Message{Role: model.RoleSystem, Content: inst})
-	}
-
-	// Inject long-term user memories into context
-	if a.MemoryManager != nil {
-		if memCtx, err := a.MemoryManager.GetUserMemories(ctx); err == nil && memCtx != "" {
-			messages = append(messages, model.Message{Role: model.RoleSystem, Content: memCtx})
-		}
+	req, err := a.chatRequest(ctx, userMessage)
+	if err != nil {
+		return nil, err
 	}
+	return a.chat(ctx, req, &toolLoop{})
+}
 
-	// Inject relevant knowledge via RAG
-	if a.Knowledge != nil {
-		if docs, err := a.Knowledge.Search(ctx, userMessage, 5); err == nil && len(docs) > 0 {
-			var kb strings.Builder
-			kb.WriteString("Relevant knowledge:\n")
-			for _, d := range docs {
-				kb.WriteString("- ")
-				kb.WriteString(d.Content)
-				kb.WriteString("\n")
-			}
-			messages = append(messages, model.Message{Role: model.RoleSystem, Content: kb.String()})
-		}
+// chatRequest builds the model request of a single message: the system
+// context, the message and the tools.
+func (a *Agent) chatRequest(ctx context.Context, userMessage string) (*model.ChatRequest, error) {
+	if a.Model == nil {
+		return nil, fmt.Errorf("agent %q has no model", a.ID)
 	}
 
+	messages := a.buildSystemContext(ctx, userMessage)
 	messages = append(messages, model.Message{Role: model.RoleUser, Content: userMessage})
 
 	// Check input guardrails
@@ -196,53 +197,28 @@ func (a *Agent) Chat(ctx context.Context, userMessage string) (*model.ChatRespon
 
 	req := &model.ChatRequest{
 		Messages: messages,
+		Tools:    a.toolDefinitions(),
 	}
 
 	// Apply output schema for structured output
 	if a.OutputSchema != nil {
 		req.ResponseFormat = "json_object"
+		req.ResponseSchema = a.OutputSchema
 	}
+	return req, nil
+}
 
-	// Add tool definitions if any are registered
-	tools := a.Tools.List()
-	if len(tools) > 0 {
-		for _, t := range tools {
-			req.Tools = append(req.Tools, model.ToolDefinition{
-				Type: "function",
-				Function: model.FunctionDef{
-					Name:        t.Name,
-					Description: t.Description,
-					Parameters:  t.Parameters,
-				},
-			})
-		}
-	}
-
-	// Fire model call hooks
-	modelEvt := &hooks.Event{Type: hooks.EventModelCallBefore, Name: a.Model.Name(), Input: req}
-	if err := a.Hooks.Before(ctx, modelEvt); err != nil {
-		return nil, fmt.Errorf("hook before model call: %w", err)
-	}
-
-	resp, err := a.Model.Chat(ctx, req)
-
-	modelEvt.Type = hooks.EventModelCallAfter
-	modelEvt.Output = resp
-	modelEvt.Error = err
-	_ = a.Hooks.After(ctx, modelEvt)
+// chat runs the model and tool loop of req, recording its steps in loop,
+// and checks the answer.
+func (a *Agent) chat(ctx context.Context, req *model.ChatRequest, loop *toolLoop) (*model.ChatResponse, error) {
+	messages := req.Messages
 
+	// Call the model, running the tools it asks for until it answers
+	resp, err := a.answer(ctx, req, loop)
 	if err != nil {
 		return nil, fmt.Errorf("agent %q chat: %w", a.ID, err)
 	}
 
-	// Handle tool calls if the model wants to use tools
-	if resp.StopReason == model.StopReasonToolCall && len(resp.ToolCalls) > 0 {
-		resp, err = a.handleToolCalls(ctx, messages, resp)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	// Check output guardrails
 	if resp != nil && resp.Content != "" {
 		if result := a.Guardrails.CheckOutput(ctx, resp.Content); result != nil {
@@ -258,48 +234,20 @@ func (a *Agent) Chat(ctx context.Context, userMessage string) (*model.ChatRespon
 	return resp, nil
 }
 
-// handleToolCalls executes tool calls and sends results back to the model.
-func (a *Agent) handleToolCalls(ctx context.Context, messages []model.Message, resp *model.ChatResponse) (*model.ChatResponse, error) {
-	messages = append(messages, model.Message{
-		Role:      model.RoleAssistant,
-		Content:   resp.Content,
-		ToolCalls: resp.ToolCalls,
-	})
-
-	for _, tc := range resp.ToolCalls {
-		var args map[string]any
-		_ = json.Unmarshal([]byte(tc.Arguments), &args)
-
-		// Fire tool call hooks
-		toolEvt := &hooks.Event{Type: hooks.EventToolCallBefore, Name: tc.Name, Input: args}
-		if err := a.Hooks.Before(ctx, toolEvt); err != nil {
-			return nil, fmt.Errorf("hook before tool %q: %w", tc.Name, err)
-		}
-
-		result, err := a.Tools.Execute(ctx, tc.Name, args)
-
-		toolEvt.Type = hooks.EventToolCallAfter
-		toolEvt.Output = result
-		toolEvt.Error = err
-		_ = a.Hooks.After(ctx, toolEvt)
-
-		var content string
-		if err != nil {
-			content = fmt.Sprintf("Error: %s", err.Error())
-		} else {
-			resultJSON, _ := json.Marshal(result)
-			content = string(resultJSON)
-		}
-
-		messages = append(messages, model.Message{
-			Role:       model.RoleTool,
-			Content:    content,
-			ToolCallID: tc.ID,
-			Name:       tc.Name,
+// toolDefinitions returns the registered tools in the model's format.
+func (a *Agent) toolDefinitions() []model.ToolDefinition {
+	var defs []model.ToolDefinition
+	for _, t := range a.Tools.List() {
+		defs = append(defs, model.ToolDefinition{
+			Type: "function",
+			Function: model.FunctionDef{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
 		})
 	}
-
-	return a.Model.Chat(ctx, &model.ChatRequest{Messages: messages})
+	return defs
 }
 
 // Execute runs the agent on a text task and returns the text response.
@@ -326,7 +274,12 @@ func (a *Agent) Run(ctx context.Context, input map[string]any) (*graph.RunState,
 		if msg == "" {
 			msg = stateToPrompt(input)
 		}
-		content, err := a.Execute(ctx, msg)
+		req, err := a.chatRequest(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		loop := &toolLoop{}
+		resp, err := a.chat(ctx, req, loop)
 		if err != nil {
 			return nil, err
 		}
@@ -334,10 +287,17 @@ func (a *Agent) Run(ctx context.Context, input map[string]any) (*graph.RunState,
 		for k, v := range input {
 			out[k] = v
 		}
-		out["response"] = content
+		out["response"] = resp.Content
+		if a.OutputSchema != nil {
+			var output any
+			_ = json.Unmarshal([]byte(resp.Content), &output)
+			out["output"] = output
+		}
 		return &graph.RunState{
-			Status: graph.RunStatusCompleted,
-			State:  graph.State(out),
+			Status:     graph.RunStatusCompleted,
+			State:      graph.State(out),
+			ToolCalls:  loop.calls,
+			TotalUsage: loop.usage,
 		}, nil
 	}
 
@@ -414,3 +374,13 @@ func (a *Agent) Resume(ctx context.Context, sessionID string) (*graph.RunState,
 	runner := graph.NewRunner(a.Graph, a.Storage)
 	return runner.Resume(ctx, sessionID)
 }
+
+// ResumeWith continues a run paused at an interrupt node, merging the human
+// response in input into the graph state before the node runs.
+func (a *Agent) ResumeWith(ctx context.Context, sessionID string, input map[string]any) (*graph.RunState, error) {
+	if a.Graph == nil || a.Storage == nil {
+		return nil, fmt.Errorf("agent %q: graph or storage not set", a.ID)
+	}
+	runner := graph.NewRunner(a.Graph, a.Storage)
+	return runner.ResumeWith(ctx, sessionID, input)
+}
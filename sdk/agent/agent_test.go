@@ -0,0 +1,422 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spawn08/chronos/engine/guardrails"
+	"github.com/spawn08/chronos/engine/hooks"
+	"github.com/spawn08/chronos/engine/model"
+	"github.com/spawn08/chronos/engine/tool"
+	"github.com/spawn08/chronos/storage/adapters/sqlite"
+)
+
+// scriptedProvider returns its responses in order and records the requests.
+type scriptedProvider struct {
+	responses []*model.ChatResponse
+	requests  []*model.ChatRequest
+}
+
+func (p *scriptedProvider) Chat(_ context.Context, req *model.ChatRequest) (*model.ChatResponse, error) {
+	snapshot := *req
+	snapshot.Messages = append([]model.Message(nil), req.Messages...)
+	p.requests = append(p.requests, &snapshot)
+	if len(p.requests) > len(p.responses) {
+		return nil, fmt.Errorf("unexpected call %d", len(p.requests))
+	}
+	return p.responses[len(p.requests)-1], nil
+}
+
+// StreamChat streams the next response word by word, with each tool call
+// split between a chunk that names it and one with its arguments.
+func (p *scriptedProvider) StreamChat(ctx context.Context, req *model.ChatRequest) (<-chan *model.ChatResponse, error) {
+	resp, err := p.Chat(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *model.ChatResponse, 64)
+	for _, word := range strings.SplitAfter(resp.Content, " ") {
+		ch <- &model.ChatResponse{Content: word, Delta: true}
+	}
+	for _, tc := range resp.ToolCalls {
+		ch <- &model.ChatResponse{ToolCalls: []model.ToolCall{{ID: tc.ID, Name: tc.Name}}, Delta: true}
+		ch <- &model.ChatResponse{ToolCalls: []model.ToolCall{{Arguments: tc.Arguments}}, Delta: true}
+	}
+	ch <- &model.ChatResponse{Usage: resp.Usage, Delta: true}
+	close(ch)
+	return ch, nil
+}
+
+func (p *scriptedProvider) Name() string  { return "scripted" }
+func (p *scriptedProvider) Model() string { return "scripted" }
+
+func toolCall(id, name, args string) *model.ChatResponse {
+	return &model.ChatResponse{
+		StopReason: model.StopReasonToolCall,
+		ToolCalls:  []model.ToolCall{{ID: id, Name: name, Arguments: args}},
+		Usage:      model.Usage{PromptTokens: 10, CompletionTokens: 5},
+	}
+}
+
+func newToolAgent(t *testing.T, p model.Provider) *Agent {
+	t.Helper()
+	a, err := New("calc", "Calc").WithModel(p).
+		AddTool(&tool.Definition{Name: "lookup", Permission: tool.PermAllow,
+			Handler: func(_ context.Context, args map[string]any) (any, error) {
+				return map[string]any{"city": args["q"], "temp": 21}, nil
+			}}).
+		AddTool(&tool.Definition{Name: "convert", Permission: tool.PermAllow,
+			Handler: func(_ context.Context, args map[string]any) (any, error) {
+				return 69.8, nil
+			}}).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	return a
+}
+
+func TestChatChainsToolCalls(t *testing.T) {
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		toolCall("1", "lookup", `{"q":"Paris"}`),
+		toolCall("2", "convert", `{"celsius":21}`),
+		{Content: "It is 69.8F in Paris.", StopReason: model.StopReasonEnd, Usage: model.Usage{PromptTokens: 30, CompletionTokens: 8}},
+	}}
+	a := newToolAgent(t, p)
+
+	rs, err := a.Run(context.Background(), map[string]any{"message": "Weather in Paris in F?"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.State["response"] != "It is 69.8F in Paris." {
+		t.Errorf("unexpected response %v", rs.State["response"])
+	}
+	if len(p.requests) != 3 {
+		t.Fatalf("expected 3 model calls, got %d", len(p.requests))
+	}
+	for i, req := range p.requests {
+		if len(req.Tools) != 2 {
+			t.Errorf("call %d: expected the tools offered again, got %d", i, len(req.Tools))
+		}
+	}
+	last := p.requests[2].Messages
+	if n := len(last); n < 4 || last[n-1].Role != model.RoleTool || last[n-1].ToolCallID != "2" {
+		t.Errorf("expected the second tool result fed back, got %+v", last)
+	}
+	if len(rs.ToolCalls) != 2 || rs.ToolCalls[0].Name != "lookup" || rs.ToolCalls[1].Name != "convert" || rs.ToolCalls[1].Result != 69.8 {
+		t.Errorf("expected both steps recorded, got %+v", rs.ToolCalls)
+	}
+	if rs.TotalUsage.TotalTokens != 68 {
+		t.Errorf("expected usage of all model calls, got %+v", rs.TotalUsage)
+	}
+}
+
+func TestChatToolLoopLimits(t *testing.T) {
+	loop := func() *scriptedProvider {
+		return &scriptedProvider{responses: []*model.ChatResponse{
+			toolCall("1", "lookup", `{}`), toolCall("2", "lookup", `{}`), toolCall("3", "lookup", `{}`),
+		}}
+	}
+
+	a := newToolAgent(t, loop())
+	a.MaxToolIterations = 2
+	if _, err := a.Chat(context.Background(), "loop"); !errors.Is(err, ErrToolLoopLimit) {
+		t.Errorf("expected ErrToolLoopLimit after 2 rounds, got %v", err)
+	}
+
+	p := loop()
+	a = newToolAgent(t, p)
+	a.ToolTokenBudget = 20
+	if _, err := a.Chat(context.Background(), "loop"); !errors.Is(err, ErrToolLoopLimit) {
+		t.Errorf("expected ErrToolLoopLimit over the token budget, got %v", err)
+	}
+	if len(p.requests) != 2 {
+		t.Errorf("expected the budget to stop the loop after 2 calls, got %d", len(p.requests))
+	}
+}
+
+// orderHook records the tool call events it sees.
+type orderHook struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *orderHook) Before(_ context.Context, evt *hooks.Event) error { return h.record(evt) }
+func (h *orderHook) After(_ context.Context, evt *hooks.Event) error  { return h.record(evt) }
+
+func (h *orderHook) record(evt *hooks.Event) error {
+	if evt.Type == hooks.EventToolCallBefore || evt.Type == hooks.EventToolCallAfter {
+		h.mu.Lock()
+		h.events = append(h.events, fmt.Sprintf("%s %v", evt.Type, evt.Input.(map[string]any)["q"]))
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func TestChatRunsToolCallsConcurrently(t *testing.T) {
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		{StopReason: model.StopReasonToolCall, ToolCalls: []model.ToolCall{
+			{ID: "a", Name: "fetch", Arguments: `{"q":"a"}`},
+			{ID: "b", Name: "fetch", Arguments: `{"q":"b"}`},
+			{ID: "c", Name: "fetch", Arguments: `{"q":"c"}`},
+		}},
+		{Content: "done", StopReason: model.StopReasonEnd},
+	}}
+	// Every handler waits until all three are running, and the later calls
+	// finish first.
+	var started sync.WaitGroup
+	started.Add(3)
+	var mu sync.Mutex
+	var approvals []string
+	h := &orderHook{}
+	a, err := New("fetcher", "Fetcher").WithModel(p).WithToolConcurrency(3).AddHook(h).
+		AddTool(&tool.Definition{Name: "fetch", Permission: tool.PermRequireApproval,
+			Handler: func(_ context.Context, args map[string]any) (any, error) {
+				started.Done()
+				started.Wait()
+				q := args["q"].(string)
+				time.Sleep(time.Duration('c'-q[0]) * 10 * time.Millisecond)
+				return "page " + q, nil
+			}}).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	a.Tools.SetApprovalHandler(func(_ context.Context, _ string, args map[string]any) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		approvals = append(approvals, args["q"].(string))
+		return true, nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Chat(context.Background(), "fetch three pages")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Chat: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tool calls did not run concurrently")
+	}
+
+	if fmt.Sprint(approvals) != "[a b c]" {
+		t.Errorf("expected approvals in call order, got %v", approvals)
+	}
+	want := "[tool_call.before a tool_call.before b tool_call.before c tool_call.after a tool_call.after b tool_call.after c]"
+	if got := fmt.Sprint(h.events); got != want {
+		t.Errorf("expected hooks in call order:\n got %s\nwant %s", got, want)
+	}
+	msgs := p.requests[1].Messages
+	results := msgs[len(msgs)-3:]
+	for i, id := range []string{"a", "b", "c"} {
+		if results[i].ToolCallID != id || results[i].Content != fmt.Sprintf("%q", "page "+id) {
+			t.Errorf("result %d: expected call %s, got %+v", i, id, results[i])
+		}
+	}
+}
+
+func TestChatStreamWithSession(t *testing.T) {
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		{Content: "Let me check.", StopReason: model.StopReasonToolCall,
+			ToolCalls: []model.ToolCall{{ID: "1", Name: "lookup", Arguments: `{"q":"Paris"}`}}},
+		{Content: "It is 21C in Paris.", StopReason: model.StopReasonEnd},
+	}}
+	a := newToolAgent(t, p)
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatalf("sqlite.New: %v", err)
+	}
+	defer store.Close()
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	a.Storage = store
+
+	events, err := a.ChatStreamWithSession(context.Background(), "s1", "Weather in Paris?")
+	if err != nil {
+		t.Fatalf("ChatStreamWithSession: %v", err)
+	}
+	var got []string
+	var final *model.ChatResponse
+	for evt := range events {
+		switch evt.Type {
+		case StreamDelta:
+			got = append(got, evt.Delta)
+		case StreamToolCallStart:
+			got = append(got, "start "+evt.ToolCall.Name+" "+evt.ToolCall.Arguments)
+		case StreamToolCallEnd:
+			got = append(got, fmt.Sprintf("end %s %v", evt.ToolCall.Name, evt.Result))
+		case StreamError:
+			t.Fatalf("stream error: %v", evt.Err)
+		case StreamDone:
+			final = evt.Response
+		}
+	}
+	want := `[Let  me  check. start lookup {"q":"Paris"} end lookup map[city:Paris temp:21] It  is  21C  in  Paris.]`
+	if fmt.Sprint(got) != want {
+		t.Errorf("unexpected events:\n got %v\nwant %s", got, want)
+	}
+	if final == nil || final.Content != "It is 21C in Paris." {
+		t.Fatalf("unexpected final response %+v", final)
+	}
+	if args := p.requests[1].Messages[len(p.requests[1].Messages)-2].ToolCalls; len(args) != 1 || args[0].Arguments != `{"q":"Paris"}` {
+		t.Errorf("expected the streamed tool call sent back whole, got %+v", args)
+	}
+
+	evts, err := store.ListEvents(context.Background(), "s1", 0)
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	cs := chatSessionFromEvents(evts)
+	if n := len(cs.Messages); n != 2 || cs.Messages[1].Content != "It is 21C in Paris." {
+		t.Errorf("expected the answer persisted to the session, got %+v", cs.Messages)
+	}
+}
+
+func TestChatStreamEnforcesTokenBudget(t *testing.T) {
+	// An OpenAI endpoint that keeps calling a tool and, like the real API,
+	// only reports the usage of a stream when asked to.
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", `{"id":"c1","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","function":{"name":"lookup","arguments":"{\"q\":\"Paris\"}"}}]},"finish_reason":null}]}`)
+		fmt.Fprintf(w, "data: %s\n\n", `{"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`)
+		if body.StreamOptions.IncludeUsage {
+			fmt.Fprintf(w, "data: %s\n\n", `{"id":"c1","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":5}}`)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	a := newToolAgent(t, model.NewOpenAIWithConfig(model.ProviderConfig{APIKey: "k", BaseURL: srv.URL}))
+	a.ToolTokenBudget = 40
+
+	events, err := a.ChatStream(context.Background(), "Weather in Paris?")
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+	var last StreamEvent
+	for evt := range events {
+		last = evt
+	}
+	if last.Type != StreamError || !errors.Is(last.Err, ErrToolLoopLimit) || !strings.Contains(last.Err.Error(), "tokens") {
+		t.Errorf("expected the token budget to stop the turn, got %s %v", last.Type, last.Err)
+	}
+	if calls != 2 {
+		t.Errorf("expected the budget to stop the loop after 2 calls, got %d", calls)
+	}
+}
+
+func TestChatStreamChecksOutputIncrementally(t *testing.T) {
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		{Content: "The password is hunter2 and more text follows", StopReason: model.StopReasonEnd},
+	}}
+	a, err := New("leaky", "Leaky").WithModel(p).WithStreamCheckInterval(1).
+		AddOutputGuardrail("secrets", &guardrails.BlocklistGuardrail{Blocklist: []string{"hunter2"}}).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	events, err := a.ChatStream(context.Background(), "What is the password?")
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+	var text string
+	var streamErr error
+	for evt := range events {
+		switch evt.Type {
+		case StreamDelta:
+			text += evt.Delta
+		case StreamError:
+			streamErr = evt.Err
+		case StreamDone:
+			t.Fatal("expected the guardrail to stop the stream")
+		}
+	}
+	if text != "The password is " {
+		t.Errorf("expected the stream cut off before the blocked term, got %q", text)
+	}
+	if streamErr == nil || !strings.Contains(streamErr.Error(), "output guardrail failed") {
+		t.Errorf("expected an output guardrail error, got %v", streamErr)
+	}
+}
+
+func TestChatRepairsStructuredOutput(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"city", "temp"},
+		"properties": map[string]any{
+			"city": map[string]any{"type": "string"},
+			"temp": map[string]any{"type": "integer"},
+		},
+	}
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		{Content: "```json\n{\"city\": \"Paris\"}\n```", StopReason: model.StopReasonEnd},
+		{Content: `Here it is: {"city": "Paris", "temp": 21}`, StopReason: model.StopReasonEnd},
+	}}
+	a, err := New("weather", "Weather").WithModel(p).WithOutputSchema(schema).Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	var report struct {
+		City string `json:"city"`
+		Temp int    `json:"temp"`
+	}
+	resp, err := a.ChatInto(context.Background(), "Weather in Paris?", &report)
+	if err != nil {
+		t.Fatalf("ChatInto: %v", err)
+	}
+	if report.City != "Paris" || report.Temp != 21 || resp.Content != `{"city": "Paris", "temp": 21}` {
+		t.Errorf("unexpected output %+v from %q", report, resp.Content)
+	}
+	if p.requests[0].ResponseSchema == nil {
+		t.Error("expected the schema sent to the model")
+	}
+	repair := p.requests[1].Messages[len(p.requests[1].Messages)-1]
+	if repair.Role != model.RoleUser || !strings.Contains(repair.Content, `missing required property "temp"`) {
+		t.Errorf("expected a repair prompt naming the problem, got %+v", repair)
+	}
+
+	p = &scriptedProvider{responses: []*model.ChatResponse{
+		{Content: "Paris, 21C", StopReason: model.StopReasonEnd},
+		{Content: "Paris, 21C", StopReason: model.StopReasonEnd},
+	}}
+	a, _ = New("weather", "Weather").WithModel(p).WithOutputSchema(schema).WithOutputRepairs(1).Build()
+	if _, err := a.Chat(context.Background(), "Weather in Paris?"); !errors.Is(err, ErrInvalidOutput) {
+		t.Errorf("expected ErrInvalidOutput after the repairs, got %v", err)
+	}
+}
+
+func TestChatReportsMalformedToolArguments(t *testing.T) {
+	p := &scriptedProvider{responses: []*model.ChatResponse{
+		toolCall("1", "lookup", `{"q": "Par`),
+		{Content: "Sorry.", StopReason: model.StopReasonEnd},
+	}}
+	a := newToolAgent(t, p)
+	if _, err := a.Chat(context.Background(), "Weather?"); err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	msgs := p.requests[1].Messages
+	if last := msgs[len(msgs)-1]; !strings.HasPrefix(last.Content, "Error: arguments are not a JSON object") {
+		t.Errorf("expected the malformed arguments reported to the model, got %q", last.Content)
+	}
+}
@@ -29,12 +29,21 @@ type AgentConfig struct {
 	Capabilities []string      `yaml:"capabilities,omitempty"`
 
 	OutputSchema   map[string]any `yaml:"output_schema,omitempty"`
+	OutputRepairs  int            `yaml:"output_repairs,omitempty"` // re-prompts for an answer not matching output_schema (default 2, -1 for none)
 	NumHistoryRuns int            `yaml:"num_history_runs,omitempty"`
 	Stream         bool           `yaml:"stream,omitempty"`
 	Context        ContextYAML    `yaml:"context,omitempty"`
 
+	MaxToolIterations   int `yaml:"max_tool_iterations,omitempty"`   // rounds of tool calls per turn (default 10)
+	ToolTokenBudget     int `yaml:"tool_token_budget,omitempty"`     // tokens a turn's model calls may use (0: no limit)
+	ToolConcurrency     int `yaml:"tool_concurrency,omitempty"`      // tool calls of one response run at once (default 4)
+	StreamCheckInterval int `yaml:"stream_check_interval,omitempty"` // streamed characters between output guardrail checks
+
 	// Team nesting: an agent config can reference sub-agents by ID
 	SubAgents []string `yaml:"sub_agents,omitempty"`
+
+	// Graph, if set, is compiled into the agent's StateGraph.
+	Graph *GraphConfig `yaml:"graph,omitempty"`
 }
 
 // ModelConfig describes which model provider and settings to use.
@@ -45,6 +54,10 @@ type ModelConfig struct {
 	BaseURL    string `yaml:"base_url,omitempty"`
 	OrgID      string `yaml:"org_id,omitempty"`
 	TimeoutSec int    `yaml:"timeout_sec,omitempty"`
+	// StreamUsage asks a compatible endpoint for token usage in streams,
+	// and JSONSchema sends it output schemas as json_schema.
+	StreamUsage bool `yaml:"stream_usage,omitempty"`
+	JSONSchema  bool `yaml:"json_schema,omitempty"`
 
 	// Azure-specific
 	Endpoint   string `yaml:"endpoint,omitempty"`
@@ -177,12 +190,15 @@ func BuildAgent(ctx context.Context, cfg *AgentConfig) (*Agent, error) {
 	for _, cap := range cfg.Capabilities {
 		b.AddCapability(cap)
 	}
-	if cfg.OutputSchema != nil {
-		b.WithOutputSchema(cfg.OutputSchema)
+	if len(cfg.OutputSchema) > 0 {
+		b.WithOutputSchema(cfg.OutputSchema).WithOutputRepairs(cfg.OutputRepairs)
 	}
 	if cfg.NumHistoryRuns > 0 {
 		b.WithHistoryRuns(cfg.NumHistoryRuns)
 	}
+	b.WithMaxToolIterations(cfg.MaxToolIterations).WithToolTokenBudget(cfg.ToolTokenBudget).
+		WithToolConcurrency(cfg.ToolConcurrency).
+		WithStream(cfg.Stream).WithStreamCheckInterval(cfg.StreamCheckInterval)
 	if cfg.Context.MaxTokens > 0 || cfg.Context.SummarizeThreshold > 0 || cfg.Context.PreserveRecentTurns > 0 {
 		b.WithContextConfig(ContextConfig{
 			MaxContextTokens:    cfg.Context.MaxTokens,
@@ -212,6 +228,14 @@ func BuildAgent(ctx context.Context, cfg *AgentConfig) (*Agent, error) {
 		b.WithStorage(store)
 	}
 
+	if cfg.Graph != nil {
+		g, err := buildGraph(b.agent, cfg.Graph)
+		if err != nil {
+			return nil, fmt.Errorf("agent %q graph: %w", cfg.ID, err)
+		}
+		b.WithGraph(g)
+	}
+
 	return b.Build()
 }
 
@@ -239,6 +263,17 @@ func BuildAll(ctx context.Context, fc *FileConfig) (map[string]*Agent, error) {
 			parent.SubAgents = append(parent.SubAgents, sub)
 		}
 	}
+	// Agent nodes call sub-agents, so they must be wired above
+	for _, cfg := range fc.Agents {
+		if cfg.Graph == nil {
+			continue
+		}
+		for _, n := range cfg.Graph.Nodes {
+			if strings.ToLower(n.Kind) == NodeKindAgent && agents[cfg.ID].findSubAgent(n.Agent) == nil {
+				return nil, fmt.Errorf("agent %q: graph node %q calls %q, which is not one of its sub_agents", cfg.ID, n.ID, n.Agent)
+			}
+		}
+	}
 	return agents, nil
 }
 
@@ -325,7 +360,10 @@ func buildProvider(cfg ModelConfig) (model.Provider, error) {
 		if cfg.Provider == "compatible" {
 			name = "compatible"
 		}
-		return model.NewOpenAICompatible(name, cfg.BaseURL, apiKey, modelID), nil
+		return model.NewOpenAICompatibleWithConfig(name, model.ProviderConfig{
+			APIKey: apiKey, Model: modelID, BaseURL: cfg.BaseURL,
+			TimeoutSec: cfg.TimeoutSec, StreamUsage: cfg.StreamUsage, JSONSchema: cfg.JSONSchema,
+		}), nil
 
 	default:
 		return nil, fmt.Errorf("unknown provider %q (supported: openai, anthropic, gemini, mistral, ollama, azure, groq, together, deepseek, openrouter, fireworks, perplexity, anyscale, compatible)", cfg.Provider)
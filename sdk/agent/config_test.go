@@ -4,7 +4,11 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/spawn08/chronos/engine/graph"
+	"github.com/spawn08/chronos/engine/tool"
 )
 
 func TestLoadFile(t *testing.T) {
@@ -255,3 +259,82 @@ func TestBuildAgentWithSubAgents(t *testing.T) {
 		t.Errorf("expected sub-agent 'worker', got %q", boss.SubAgents[0].ID)
 	}
 }
+
+func TestBuildAgentWithGraph(t *testing.T) {
+	RegisterNodeFunc("test.classify", func(_ context.Context, s graph.State) (graph.State, error) {
+		msg, _ := s["message"].(string)
+		return graph.State{"route": strings.Fields(msg)[0]}, nil
+	})
+	yaml := `
+agents:
+  - id: flow
+    name: Flow
+    model:
+      provider: ollama
+    storage:
+      dsn: ` + filepath.Join(t.TempDir(), "flow.db") + `
+    graph:
+      nodes:
+        - id: classify
+          func: test.classify
+        - id: lookup
+          kind: tool
+          tool: echo
+          input: {q: message}
+        - id: review
+          kind: interrupt
+          prompt: "Approve {{.result}}?"
+      edges:
+        - from: classify
+          to: lookup
+          when: {key: route, equals: lookup}
+        - from: classify
+          to: end
+        - from: lookup
+          to: review
+        - from: review
+          to: end
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("write test config: %v", err)
+	}
+	fc, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	a, err := BuildAgent(context.Background(), &fc.Agents[0])
+	if err != nil {
+		t.Fatalf("BuildAgent: %v", err)
+	}
+	if a.Graph == nil || a.Graph.Entry != "classify" {
+		t.Fatalf("expected graph with entry 'classify', got %+v", a.Graph)
+	}
+	a.Tools.Register(&tool.Definition{
+		Name: "echo",
+		Handler: func(_ context.Context, args map[string]any) (any, error) {
+			return args["q"], nil
+		},
+	})
+
+	rs, err := a.Run(context.Background(), map[string]any{"message": "lookup order 42"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != graph.RunStatusPaused || rs.Interrupt != "Approve lookup order 42?" {
+		t.Errorf("expected pause with prompt, got status %q, interrupt %v", rs.Status, rs.Interrupt)
+	}
+
+	rs, err = a.Run(context.Background(), map[string]any{"message": "hello"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if rs.Status != graph.RunStatusCompleted || rs.State["result"] != nil {
+		t.Errorf("expected default edge to end the run, got status %q, state %v", rs.Status, rs.State)
+	}
+
+	fc.Agents[0].Graph.Nodes[0].Func = "test.missing"
+	if _, err := BuildAgent(context.Background(), &fc.Agents[0]); err == nil || !strings.Contains(err.Error(), "test.missing") {
+		t.Errorf("expected unregistered node function error, got %v", err)
+	}
+}
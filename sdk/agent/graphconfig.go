@@ -0,0 +1,411 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/spawn08/chronos/engine/graph"
+	"github.com/spawn08/chronos/engine/model"
+)
+
+// GraphConfig is the YAML definition of an agent's StateGraph.
+type GraphConfig struct {
+	ID    string            `yaml:"id,omitempty"`    // defaults to the agent ID
+	Entry string            `yaml:"entry,omitempty"` // defaults to the first node
+	Nodes []GraphNodeConfig `yaml:"nodes"`
+	Edges []GraphEdgeConfig `yaml:"edges,omitempty"`
+
+	MaxSteps        int  `yaml:"max_steps,omitempty"`        // nodes a run may execute (0: no limit)
+	DetectFixpoints bool `yaml:"detect_fixpoints,omitempty"` // fail runs that loop with unchanged state
+
+	// Schema is a JSON Schema for the state; see graph.JSONSchema.
+	Schema map[string]any `yaml:"schema,omitempty"`
+
+	// Version is recorded by checkpoints; Migrations upgrade the paused runs
+	// of earlier versions. See graph.StateGraph.SetVersion.
+	Version    string                 `yaml:"version,omitempty"`
+	Migrations []GraphMigrationConfig `yaml:"migrations,omitempty"`
+}
+
+// GraphMigrationConfig describes a graph.Migration from version From to To.
+type GraphMigrationConfig struct {
+	From  string            `yaml:"from"`
+	To    string            `yaml:"to"`
+	Nodes map[string]string `yaml:"nodes,omitempty"` // old node ID -> new node ID
+	Keys  map[string]string `yaml:"keys,omitempty"`  // old state key -> new state key
+}
+
+// Node kinds available in a GraphConfig.
+const (
+	NodeKindFunc      = "func"      // a node function registered with RegisterNodeFunc
+	NodeKindModel     = "model"     // a call to the agent's model
+	NodeKindTool      = "tool"      // a call to a tool in the agent's registry
+	NodeKindAgent     = "agent"     // a call to a sub-agent
+	NodeKindInterrupt = "interrupt" // a pause for human input
+)
+
+// GraphNodeConfig describes one node of a GraphConfig. Prompt is a Go
+// text/template executed against the graph state, e.g. "Summarise {{.text}}".
+type GraphNodeConfig struct {
+	ID     string            `yaml:"id"`
+	Kind   string            `yaml:"kind,omitempty"`   // func (default), model, tool, agent, interrupt
+	Func   string            `yaml:"func,omitempty"`   // registered node function (func; optional for interrupt)
+	Prompt string            `yaml:"prompt,omitempty"` // model and agent input; interrupt prompt
+	Tool   string            `yaml:"tool,omitempty"`   // tool name (tool)
+	Args   map[string]any    `yaml:"args,omitempty"`   // literal tool arguments (tool)
+	Input  map[string]string `yaml:"input,omitempty"`  // tool argument -> state key (tool)
+	Agent  string            `yaml:"agent,omitempty"`  // sub-agent ID (agent)
+	Output string            `yaml:"output,omitempty"` // state key for the result (default "response", or "result" for tools)
+
+	MaxVisits int `yaml:"max_visits,omitempty"` // times a run may execute the node (0: no limit)
+}
+
+// GraphEdgeConfig describes an edge of a GraphConfig. "end" (or __end__)
+// finishes the run. The edges leaving a node are either all static or
+// evaluated in order: the first whose When matches is taken, and an edge
+// without When is the default.
+type GraphEdgeConfig struct {
+	From string           `yaml:"from"`
+	To   string           `yaml:"to"`
+	When *ConditionConfig `yaml:"when,omitempty"`
+}
+
+// ConditionConfig is a simple test on a state key. Values are compared in
+// their printed form, so 3 matches both 3 and "3".
+type ConditionConfig struct {
+	Key       string `yaml:"key"`
+	Equals    any    `yaml:"equals,omitempty"`
+	NotEquals any    `yaml:"not_equals,omitempty"`
+	Exists    *bool  `yaml:"exists,omitempty"`
+}
+
+var (
+	nodeFuncsMu sync.RWMutex
+	nodeFuncs   = make(map[string]graph.NodeFunc)
+)
+
+// RegisterNodeFunc makes fn available to YAML graphs under name. It is
+// typically called from an init function, before configs are built.
+func RegisterNodeFunc(name string, fn graph.NodeFunc) {
+	nodeFuncsMu.Lock()
+	defer nodeFuncsMu.Unlock()
+	nodeFuncs[name] = fn
+}
+
+func lookupNodeFunc(name string) (graph.NodeFunc, error) {
+	nodeFuncsMu.RLock()
+	defer nodeFuncsMu.RUnlock()
+	fn, ok := nodeFuncs[name]
+	if !ok {
+		names := make([]string, 0, len(nodeFuncs))
+		for n := range nodeFuncs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("node function %q is not registered (registered: %s)", name, strings.Join(names, ", "))
+	}
+	return fn, nil
+}
+
+// renameKeys returns a migration state function that moves the values of
+// the state keys in keys to their new names, or nil if keys is empty.
+func renameKeys(keys map[string]string) func(graph.State) (graph.State, error) {
+	if len(keys) == 0 {
+		return nil
+	}
+	return func(s graph.State) (graph.State, error) {
+		for old, to := range keys {
+			if v, ok := s[old]; ok {
+				delete(s, old)
+				s[to] = v
+			}
+		}
+		return s, nil
+	}
+}
+
+// buildGraph turns cfg into a StateGraph whose built-in nodes act on behalf
+// of a. Nodes look up a's model, tools and sub-agents when they run, so
+// sub-agents wired after the agent is built are found.
+func buildGraph(a *Agent, cfg *GraphConfig) (*graph.StateGraph, error) {
+	if len(cfg.Nodes) == 0 {
+		return nil, fmt.Errorf("graph has no nodes")
+	}
+	id := cfg.ID
+	if id == "" {
+		id = a.ID
+	}
+	g := graph.New(id).SetMaxSteps(cfg.MaxSteps)
+	if cfg.DetectFixpoints {
+		g.DetectFixpoints()
+	}
+	if cfg.Schema != nil {
+		data, err := json.Marshal(cfg.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("graph schema: %w", err)
+		}
+		schema, err := graph.JSONSchema(data)
+		if err != nil {
+			return nil, err
+		}
+		g.SetSchema(schema)
+	}
+	if cfg.Version != "" {
+		g.SetVersion(cfg.Version)
+	}
+	for _, m := range cfg.Migrations {
+		g.AddMigration(graph.Migration{From: m.From, To: m.To, Nodes: m.Nodes, State: renameKeys(m.Keys)})
+	}
+	for i := range cfg.Nodes {
+		if err := addConfigNode(g, a, &cfg.Nodes[i]); err != nil {
+			return nil, err
+		}
+		if n := cfg.Nodes[i].MaxVisits; n > 0 {
+			g.SetMaxVisits(cfg.Nodes[i].ID, n)
+		}
+	}
+
+	entry := cfg.Entry
+	if entry == "" {
+		entry = cfg.Nodes[0].ID
+	}
+	g.SetEntryPoint(entry)
+
+	var froms []string
+	edges := make(map[string][]GraphEdgeConfig)
+	for _, e := range cfg.Edges {
+		if _, ok := edges[e.From]; !ok {
+			froms = append(froms, e.From)
+		}
+		edges[e.From] = append(edges[e.From], e)
+	}
+	for _, from := range froms {
+		if err := addConfigEdges(g, from, edges[from]); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func addConfigNode(g *graph.StateGraph, a *Agent, n *GraphNodeConfig) error {
+	if n.ID == "" {
+		return fmt.Errorf("graph node without id")
+	}
+	prompt, err := template.New(n.ID).Option("missingkey=zero").Parse(n.Prompt)
+	if err != nil {
+		return fmt.Errorf("node %q prompt: %w", n.ID, err)
+	}
+
+	switch strings.ToLower(n.Kind) {
+	case "", NodeKindFunc:
+		fn, err := lookupNodeFunc(n.Func)
+		if err != nil {
+			return fmt.Errorf("node %q: %w", n.ID, err)
+		}
+		g.AddNode(n.ID, fn)
+
+	case NodeKindModel:
+		out := outputKey(n.Output, "response")
+		g.AddNode(n.ID, func(ctx context.Context, s graph.State) (graph.State, error) {
+			if a.Model == nil {
+				return nil, fmt.Errorf("agent %q has no model", a.ID)
+			}
+			text, err := renderPrompt(prompt, n.Prompt, s)
+			if err != nil {
+				return nil, err
+			}
+			messages := make([]model.Message, 0, len(a.Instructions)+2)
+			if a.SystemPrompt != "" {
+				messages = append(messages, model.Message{Role: model.RoleSystem, Content: a.SystemPrompt})
+			}
+			for _, inst := range a.Instructions {
+				messages = append(messages, model.Message{Role: model.RoleSystem, Content: inst})
+			}
+			messages = append(messages, model.Message{Role: model.RoleUser, Content: text})
+			resp, err := graph.RecordedProvider(a.Model).Chat(ctx, &model.ChatRequest{Messages: messages})
+			if err != nil {
+				return nil, err
+			}
+			return graph.State{out: resp.Content}, nil
+		})
+
+	case NodeKindTool:
+		if n.Tool == "" {
+			return fmt.Errorf("node %q: tool node without tool", n.ID)
+		}
+		out := outputKey(n.Output, "result")
+		g.AddNode(n.ID, func(ctx context.Context, s graph.State) (graph.State, error) {
+			args := make(map[string]any, len(n.Args)+len(n.Input))
+			for k, v := range n.Args {
+				args[k] = v
+			}
+			for arg, key := range n.Input {
+				args[arg] = s[key]
+			}
+			result, err := graph.ExecuteTool(ctx, a.Tools, n.Tool, args)
+			if err != nil {
+				return nil, err
+			}
+			return graph.State{out: result}, nil
+		})
+
+	case NodeKindAgent:
+		if n.Agent == "" {
+			return fmt.Errorf("node %q: agent node without agent", n.ID)
+		}
+		out := outputKey(n.Output, "response")
+		g.AddNode(n.ID, func(ctx context.Context, s graph.State) (graph.State, error) {
+			sub := a.findSubAgent(n.Agent)
+			if sub == nil {
+				return nil, fmt.Errorf("agent %q has no sub-agent %q", a.ID, n.Agent)
+			}
+			task, err := renderPrompt(prompt, n.Prompt, s)
+			if err != nil {
+				return nil, err
+			}
+			content, err := graph.Recorded(ctx, "agent", sub.ID, func(ctx context.Context) (string, error) {
+				return sub.Execute(ctx, task)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return graph.State{out: content}, nil
+		})
+
+	case NodeKindInterrupt:
+		var fn graph.NodeFunc = func(context.Context, graph.State) (graph.State, error) { return nil, nil }
+		if n.Func != "" {
+			if fn, err = lookupNodeFunc(n.Func); err != nil {
+				return fmt.Errorf("node %q: %w", n.ID, err)
+			}
+		}
+		if n.Prompt == "" {
+			g.AddInterruptNode(n.ID, fn)
+			break
+		}
+		g.AddInterruptNodeWithPrompt(n.ID, fn, func(s graph.State) any {
+			text, err := renderPrompt(prompt, n.Prompt, s)
+			if err != nil {
+				return err.Error()
+			}
+			return text
+		})
+
+	default:
+		return fmt.Errorf("node %q: unknown kind %q (supported: func, model, tool, agent, interrupt)", n.ID, n.Kind)
+	}
+	return nil
+}
+
+// addConfigEdges adds the edges leaving from. Conditional edges become one
+// conditional edge whose routes are their targets.
+func addConfigEdges(g *graph.StateGraph, from string, edges []GraphEdgeConfig) error {
+	from = configNodeID(from)
+	conditional := false
+	for _, e := range edges {
+		if e.When != nil {
+			conditional = true
+		}
+	}
+	if !conditional {
+		for _, e := range edges {
+			g.AddEdge(from, configNodeID(e.To))
+		}
+		return nil
+	}
+
+	fallback := graph.EndNode
+	var routes []string
+	seen := make(map[string]bool)
+	for i, e := range edges {
+		to := configNodeID(e.To)
+		if e.When == nil {
+			if i != len(edges)-1 {
+				return fmt.Errorf("edge %s -> %s: the default edge must come after the conditional edges from %q", from, e.To, from)
+			}
+			fallback = to
+		} else if e.When.Key == "" {
+			return fmt.Errorf("edge %s -> %s: condition without key", from, e.To)
+		}
+		if !seen[to] {
+			seen[to] = true
+			routes = append(routes, to)
+		}
+	}
+	if !seen[fallback] {
+		routes = append(routes, fallback)
+	}
+	g.AddConditionalEdge(from, func(s graph.State) string {
+		for _, e := range edges {
+			if e.When != nil && e.When.match(s) {
+				return configNodeID(e.To)
+			}
+		}
+		return fallback
+	}, routes...)
+	return nil
+}
+
+// match reports whether the condition holds for state s.
+func (c *ConditionConfig) match(s graph.State) bool {
+	v, ok := s[c.Key]
+	if c.Exists != nil && ok != *c.Exists {
+		return false
+	}
+	if c.Equals != nil && (!ok || fmt.Sprint(v) != fmt.Sprint(c.Equals)) {
+		return false
+	}
+	if c.NotEquals != nil && ok && fmt.Sprint(v) == fmt.Sprint(c.NotEquals) {
+		return false
+	}
+	return true
+}
+
+// configNodeID maps the YAML names of the graph's ends to their node IDs.
+func configNodeID(id string) string {
+	switch strings.ToLower(id) {
+	case "start":
+		return graph.StartNode
+	case "end":
+		return graph.EndNode
+	}
+	return id
+}
+
+func outputKey(key, def string) string {
+	if key == "" {
+		return def
+	}
+	return key
+}
+
+// renderPrompt executes a node's prompt template against the state. An
+// empty prompt falls back to the state's "message", or the whole state.
+func renderPrompt(t *template.Template, src string, s graph.State) (string, error) {
+	if src == "" {
+		if msg, ok := s["message"].(string); ok && msg != "" {
+			return msg, nil
+		}
+		return stateToPrompt(s), nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, map[string]any(s)); err != nil {
+		return "", fmt.Errorf("prompt: %w", err)
+	}
+	return b.String(), nil
+}
+
+// findSubAgent returns the sub-agent with the given ID, or nil.
+func (a *Agent) findSubAgent(id string) *Agent {
+	for _, sub := range a.SubAgents {
+		if sub.ID == id {
+			return sub
+		}
+	}
+	return nil
+}
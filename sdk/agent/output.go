@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spawn08/chronos/engine/model"
+)
+
+// DefaultOutputRepairs is the number of times the model is asked to correct
+// an answer that does not match the OutputSchema when Agent.OutputRepairs
+// is not set.
+const DefaultOutputRepairs = 2
+
+// ErrInvalidOutput is returned when the answer still does not match the
+// agent's OutputSchema after the repair re-prompts.
+var ErrInvalidOutput = errors.New("output does not match schema")
+
+func (a *Agent) outputRepairs() int {
+	switch {
+	case a.OutputRepairs < 0:
+		return 0
+	case a.OutputRepairs > 0:
+		return a.OutputRepairs
+	}
+	return DefaultOutputRepairs
+}
+
+// ChatInto sends a message like Chat and decodes the JSON answer into out,
+// a pointer to a map[string]any or to a struct. When the agent has an
+// OutputSchema the answer has been validated against it.
+func (a *Agent) ChatInto(ctx context.Context, userMessage string, out any) (*model.ChatResponse, error) {
+	resp, err := a.Chat(ctx, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(extractJSON(resp.Content)), out); err != nil {
+		return resp, fmt.Errorf("agent %q: decode output: %w", a.ID, err)
+	}
+	return resp, nil
+}
+
+// answer runs the tool loop of req and, when the agent has an OutputSchema,
+// checks the answer against it. An answer that does not match is sent back
+// with its problems until the model corrects it or the repairs run out. The
+// content of a matching answer is its bare JSON.
+func (a *Agent) answer(ctx context.Context, req *model.ChatRequest, loop *toolLoop) (*model.ChatResponse, error) {
+	resp, err := a.complete(ctx, req, loop)
+	if err != nil || a.OutputSchema == nil {
+		return resp, err
+	}
+	for repair := 0; ; repair++ {
+		text, invalid := a.checkOutput(resp.Content)
+		if invalid == nil {
+			resp.Content = text
+			return resp, nil
+		}
+		if repair >= a.outputRepairs() {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOutput, invalid)
+		}
+		req.Messages = append(req.Messages,
+			model.Message{Role: model.RoleAssistant, Content: resp.Content},
+			model.Message{Role: model.RoleUser, Content: fmt.Sprintf(
+				"Your answer is invalid: %v. Reply again with only the JSON of your answer, matching the required schema.", invalid)},
+		)
+		if resp, err = a.complete(ctx, req, loop); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkOutput extracts the JSON of an answer and validates it against the
+// agent's OutputSchema.
+func (a *Agent) checkOutput(content string) (string, error) {
+	text := extractJSON(content)
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return "", fmt.Errorf("not valid JSON: %w", err)
+	}
+	if err := model.ValidateSchema(a.OutputSchema, v); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// extractJSON returns the JSON in a model's answer, without the markdown
+// code fence or the surrounding prose models sometimes add.
+func extractJSON(content string) string {
+	text := strings.TrimSpace(content)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimPrefix(text, "json")
+		text = strings.TrimSpace(strings.TrimSuffix(text, "```"))
+	}
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start >= 0 && end > start && json.Valid([]byte(text[start:end+1])) {
+		return text[start : end+1]
+	}
+	return text
+}
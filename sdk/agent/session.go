@@ -115,6 +115,24 @@ func persistSummary(ctx context.Context, store storage.Storage, sessionID string
 // When the conversation approaches the model's context window limit, older
 // messages are automatically summarized to stay within budget.
 func (a *Agent) ChatWithSession(ctx context.Context, sessionID, userMessage string) (*model.ChatResponse, error) {
+	turn, err := a.startSessionTurn(ctx, sessionID, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	return a.finishSessionTurn(ctx, turn, &toolLoop{})
+}
+
+// sessionTurn is a session chat turn between loading the conversation and
+// calling the model.
+type sessionTurn struct {
+	cs     *ChatSession
+	seqNum int64 // of the last event in the ledger
+	req    *model.ChatRequest
+}
+
+// startSessionTurn loads the session, records the user message and builds
+// the model request, summarizing older messages if needed.
+func (a *Agent) startSessionTurn(ctx context.Context, sessionID, userMessage string) (*sessionTurn, error) {
 	if a.Model == nil {
 		return nil, fmt.Errorf("agent %q has no model", a.ID)
 	}
@@ -222,51 +240,28 @@ func (a *Agent) ChatWithSession(ctx context.Context, sessionID, userMessage stri
 		return nil, fmt.Errorf("input guardrail failed: %s", result.Reason)
 	}
 
-	req := &model.ChatRequest{Messages: messages}
+	req := &model.ChatRequest{Messages: messages, Tools: a.toolDefinitions()}
 	if a.OutputSchema != nil {
 		req.ResponseFormat = "json_object"
+		req.ResponseSchema = a.OutputSchema
 	}
+	return &sessionTurn{cs: cs, seqNum: seqNum, req: req}, nil
+}
 
-	// Add tool definitions
-	tools := a.Tools.List()
-	if len(tools) > 0 {
-		for _, t := range tools {
-			req.Tools = append(req.Tools, model.ToolDefinition{
-				Type: "function",
-				Function: model.FunctionDef{
-					Name:        t.Name,
-					Description: t.Description,
-					Parameters:  t.Parameters,
-				},
-			})
-		}
-	}
-
-	// Fire model call hooks
-	modelEvt := &hooks.Event{Type: hooks.EventModelCallBefore, Name: a.Model.Name(), Input: req}
-	if err := a.Hooks.Before(ctx, modelEvt); err != nil {
-		return nil, fmt.Errorf("hook before model call: %w", err)
-	}
-
-	resp, err := a.Model.Chat(ctx, req)
+// finishSessionTurn runs the model and tool loop of turn, recording its
+// steps in loop, and appends the answer to the session.
+func (a *Agent) finishSessionTurn(ctx context.Context, turn *sessionTurn, loop *toolLoop) (*model.ChatResponse, error) {
+	cs, seqNum, sessionID := turn.cs, turn.seqNum, turn.cs.ID
 
-	modelEvt.Type = hooks.EventModelCallAfter
-	modelEvt.Output = resp
-	modelEvt.Error = err
-	_ = a.Hooks.After(ctx, modelEvt)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
+	// Call the model, running the tools it asks for until it answers
+	resp, err := a.answer(ctx, turn.req, loop)
 	if err != nil {
 		return nil, fmt.Errorf("agent %q session chat: %w", a.ID, err)
 	}
 
-	// Handle tool calls
-	if resp.StopReason == model.StopReasonToolCall && len(resp.ToolCalls) > 0 {
-		resp, err = a.handleToolCalls(ctx, messages, resp)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	// Check output guardrails
 	if resp != nil && resp.Content != "" {
 		if result := a.Guardrails.CheckOutput(ctx, resp.Content); result != nil {
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spawn08/chronos/engine/model"
+)
+
+// StreamEventType identifies the kind of a StreamEvent.
+type StreamEventType string
+
+const (
+	StreamDelta         StreamEventType = "delta"           // text streamed by the model
+	StreamToolCallStart StreamEventType = "tool_call.start" // a tool call is about to run
+	StreamToolCallEnd   StreamEventType = "tool_call.end"   // a tool call returned
+	StreamDone          StreamEventType = "done"            // the final answer
+	StreamError         StreamEventType = "error"           // the turn failed
+)
+
+// StreamEvent is sent on the channel of ChatStream and ChatStreamWithSession.
+// Every stream ends with a single StreamDone or StreamError event.
+type StreamEvent struct {
+	Type     StreamEventType
+	Delta    string              // StreamDelta
+	ToolCall *model.ToolCall     // StreamToolCallStart, StreamToolCallEnd
+	Result   any                 // StreamToolCallEnd
+	Err      error               // StreamToolCallEnd if the tool failed, StreamError
+	Response *model.ChatResponse // StreamDone, with the whole answer and the usage of its last model call
+}
+
+// ChatStream is the streaming form of Chat. The model's output is sent as
+// StreamDelta events as it arrives, each tool call between a
+// StreamToolCallStart and a StreamToolCallEnd event, and the turn ends with
+// StreamDone or StreamError. Errors found before the model is called, such
+// as a failed input guardrail, are returned instead.
+//
+// Output guardrails check the final answer, and, when StreamCheckInterval
+// is set, the text streamed so far every StreamCheckInterval characters, so
+// that a blocked answer is cut off early. Text sent before a failed check
+// cannot be taken back.
+//
+// The channel is closed after the last event. The caller must read it to
+// the end or cancel ctx.
+func (a *Agent) ChatStream(ctx context.Context, userMessage string) (<-chan StreamEvent, error) {
+	req, err := a.chatRequest(ctx, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	return a.stream(ctx, func(loop *toolLoop) (*model.ChatResponse, error) {
+		return a.chat(ctx, req, loop)
+	}), nil
+}
+
+// ChatStreamWithSession is the streaming form of ChatWithSession. The final
+// answer is appended to the session ledger before StreamDone is sent.
+func (a *Agent) ChatStreamWithSession(ctx context.Context, sessionID, userMessage string) (<-chan StreamEvent, error) {
+	turn, err := a.startSessionTurn(ctx, sessionID, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	return a.stream(ctx, func(loop *toolLoop) (*model.ChatResponse, error) {
+		return a.finishSessionTurn(ctx, turn, loop)
+	}), nil
+}
+
+// stream runs turn in the background with a streaming tool loop.
+func (a *Agent) stream(ctx context.Context, turn func(*toolLoop) (*model.ChatResponse, error)) <-chan StreamEvent {
+	ch := make(chan StreamEvent, 64)
+	send := func(evt StreamEvent) {
+		select {
+		case ch <- evt:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		defer close(ch)
+		resp, err := turn(&toolLoop{emit: send})
+		if err != nil {
+			send(StreamEvent{Type: StreamError, Err: err})
+			return
+		}
+		send(StreamEvent{Type: StreamDone, Response: resp})
+	}()
+	return ch
+}
+
+// streamModel sends req to the model's StreamChat, emitting the text as it
+// arrives, and returns the assembled response.
+func (a *Agent) streamModel(ctx context.Context, req *model.ChatRequest, loop *toolLoop) (*model.ChatResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks, err := a.Model.StreamChat(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var acc model.StreamAccumulator
+	var text []byte
+	checked := 0
+	for chunk := range chunks {
+		acc.Add(chunk)
+		if chunk == nil || chunk.Content == "" {
+			continue
+		}
+		text = append(text, chunk.Content...)
+		if a.StreamCheckInterval > 0 && len(text)-checked >= a.StreamCheckInterval {
+			checked = len(text)
+			if result := a.Guardrails.CheckOutput(ctx, string(text)); result != nil {
+				// Let the provider see the cancellation and close the channel.
+				go func() {
+					for range chunks {
+					}
+				}()
+				return nil, fmt.Errorf("output guardrail failed: %s", result.Reason)
+			}
+		}
+		loop.emit(StreamEvent{Type: StreamDelta, Delta: chunk.Content})
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return acc.Response(), nil
+}
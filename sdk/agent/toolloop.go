@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spawn08/chronos/engine/graph"
+	"github.com/spawn08/chronos/engine/hooks"
+	"github.com/spawn08/chronos/engine/model"
+	"github.com/spawn08/chronos/engine/tool"
+)
+
+// DefaultMaxToolIterations is the number of tool call rounds a chat turn may
+// take when Agent.MaxToolIterations is not set.
+const DefaultMaxToolIterations = 10
+
+// DefaultToolConcurrency is the number of tool calls of one model response
+// that run at once when Agent.ToolConcurrency is not set.
+const DefaultToolConcurrency = 4
+
+// ErrToolLoopLimit is returned when the model still asks for tools after the
+// agent's iteration limit or token budget is used up.
+var ErrToolLoopLimit = errors.New("tool loop limit reached")
+
+// toolLoop records the steps of one chat turn.
+type toolLoop struct {
+	calls []graph.ToolCallRecord
+	usage graph.UsageStats
+	// emit, if set, streams the model output and tool calls of the turn.
+	emit func(StreamEvent)
+}
+
+func (l *toolLoop) addUsage(u model.Usage) {
+	l.usage.PromptTokens += u.PromptTokens
+	l.usage.CompletionTokens += u.CompletionTokens
+	l.usage.TotalTokens += u.PromptTokens + u.CompletionTokens
+}
+
+func (a *Agent) maxToolIterations() int {
+	if a.MaxToolIterations > 0 {
+		return a.MaxToolIterations
+	}
+	return DefaultMaxToolIterations
+}
+
+func (a *Agent) toolConcurrency() int {
+	if a.ToolConcurrency > 0 {
+		return a.ToolConcurrency
+	}
+	return DefaultToolConcurrency
+}
+
+// complete sends req to the model and runs the tool calls it asks for,
+// feeding the results back with the tools offered again, until the model
+// answers without calling tools. req.Messages grows with every round.
+func (a *Agent) complete(ctx context.Context, req *model.ChatRequest, loop *toolLoop) (*model.ChatResponse, error) {
+	resp, err := a.callModel(ctx, req, loop)
+	if err != nil {
+		return nil, err
+	}
+	loop.addUsage(resp.Usage)
+	for round := 1; resp.StopReason == model.StopReasonToolCall && len(resp.ToolCalls) > 0; round++ {
+		if round > a.maxToolIterations() {
+			return resp, fmt.Errorf("%w: still calling tools after %d rounds", ErrToolLoopLimit, a.maxToolIterations())
+		}
+		if a.ToolTokenBudget > 0 && loop.usage.TotalTokens >= a.ToolTokenBudget {
+			return resp, fmt.Errorf("%w: used %d of %d tokens", ErrToolLoopLimit, loop.usage.TotalTokens, a.ToolTokenBudget)
+		}
+		req.Messages = append(req.Messages, model.Message{
+			Role:      model.RoleAssistant,
+			Content:   resp.Content,
+			ToolCalls: resp.ToolCalls,
+		})
+		results, err := a.handleToolCalls(ctx, resp.ToolCalls, loop)
+		if err != nil {
+			return nil, err
+		}
+		req.Messages = append(req.Messages, results...)
+		if resp, err = a.callModel(ctx, req, loop); err != nil {
+			return nil, err
+		}
+		loop.addUsage(resp.Usage)
+	}
+	return resp, nil
+}
+
+// callModel sends req to the model, firing the model call hooks. When loop
+// streams, the model's output is streamed as it arrives.
+func (a *Agent) callModel(ctx context.Context, req *model.ChatRequest, loop *toolLoop) (*model.ChatResponse, error) {
+	modelEvt := &hooks.Event{Type: hooks.EventModelCallBefore, Name: a.Model.Name(), Input: req}
+	if err := a.Hooks.Before(ctx, modelEvt); err != nil {
+		return nil, fmt.Errorf("hook before model call: %w", err)
+	}
+
+	var resp *model.ChatResponse
+	var err error
+	if loop.emit != nil {
+		resp, err = a.streamModel(ctx, req, loop)
+	} else {
+		resp, err = a.Model.Chat(ctx, req)
+	}
+
+	modelEvt.Type = hooks.EventModelCallAfter
+	modelEvt.Output = resp
+	modelEvt.Error = err
+	_ = a.Hooks.After(ctx, modelEvt)
+	return resp, err
+}
+
+// toolRun is one tool call of a round, from its hook to its result.
+type toolRun struct {
+	call   model.ToolCall
+	args   map[string]any
+	def    *tool.Definition
+	evt    *hooks.Event
+	result any
+	err    error
+}
+
+// handleToolCalls executes one round of tool calls, records them in loop
+// and returns the tool result messages for the model, in call order.
+//
+// The before hooks and approval prompts run one call at a time in call
+// order; the approved handlers then run concurrently, up to the agent's
+// tool concurrency; the after hooks run in call order once all are done.
+func (a *Agent) handleToolCalls(ctx context.Context, calls []model.ToolCall, loop *toolLoop) ([]model.Message, error) {
+	runs := make([]*toolRun, len(calls))
+	for i, tc := range calls {
+		run := &toolRun{call: tc}
+		var argsErr error
+		if strings.TrimSpace(tc.Arguments) != "" {
+			if err := json.Unmarshal([]byte(tc.Arguments), &run.args); err != nil {
+				argsErr = fmt.Errorf("arguments are not a JSON object: %w", err)
+			}
+		}
+
+		// Fire tool call hooks
+		run.evt = &hooks.Event{Type: hooks.EventToolCallBefore, Name: tc.Name, Input: run.args}
+		if err := a.Hooks.Before(ctx, run.evt); err != nil {
+			return nil, fmt.Errorf("hook before tool %q: %w", tc.Name, err)
+		}
+		if run.err = argsErr; run.err == nil {
+			run.def, run.err = a.Tools.Authorize(ctx, tc.Name, run.args)
+		}
+		runs[i] = run
+		if loop.emit != nil {
+			loop.emit(StreamEvent{Type: StreamToolCallStart, ToolCall: &run.call})
+		}
+	}
+
+	sem := make(chan struct{}, a.toolConcurrency())
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		if run.err != nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(run *toolRun) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			run.result, run.err = run.def.Handler(ctx, run.args)
+		}(run)
+	}
+	wg.Wait()
+
+	messages := make([]model.Message, 0, len(runs))
+	for _, run := range runs {
+		run.evt.Type = hooks.EventToolCallAfter
+		run.evt.Output = run.result
+		run.evt.Error = run.err
+		_ = a.Hooks.After(ctx, run.evt)
+		if loop.emit != nil {
+			loop.emit(StreamEvent{Type: StreamToolCallEnd, ToolCall: &run.call, Result: run.result, Err: run.err})
+		}
+
+		record := graph.ToolCallRecord{Name: run.call.Name, Args: run.args, Result: run.result}
+		var content string
+		if run.err != nil {
+			record.Error = run.err.Error()
+			content = fmt.Sprintf("Error: %s", run.err.Error())
+		} else {
+			resultJSON, _ := json.Marshal(run.result)
+			content = string(resultJSON)
+		}
+		loop.calls = append(loop.calls, record)
+
+		messages = append(messages, model.Message{
+			Role:       model.RoleTool,
+			Content:    content,
+			ToolCallID: run.call.ID,
+			Name:       run.call.Name,
+		})
+	}
+	return messages, nil
+}
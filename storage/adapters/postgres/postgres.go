@@ -5,7 +5,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spawn08/chronos/storage"
@@ -13,6 +15,11 @@ import (
 
 // Store implements storage.Storage using PostgreSQL.
 type Store struct {
+	// SnapshotInterval is the number of checkpoints of a run stored per
+	// full state snapshot; the others store a diff against the snapshot.
+	// 0 means storage.DefaultSnapshotInterval, 1 stores every state in full.
+	SnapshotInterval int
+
 	db *sql.DB
 }
 
@@ -84,10 +91,34 @@ func (s *Store) Migrate(ctx context.Context) error {
 			node_id TEXT NOT NULL,
 			state JSONB,
 			seq_num BIGINT NOT NULL,
+			metadata JSONB,
 			created_at TIMESTAMPTZ NOT NULL
 		)`,
+		`ALTER TABLE checkpoints ADD COLUMN IF NOT EXISTS metadata JSONB`,
+		`ALTER TABLE checkpoints ADD COLUMN IF NOT EXISTS base_id TEXT`,
+		`CREATE TABLE IF NOT EXISTS run_queue (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			session_id TEXT NOT NULL,
+			graph_id TEXT NOT NULL,
+			checkpoint_id TEXT,
+			input JSONB,
+			status TEXT NOT NULL,
+			worker TEXT,
+			lease_until TIMESTAMPTZ,
+			attempts INT NOT NULL DEFAULT 0,
+			error TEXT,
+			created_at TIMESTAMPTZ NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS run_cancels (
+			run_id TEXT PRIMARY KEY,
+			requested_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_run_queue_status ON run_queue(status, created_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_events_session_seq ON events(session_id, seq_num)`,
 		`CREATE INDEX IF NOT EXISTS idx_checkpoints_session ON checkpoints(session_id, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_checkpoints_base ON checkpoints(base_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_memory_agent_key ON memory(agent_id, key)`,
 	}
 	for _, stmt := range stmts {
@@ -318,58 +349,448 @@ func (s *Store) ListEvents(ctx context.Context, sessionID string, afterSeq int64
 
 // --- Checkpoints ---
 
+// A checkpoint's state is stored in full (a snapshot) or, when base_id is
+// set, as a storage.StateDiff against the snapshot base_id of the same run.
+
+const checkpointColumns = `id, session_id, run_id, node_id, state, seq_num, metadata, created_at, base_id`
+
+// snapshot is the latest full state of a run and the number of diffs
+// stored against it.
+type snapshot struct {
+	id    string
+	state map[string]any
+	diffs int
+}
+
+func (s *Store) snapshotInterval() int {
+	if s.SnapshotInterval > 0 {
+		return s.SnapshotInterval
+	}
+	return storage.DefaultSnapshotInterval
+}
+
 func (s *Store) SaveCheckpoint(ctx context.Context, cp *storage.Checkpoint) error {
-	state, _ := json.Marshal(cp.State)
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO checkpoints (id, session_id, run_id, node_id, state, seq_num, created_at) VALUES ($1,$2,$3,$4,$5,$6,$7)`,
-		cp.ID, cp.SessionID, cp.RunID, cp.NodeID, state, cp.SeqNum, cp.CreatedAt,
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var base *snapshot
+	if s.snapshotInterval() > 1 {
+		var id string
+		var state []byte
+		var diffs int
+		// The share lock keeps DeleteCheckpoints from deleting the snapshot
+		// before the diff against it is committed.
+		err := tx.QueryRowContext(ctx,
+			`SELECT c.id, c.state, (SELECT COUNT(*) FROM checkpoints d WHERE d.base_id = c.id)
+			FROM checkpoints c WHERE c.session_id=$1 AND c.run_id=$2 AND c.base_id IS NULL
+			ORDER BY c.seq_num DESC LIMIT 1 FOR SHARE OF c`,
+			cp.SessionID, cp.RunID,
+		).Scan(&id, &state, &diffs)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		default:
+			base = &snapshot{id: id, diffs: diffs}
+			if base.state, err = storage.DecodeCheckpointState(state, false, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := s.insertCheckpoint(ctx, tx, cp, base); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertCheckpoint stores cp encoded with encodeCheckpoint. It reports
+// whether a diff was stored.
+func (s *Store) insertCheckpoint(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, cp *storage.Checkpoint, base *snapshot) (bool, error) {
+	state, baseID, err := s.encodeCheckpoint(cp, base)
+	if err != nil {
+		return false, err
+	}
+	meta, _ := json.Marshal(cp.Metadata)
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO checkpoints (`+checkpointColumns+`) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`,
+		cp.ID, cp.SessionID, cp.RunID, cp.NodeID, state, cp.SeqNum, meta, cp.CreatedAt, baseID,
 	)
-	return err
+	return baseID.Valid, err
 }
 
-func (s *Store) GetCheckpoint(ctx context.Context, id string) (*storage.Checkpoint, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE id=$1`, id)
-	cp := &storage.Checkpoint{}
-	var state []byte
-	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
-		return nil, err
+// encodeCheckpoint returns the stored form of cp's state: a diff against
+// base, and base's ID, if base may take another diff and the diff is
+// smaller, or else the full state.
+func (s *Store) encodeCheckpoint(cp *storage.Checkpoint, base *snapshot) ([]byte, sql.NullString, error) {
+	var baseState map[string]any
+	if base != nil && base.diffs+1 < s.snapshotInterval() {
+		baseState = base.state
 	}
-	_ = json.Unmarshal(state, &cp.State)
-	return cp, nil
+	state, isDiff, err := storage.EncodeCheckpointState(cp.State, baseState)
+	if err != nil || !isDiff {
+		return state, sql.NullString{}, err
+	}
+	return state, sql.NullString{String: base.id, Valid: true}, nil
+}
+
+func (s *Store) GetCheckpoint(ctx context.Context, id string) (*storage.Checkpoint, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+checkpointColumns+` FROM checkpoints WHERE id=$1`, id)
+	return s.resolveCheckpoint(ctx, row)
 }
 
 func (s *Store) GetLatestCheckpoint(ctx context.Context, sessionID string) (*storage.Checkpoint, error) {
 	row := s.db.QueryRowContext(ctx,
-		`SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE session_id=$1 ORDER BY created_at DESC LIMIT 1`,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=$1 ORDER BY created_at DESC, seq_num DESC LIMIT 1`,
 		sessionID,
 	)
-	cp := &storage.Checkpoint{}
-	var state []byte
-	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
-		return nil, err
-	}
-	_ = json.Unmarshal(state, &cp.State)
-	return cp, nil
+	return s.resolveCheckpoint(ctx, row)
 }
 
 func (s *Store) ListCheckpoints(ctx context.Context, sessionID string) ([]*storage.Checkpoint, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE session_id=$1 ORDER BY seq_num`,
+	return s.queryCheckpoints(ctx,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=$1 ORDER BY seq_num`,
 		sessionID,
 	)
+}
+
+// ListDueCheckpoints implements storage.TimerStore.
+func (s *Store) ListDueCheckpoints(ctx context.Context, t time.Time) ([]*storage.Checkpoint, error) {
+	return s.queryCheckpoints(ctx,
+		`SELECT `+checkpointColumns+` FROM checkpoints c
+		WHERE c.metadata->>'`+storage.WakeAtKey+`' <= $1
+		AND NOT EXISTS (SELECT 1 FROM checkpoints l WHERE l.session_id = c.session_id
+			AND (l.created_at > c.created_at OR (l.created_at = c.created_at AND l.seq_num > c.seq_num)))
+		ORDER BY c.created_at`,
+		t.UTC().Format(storage.WakeAtFormat),
+	)
+}
+
+// ListCheckpointSessions implements storage.CheckpointPruner.
+func (s *Store) ListCheckpointSessions(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT session_id FROM checkpoints ORDER BY session_id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var out []*storage.Checkpoint
+	var out []string
 	for rows.Next() {
-		cp := &storage.Checkpoint{}
-		var state []byte
-		if err := rows.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		_ = json.Unmarshal(state, &cp.State)
-		out = append(out, cp)
+		out = append(out, id)
 	}
 	return out, rows.Err()
 }
+
+// DeleteCheckpoints implements storage.CheckpointPruner. The remaining
+// checkpoints of the session are re-encoded as SaveCheckpoint would store
+// them, so that no diff refers to a deleted snapshot and states stored in
+// full become diffs; only those whose encoding changes are rewritten.
+// Checkpoints are read and written in one transaction, so that those a
+// live run saves meanwhile are kept.
+func (s *Store) DeleteCheckpoints(ctx context.Context, sessionID string, ids []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("delete checkpoints: %w", err)
+	}
+	defer tx.Rollback()
+	if err := s.deleteCheckpoints(ctx, tx, sessionID, ids); err != nil {
+		return fmt.Errorf("delete checkpoints: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) deleteCheckpoints(ctx context.Context, tx *sql.Tx, sessionID string, ids []string) error {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	// Lock the session's checkpoints, so that SaveCheckpoint waits to
+	// store a diff against one of them. Diffs committed before the lock
+	// was granted are seen by the next statement.
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM checkpoints WHERE session_id=$1 FOR UPDATE`, sessionID); err != nil {
+		return err
+	}
+	stored, err := s.queryStored(ctx, tx,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=$1 ORDER BY seq_num`, sessionID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM checkpoints WHERE id=$1 AND session_id=$2`, id, sessionID); err != nil {
+			return err
+		}
+	}
+	snapshots := make(map[string]*snapshot) // latest snapshot of each run
+	for _, sc := range stored {
+		if drop[sc.cp.ID] {
+			continue
+		}
+		base := snapshots[sc.cp.RunID]
+		_, baseID, err := s.encodeCheckpoint(sc.cp, base)
+		if err != nil {
+			return fmt.Errorf("rewrite %s: %w", sc.cp.ID, err)
+		}
+		if baseID != sc.baseID {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM checkpoints WHERE id=$1`, sc.cp.ID); err != nil {
+				return err
+			}
+			if _, err := s.insertCheckpoint(ctx, tx, sc.cp, base); err != nil {
+				return fmt.Errorf("rewrite %s: %w", sc.cp.ID, err)
+			}
+		}
+		if baseID.Valid {
+			base.diffs++
+		} else {
+			snapshots[sc.cp.RunID] = &snapshot{id: sc.cp.ID, state: sc.cp.State}
+		}
+	}
+	return nil
+}
+
+// storedCheckpoint is a checkpoint row whose state may be a diff against the
+// snapshot baseID.
+type storedCheckpoint struct {
+	cp     *storage.Checkpoint
+	state  []byte
+	baseID sql.NullString
+}
+
+// scanCheckpoint reads one checkpoint row selected with checkpointColumns.
+// Its state is decoded by resolve.
+func scanCheckpoint(row interface{ Scan(...any) error }) (*storedCheckpoint, error) {
+	sc := &storedCheckpoint{cp: &storage.Checkpoint{}}
+	cp := sc.cp
+	var meta []byte
+	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &sc.state, &cp.SeqNum, &meta, &cp.CreatedAt, &sc.baseID); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal(meta, &cp.Metadata)
+	return sc, nil
+}
+
+func (s *Store) resolveCheckpoint(ctx context.Context, row *sql.Row) (*storage.Checkpoint, error) {
+	sc, err := scanCheckpoint(row)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolve(ctx, s.db, []*storedCheckpoint{sc}); err != nil {
+		return nil, err
+	}
+	return sc.cp, nil
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+// queryCheckpoints runs a query selecting checkpointColumns and returns the
+// checkpoints with their states rebuilt.
+func (s *Store) queryCheckpoints(ctx context.Context, query string, args ...any) ([]*storage.Checkpoint, error) {
+	stored, err := s.queryStored(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*storage.Checkpoint, len(stored))
+	for i, sc := range stored {
+		out[i] = sc.cp
+	}
+	return out, nil
+}
+
+// queryStored runs a query selecting checkpointColumns on q and returns the
+// rows with their states rebuilt.
+func (s *Store) queryStored(ctx context.Context, q querier, query string, args ...any) ([]*storedCheckpoint, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var stored []*storedCheckpoint
+	for rows.Next() {
+		sc, err := scanCheckpoint(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored = append(stored, sc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.resolve(ctx, q, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// resolve decodes the states of stored, loading the snapshots that their
+// diffs refer to.
+func (s *Store) resolve(ctx context.Context, q querier, stored []*storedCheckpoint) error {
+	snapshots := make(map[string][]byte)
+	for _, sc := range stored {
+		if !sc.baseID.Valid {
+			snapshots[sc.cp.ID] = sc.state
+		}
+	}
+	for _, sc := range stored {
+		var base map[string]any
+		if sc.baseID.Valid {
+			data, ok := snapshots[sc.baseID.String]
+			if !ok {
+				if err := q.QueryRowContext(ctx, `SELECT state FROM checkpoints WHERE id=$1`, sc.baseID.String).Scan(&data); err != nil {
+					return fmt.Errorf("checkpoint %s: snapshot %s: %w", sc.cp.ID, sc.baseID.String, err)
+				}
+				snapshots[sc.baseID.String] = data
+			}
+			var err error
+			if base, err = storage.DecodeCheckpointState(data, false, nil); err != nil {
+				return err
+			}
+		}
+		if len(sc.state) == 0 {
+			continue
+		}
+		state, err := storage.DecodeCheckpointState(sc.state, sc.baseID.Valid, base)
+		if err != nil {
+			return fmt.Errorf("checkpoint %s: %w", sc.cp.ID, err)
+		}
+		sc.cp.State = state
+	}
+	return nil
+}
+
+// --- Run queue ---
+
+const queuedRunColumns = `id, kind, session_id, graph_id, checkpoint_id, input, status, worker, lease_until, attempts, error, created_at, updated_at`
+
+// EnqueueRun implements storage.RunQueue.
+func (s *Store) EnqueueRun(ctx context.Context, q *storage.QueuedRun) error {
+	input, _ := json.Marshal(q.Input)
+	status := q.Status
+	if status == "" {
+		status = "queued"
+	}
+	var leaseUntil *time.Time
+	if !q.LeaseUntil.IsZero() {
+		leaseUntil = &q.LeaseUntil
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO run_queue (`+queuedRunColumns+`) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+		ON CONFLICT (id) DO NOTHING`,
+		q.ID, q.Kind, q.SessionID, q.GraphID, q.CheckpointID, input, status, q.Worker,
+		leaseUntil, q.Attempts, q.Error, q.CreatedAt, q.CreatedAt,
+	)
+	return err
+}
+
+// GetQueuedRun implements storage.RunQueue.
+func (s *Store) GetQueuedRun(ctx context.Context, id string) (*storage.QueuedRun, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+queuedRunColumns+` FROM run_queue WHERE id=$1`, id)
+	return scanQueuedRun(row)
+}
+
+// LeaseRun implements storage.RunQueue. SKIP LOCKED lets concurrent workers
+// lease different runs without waiting on each other.
+func (s *Store) LeaseRun(ctx context.Context, worker string, graphIDs []string, ttl time.Duration) (*storage.QueuedRun, error) {
+	if len(graphIDs) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	args := []any{worker, now.Add(ttl), now}
+	placeholders := make([]string, len(graphIDs))
+	for i, id := range graphIDs {
+		args = append(args, id)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	row := s.db.QueryRowContext(ctx,
+		`UPDATE run_queue SET status='leased', worker=$1, lease_until=$2, attempts=attempts+1, updated_at=$3
+		WHERE id = (SELECT id FROM run_queue
+			WHERE graph_id IN (`+strings.Join(placeholders, ",")+`)
+			AND (status='queued' OR (status='leased' AND lease_until < $3))
+			ORDER BY created_at LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+queuedRunColumns,
+		args...,
+	)
+	q, err := scanQueuedRun(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return q, err
+}
+
+// RenewLease implements storage.RunQueue.
+func (s *Store) RenewLease(ctx context.Context, id, worker string, ttl time.Duration) error {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE run_queue SET lease_until=$1, updated_at=$2 WHERE id=$3 AND worker=$4 AND status='leased'`,
+		now.Add(ttl), now, id, worker,
+	)
+	return leaseResult(res, err)
+}
+
+// FinishRun implements storage.RunQueue.
+func (s *Store) FinishRun(ctx context.Context, id, worker, status, errMsg string) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE run_queue SET status=$1, error=$2, lease_until=NULL, updated_at=$3 WHERE id=$4 AND worker=$5 AND status='leased'`,
+		status, errMsg, time.Now(), id, worker,
+	)
+	return leaseResult(res, err)
+}
+
+// RequestCancel implements storage.RunCanceller.
+func (s *Store) RequestCancel(ctx context.Context, runID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO run_cancels (run_id, requested_at) VALUES ($1,$2) ON CONFLICT (run_id) DO NOTHING`, runID, time.Now())
+	return err
+}
+
+// CancelRequested implements storage.RunCanceller.
+func (s *Store) CancelRequested(ctx context.Context, runID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM run_cancels WHERE run_id=$1`, runID).Scan(&n)
+	return n > 0, err
+}
+
+// ClearCancel implements storage.RunCanceller.
+func (s *Store) ClearCancel(ctx context.Context, runID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM run_cancels WHERE run_id=$1`, runID)
+	return err
+}
+
+// leaseResult maps an update of a leased run that matched no row to
+// storage.ErrLeaseLost.
+func leaseResult(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+func scanQueuedRun(row interface{ Scan(...any) error }) (*storage.QueuedRun, error) {
+	q := &storage.QueuedRun{}
+	var checkpoint, worker, errMsg sql.NullString
+	var leaseUntil sql.NullTime
+	var input []byte
+	if err := row.Scan(&q.ID, &q.Kind, &q.SessionID, &q.GraphID, &checkpoint, &input, &q.Status, &worker,
+		&leaseUntil, &q.Attempts, &errMsg, &q.CreatedAt, &q.UpdatedAt); err != nil {
+		return nil, err
+	}
+	q.CheckpointID, q.Worker, q.Error = checkpoint.String, worker.String, errMsg.String
+	q.LeaseUntil = leaseUntil.Time
+	_ = json.Unmarshal(input, &q.Input)
+	return q, nil
+}
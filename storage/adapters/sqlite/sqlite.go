@@ -5,7 +5,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,6 +17,11 @@ import (
 
 // Store implements storage.Storage using SQLite.
 type Store struct {
+	// SnapshotInterval is the number of checkpoints of a run stored per
+	// full state snapshot; the others store a diff against the snapshot.
+	// 0 means storage.DefaultSnapshotInterval, 1 stores every state in full.
+	SnapshotInterval int
+
 	db *sql.DB
 }
 
@@ -84,19 +91,65 @@ func (s *Store) Migrate(ctx context.Context) error {
 			node_id TEXT NOT NULL,
 			state TEXT,
 			seq_num INTEGER NOT NULL,
+			metadata TEXT,
 			created_at DATETIME NOT NULL
 		)`,
+		`CREATE TABLE IF NOT EXISTS run_queue (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			session_id TEXT NOT NULL,
+			graph_id TEXT NOT NULL,
+			checkpoint_id TEXT,
+			input TEXT,
+			status TEXT NOT NULL,
+			worker TEXT,
+			lease_until INTEGER NOT NULL DEFAULT 0,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS run_cancels (
+			run_id TEXT PRIMARY KEY,
+			requested_at DATETIME NOT NULL
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_events_session_seq ON events(session_id, seq_num)`,
 		`CREATE INDEX IF NOT EXISTS idx_checkpoints_session ON checkpoints(session_id, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_run_queue_status ON run_queue(status, created_at)`,
 	}
 	for _, stmt := range stmts {
 		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
 			return fmt.Errorf("migrate: %w", err)
 		}
 	}
+	// Columns added after the initial schema; CREATE TABLE IF NOT EXISTS
+	// does not touch tables created by older versions.
+	if err := s.addColumn(ctx, "checkpoints", "metadata", "TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := s.addColumn(ctx, "checkpoints", "base_id", "TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_checkpoints_base ON checkpoints(base_id)`); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
 	return nil
 }
 
+// addColumn adds a column to an existing table unless it is already present.
+func (s *Store) addColumn(ctx context.Context, table, column, decl string) error {
+	var n int
+	row := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, table, column)
+	if err := row.Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
 func (s *Store) Close() error { return s.db.Close() }
 
 // --- Sessions ---
@@ -316,58 +369,436 @@ func (s *Store) ListEvents(ctx context.Context, sessionID string, afterSeq int64
 
 // --- Checkpoints ---
 
+// A checkpoint's state is stored in full (a snapshot) or, when base_id is
+// set, as a storage.StateDiff against the snapshot base_id of the same run.
+
+const checkpointColumns = `id, session_id, run_id, node_id, state, seq_num, metadata, created_at, base_id`
+
+// snapshot is the latest full state of a run and the number of diffs
+// stored against it.
+type snapshot struct {
+	id    string
+	state map[string]any
+	diffs int
+}
+
+func (s *Store) snapshotInterval() int {
+	if s.SnapshotInterval > 0 {
+		return s.SnapshotInterval
+	}
+	return storage.DefaultSnapshotInterval
+}
+
 func (s *Store) SaveCheckpoint(ctx context.Context, cp *storage.Checkpoint) error {
-	state, _ := json.Marshal(cp.State)
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO checkpoints (id, session_id, run_id, node_id, state, seq_num, created_at) VALUES (?,?,?,?,?,?,?)`,
-		cp.ID, cp.SessionID, cp.RunID, cp.NodeID, string(state), cp.SeqNum, cp.CreatedAt,
-	)
+	var base *snapshot
+	if s.snapshotInterval() > 1 {
+		var id, state string
+		var diffs int
+		err := s.db.QueryRowContext(ctx,
+			`SELECT c.id, c.state, (SELECT COUNT(*) FROM checkpoints d WHERE d.base_id = c.id)
+			FROM checkpoints c WHERE c.session_id=? AND c.run_id=? AND c.base_id IS NULL
+			ORDER BY c.seq_num DESC LIMIT 1`,
+			cp.SessionID, cp.RunID,
+		).Scan(&id, &state, &diffs)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		default:
+			base = &snapshot{id: id, diffs: diffs}
+			if base.state, err = storage.DecodeCheckpointState([]byte(state), false, nil); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := s.insertCheckpoint(ctx, s.db, cp, base)
 	return err
 }
 
-func (s *Store) GetCheckpoint(ctx context.Context, id string) (*storage.Checkpoint, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE id=?`, id)
-	cp := &storage.Checkpoint{}
-	var state string
-	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
-		return nil, err
+// insertCheckpoint stores cp encoded with encodeCheckpoint. It reports
+// whether a diff was stored.
+func (s *Store) insertCheckpoint(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, cp *storage.Checkpoint, base *snapshot) (bool, error) {
+	state, baseID, err := s.encodeCheckpoint(cp, base)
+	if err != nil {
+		return false, err
+	}
+	meta, _ := json.Marshal(cp.Metadata)
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO checkpoints (`+checkpointColumns+`) VALUES (?,?,?,?,?,?,?,?,?)`,
+		cp.ID, cp.SessionID, cp.RunID, cp.NodeID, string(state), cp.SeqNum, string(meta), cp.CreatedAt, baseID,
+	)
+	return baseID.Valid, err
+}
+
+// encodeCheckpoint returns the stored form of cp's state: a diff against
+// base, and base's ID, if base may take another diff and the diff is
+// smaller, or else the full state.
+func (s *Store) encodeCheckpoint(cp *storage.Checkpoint, base *snapshot) ([]byte, sql.NullString, error) {
+	var baseState map[string]any
+	if base != nil && base.diffs+1 < s.snapshotInterval() {
+		baseState = base.state
+	}
+	state, isDiff, err := storage.EncodeCheckpointState(cp.State, baseState)
+	if err != nil || !isDiff {
+		return state, sql.NullString{}, err
 	}
-	_ = json.Unmarshal([]byte(state), &cp.State)
-	return cp, nil
+	return state, sql.NullString{String: base.id, Valid: true}, nil
+}
+
+func (s *Store) GetCheckpoint(ctx context.Context, id string) (*storage.Checkpoint, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+checkpointColumns+` FROM checkpoints WHERE id=?`, id)
+	return s.resolveCheckpoint(ctx, row)
 }
 
 func (s *Store) GetLatestCheckpoint(ctx context.Context, sessionID string) (*storage.Checkpoint, error) {
 	row := s.db.QueryRowContext(ctx,
-		`SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE session_id=? ORDER BY created_at DESC LIMIT 1`,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=? ORDER BY created_at DESC, seq_num DESC LIMIT 1`,
 		sessionID,
 	)
-	cp := &storage.Checkpoint{}
-	var state string
-	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
-		return nil, err
-	}
-	_ = json.Unmarshal([]byte(state), &cp.State)
-	return cp, nil
+	return s.resolveCheckpoint(ctx, row)
 }
 
 func (s *Store) ListCheckpoints(ctx context.Context, sessionID string) ([]*storage.Checkpoint, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, session_id, run_id, node_id, state, seq_num, created_at FROM checkpoints WHERE session_id=? ORDER BY seq_num`,
+	return s.queryCheckpoints(ctx,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=? ORDER BY seq_num`,
 		sessionID,
 	)
+}
+
+// ListCheckpointSessions implements storage.CheckpointPruner.
+func (s *Store) ListCheckpointSessions(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT session_id FROM checkpoints ORDER BY session_id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var out []*storage.Checkpoint
+	var out []string
 	for rows.Next() {
-		cp := &storage.Checkpoint{}
-		var state string
-		if err := rows.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &state, &cp.SeqNum, &cp.CreatedAt); err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		_ = json.Unmarshal([]byte(state), &cp.State)
-		out = append(out, cp)
+		out = append(out, id)
 	}
 	return out, rows.Err()
 }
+
+// DeleteCheckpoints implements storage.CheckpointPruner. The remaining
+// checkpoints of the session are re-encoded as SaveCheckpoint would store
+// them, so that no diff refers to a deleted snapshot and states stored in
+// full become diffs; only those whose encoding changes are rewritten.
+// Checkpoints are read and written in one transaction, so that those a
+// live run saves meanwhile are kept.
+func (s *Store) DeleteCheckpoints(ctx context.Context, sessionID string, ids []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("delete checkpoints: %w", err)
+	}
+	defer tx.Rollback()
+	if err := s.deleteCheckpoints(ctx, tx, sessionID, ids); err != nil {
+		return fmt.Errorf("delete checkpoints: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) deleteCheckpoints(ctx context.Context, tx *sql.Tx, sessionID string, ids []string) error {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	stored, err := s.queryStored(ctx, tx,
+		`SELECT `+checkpointColumns+` FROM checkpoints WHERE session_id=? ORDER BY seq_num`, sessionID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM checkpoints WHERE id=? AND session_id=?`, id, sessionID); err != nil {
+			return err
+		}
+	}
+	snapshots := make(map[string]*snapshot) // latest snapshot of each run
+	for _, sc := range stored {
+		if drop[sc.cp.ID] {
+			continue
+		}
+		base := snapshots[sc.cp.RunID]
+		_, baseID, err := s.encodeCheckpoint(sc.cp, base)
+		if err != nil {
+			return fmt.Errorf("rewrite %s: %w", sc.cp.ID, err)
+		}
+		if baseID != sc.baseID {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM checkpoints WHERE id=?`, sc.cp.ID); err != nil {
+				return err
+			}
+			if _, err := s.insertCheckpoint(ctx, tx, sc.cp, base); err != nil {
+				return fmt.Errorf("rewrite %s: %w", sc.cp.ID, err)
+			}
+		}
+		if baseID.Valid {
+			base.diffs++
+		} else {
+			snapshots[sc.cp.RunID] = &snapshot{id: sc.cp.ID, state: sc.cp.State}
+		}
+	}
+	return nil
+}
+
+// ListDueCheckpoints implements storage.TimerStore.
+func (s *Store) ListDueCheckpoints(ctx context.Context, t time.Time) ([]*storage.Checkpoint, error) {
+	return s.queryCheckpoints(ctx,
+		`SELECT `+checkpointColumns+` FROM checkpoints c
+		WHERE json_extract(c.metadata, '$.`+storage.WakeAtKey+`') <= ?
+		AND NOT EXISTS (SELECT 1 FROM checkpoints l WHERE l.session_id = c.session_id
+			AND (l.created_at > c.created_at OR (l.created_at = c.created_at AND l.seq_num > c.seq_num)))
+		ORDER BY c.created_at`,
+		t.UTC().Format(storage.WakeAtFormat),
+	)
+}
+
+// Vacuum rebuilds the database file, returning the space of deleted rows
+// to the file system.
+func (s *Store) Vacuum(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+// storedCheckpoint is a checkpoint row whose state may be a diff against the
+// snapshot baseID.
+type storedCheckpoint struct {
+	cp     *storage.Checkpoint
+	state  string
+	baseID sql.NullString
+}
+
+// scanCheckpoint reads one checkpoint row selected with checkpointColumns.
+// Its state is decoded by resolve.
+func scanCheckpoint(row interface{ Scan(...any) error }) (*storedCheckpoint, error) {
+	sc := &storedCheckpoint{cp: &storage.Checkpoint{}}
+	cp := sc.cp
+	var meta sql.NullString
+	if err := row.Scan(&cp.ID, &cp.SessionID, &cp.RunID, &cp.NodeID, &sc.state, &cp.SeqNum, &meta, &cp.CreatedAt, &sc.baseID); err != nil {
+		return nil, err
+	}
+	if meta.Valid {
+		_ = json.Unmarshal([]byte(meta.String), &cp.Metadata)
+	}
+	return sc, nil
+}
+
+func (s *Store) resolveCheckpoint(ctx context.Context, row *sql.Row) (*storage.Checkpoint, error) {
+	sc, err := scanCheckpoint(row)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolve(ctx, s.db, []*storedCheckpoint{sc}); err != nil {
+		return nil, err
+	}
+	return sc.cp, nil
+}
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+// queryCheckpoints runs a query selecting checkpointColumns and returns the
+// checkpoints with their states rebuilt.
+func (s *Store) queryCheckpoints(ctx context.Context, query string, args ...any) ([]*storage.Checkpoint, error) {
+	stored, err := s.queryStored(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*storage.Checkpoint, len(stored))
+	for i, sc := range stored {
+		out[i] = sc.cp
+	}
+	return out, nil
+}
+
+// queryStored runs a query selecting checkpointColumns on q and returns the
+// rows with their states rebuilt.
+func (s *Store) queryStored(ctx context.Context, q querier, query string, args ...any) ([]*storedCheckpoint, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var stored []*storedCheckpoint
+	for rows.Next() {
+		sc, err := scanCheckpoint(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored = append(stored, sc)
+	}
+	// The rows hold the only connection until closed; resolve may query.
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.resolve(ctx, q, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// resolve decodes the states of stored, loading the snapshots that their
+// diffs refer to.
+func (s *Store) resolve(ctx context.Context, q querier, stored []*storedCheckpoint) error {
+	snapshots := make(map[string]string)
+	for _, sc := range stored {
+		if !sc.baseID.Valid {
+			snapshots[sc.cp.ID] = sc.state
+		}
+	}
+	for _, sc := range stored {
+		var base map[string]any
+		if sc.baseID.Valid {
+			data, ok := snapshots[sc.baseID.String]
+			if !ok {
+				if err := q.QueryRowContext(ctx, `SELECT state FROM checkpoints WHERE id=?`, sc.baseID.String).Scan(&data); err != nil {
+					return fmt.Errorf("checkpoint %s: snapshot %s: %w", sc.cp.ID, sc.baseID.String, err)
+				}
+				snapshots[sc.baseID.String] = data
+			}
+			var err error
+			if base, err = storage.DecodeCheckpointState([]byte(data), false, nil); err != nil {
+				return err
+			}
+		}
+		state, err := storage.DecodeCheckpointState([]byte(sc.state), sc.baseID.Valid, base)
+		if err != nil {
+			return fmt.Errorf("checkpoint %s: %w", sc.cp.ID, err)
+		}
+		sc.cp.State = state
+	}
+	return nil
+}
+
+// --- Run queue ---
+
+// lease_until is stored in Unix milliseconds so that leases compare
+// numerically.
+const queuedRunColumns = `id, kind, session_id, graph_id, checkpoint_id, input, status, worker, lease_until, attempts, error, created_at, updated_at`
+
+// EnqueueRun implements storage.RunQueue.
+func (s *Store) EnqueueRun(ctx context.Context, q *storage.QueuedRun) error {
+	input, _ := json.Marshal(q.Input)
+	status := q.Status
+	if status == "" {
+		status = "queued"
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO run_queue (`+queuedRunColumns+`) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		q.ID, q.Kind, q.SessionID, q.GraphID, q.CheckpointID, string(input), status, q.Worker,
+		q.LeaseUntil.UnixMilli(), q.Attempts, q.Error, q.CreatedAt, q.CreatedAt,
+	)
+	return err
+}
+
+// GetQueuedRun implements storage.RunQueue.
+func (s *Store) GetQueuedRun(ctx context.Context, id string) (*storage.QueuedRun, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+queuedRunColumns+` FROM run_queue WHERE id=?`, id)
+	return scanQueuedRun(row)
+}
+
+// LeaseRun implements storage.RunQueue.
+func (s *Store) LeaseRun(ctx context.Context, worker string, graphIDs []string, ttl time.Duration) (*storage.QueuedRun, error) {
+	if len(graphIDs) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	args := []any{worker, now.Add(ttl).UnixMilli(), now}
+	for _, id := range graphIDs {
+		args = append(args, id)
+	}
+	args = append(args, now.UnixMilli())
+	row := s.db.QueryRowContext(ctx,
+		`UPDATE run_queue SET status='leased', worker=?, lease_until=?, attempts=attempts+1, updated_at=?
+		WHERE id = (SELECT id FROM run_queue
+			WHERE graph_id IN (?`+strings.Repeat(",?", len(graphIDs)-1)+`)
+			AND (status='queued' OR (status='leased' AND lease_until < ?))
+			ORDER BY created_at LIMIT 1)
+		RETURNING `+queuedRunColumns,
+		args...,
+	)
+	q, err := scanQueuedRun(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return q, err
+}
+
+// RenewLease implements storage.RunQueue.
+func (s *Store) RenewLease(ctx context.Context, id, worker string, ttl time.Duration) error {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE run_queue SET lease_until=?, updated_at=? WHERE id=? AND worker=? AND status='leased'`,
+		now.Add(ttl).UnixMilli(), now, id, worker,
+	)
+	return leaseResult(res, err)
+}
+
+// FinishRun implements storage.RunQueue.
+func (s *Store) FinishRun(ctx context.Context, id, worker, status, errMsg string) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE run_queue SET status=?, error=?, lease_until=0, updated_at=? WHERE id=? AND worker=? AND status='leased'`,
+		status, errMsg, time.Now(), id, worker,
+	)
+	return leaseResult(res, err)
+}
+
+// RequestCancel implements storage.RunCanceller.
+func (s *Store) RequestCancel(ctx context.Context, runID string) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO run_cancels (run_id, requested_at) VALUES (?,?)`, runID, time.Now())
+	return err
+}
+
+// CancelRequested implements storage.RunCanceller.
+func (s *Store) CancelRequested(ctx context.Context, runID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM run_cancels WHERE run_id=?`, runID).Scan(&n)
+	return n > 0, err
+}
+
+// ClearCancel implements storage.RunCanceller.
+func (s *Store) ClearCancel(ctx context.Context, runID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM run_cancels WHERE run_id=?`, runID)
+	return err
+}
+
+// leaseResult maps an update of a leased run that matched no row to
+// storage.ErrLeaseLost.
+func leaseResult(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+func scanQueuedRun(row interface{ Scan(...any) error }) (*storage.QueuedRun, error) {
+	q := &storage.QueuedRun{}
+	var checkpoint, input, worker, errMsg sql.NullString
+	var leaseUntil int64
+	if err := row.Scan(&q.ID, &q.Kind, &q.SessionID, &q.GraphID, &checkpoint, &input, &q.Status, &worker,
+		&leaseUntil, &q.Attempts, &errMsg, &q.CreatedAt, &q.UpdatedAt); err != nil {
+		return nil, err
+	}
+	q.CheckpointID, q.Worker, q.Error = checkpoint.String, worker.String, errMsg.String
+	if leaseUntil > 0 {
+		q.LeaseUntil = time.UnixMilli(leaseUntil)
+	}
+	if input.Valid {
+		_ = json.Unmarshal([]byte(input.String), &q.Input)
+	}
+	return q, nil
+}
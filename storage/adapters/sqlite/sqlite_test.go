@@ -2,6 +2,10 @@ package sqlite
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -148,6 +152,159 @@ func TestCheckpointCRUD(t *testing.T) {
 	}
 }
 
+func TestCheckpointDiffs(t *testing.T) {
+	store := newTestStore(t)
+	store.SnapshotInterval = 3
+	ctx := context.Background()
+	now := time.Now()
+
+	want := make(map[string]map[string]any)
+	state := map[string]any{"doc": strings.Repeat("x", 200), "tmp": true}
+	for i := 1; i <= 7; i++ {
+		state = map[string]any{"doc": state["doc"], "step": float64(i), "items": []any{"a", float64(i)}}
+		if i%2 == 1 {
+			state["tmp"] = true
+		}
+		cp := &storage.Checkpoint{
+			ID: fmt.Sprintf("cp%d", i), SessionID: "s1", RunID: "r1", NodeID: "n",
+			SeqNum: int64(i), State: state, CreatedAt: now.Add(time.Duration(i) * time.Second),
+		}
+		if err := store.SaveCheckpoint(ctx, cp); err != nil {
+			t.Fatalf("SaveCheckpoint: %v", err)
+		}
+		want[cp.ID] = state
+	}
+
+	var diffs int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM checkpoints WHERE base_id IS NOT NULL`).Scan(&diffs); err != nil {
+		t.Fatal(err)
+	}
+	if diffs != 4 {
+		t.Fatalf("expected 4 diff checkpoints with a snapshot every 3, got %d", diffs)
+	}
+
+	check := func(dropped ...string) {
+		t.Helper()
+		cps, err := store.ListCheckpoints(ctx, "s1")
+		if err != nil {
+			t.Fatalf("ListCheckpoints: %v", err)
+		}
+		if len(cps) != len(want)-len(dropped) {
+			t.Fatalf("expected %d checkpoints, got %d", len(want)-len(dropped), len(cps))
+		}
+		for _, cp := range cps {
+			got, err := store.GetCheckpoint(ctx, cp.ID)
+			if err != nil {
+				t.Fatalf("GetCheckpoint(%s): %v", cp.ID, err)
+			}
+			if !reflect.DeepEqual(cp.State, want[cp.ID]) || !reflect.DeepEqual(got.State, want[cp.ID]) {
+				t.Fatalf("checkpoint %s: expected state %v, got %v and %v", cp.ID, want[cp.ID], cp.State, got.State)
+			}
+		}
+	}
+	check()
+
+	rowid := func(id string) int64 {
+		t.Helper()
+		var n int64
+		if err := store.db.QueryRow(`SELECT rowid FROM checkpoints WHERE id=?`, id).Scan(&n); err != nil {
+			t.Fatalf("rowid of %s: %v", id, err)
+		}
+		return n
+	}
+	untouched := rowid("cp2")
+
+	// Deleting a snapshot re-encodes the diffs that referred to it, and
+	// leaves the checkpoints before it in place.
+	if err := store.DeleteCheckpoints(ctx, "s1", []string{"cp4"}); err != nil {
+		t.Fatalf("DeleteCheckpoints: %v", err)
+	}
+	check("cp4")
+	if rowid("cp2") != untouched {
+		t.Error("expected checkpoints whose encoding is unchanged to be left in place")
+	}
+	if err := store.DeleteCheckpoints(ctx, "s1", []string{"cp1"}); err != nil {
+		t.Fatalf("DeleteCheckpoints: %v", err)
+	}
+	check("cp1", "cp4")
+	latest, err := store.GetLatestCheckpoint(ctx, "s1")
+	if err != nil || latest.ID != "cp7" || !reflect.DeepEqual(latest.State, want["cp7"]) {
+		t.Fatalf("expected latest checkpoint cp7 with its state, got %v, %v", latest, err)
+	}
+}
+
+func TestListDueCheckpoints(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	wake := func(d time.Duration) map[string]any {
+		return map[string]any{storage.WakeAtKey: now.Add(d).UTC().Format(storage.WakeAtFormat)}
+	}
+	cps := []*storage.Checkpoint{
+		{ID: "due", SessionID: "s1", RunID: "r1", NodeID: "wait", SeqNum: 1, Metadata: wake(-time.Minute), CreatedAt: now},
+		{ID: "later", SessionID: "s2", RunID: "r2", NodeID: "wait", SeqNum: 1, Metadata: wake(time.Hour), CreatedAt: now},
+		{ID: "woken", SessionID: "s3", RunID: "r3", NodeID: "wait", SeqNum: 1, Metadata: wake(-time.Hour), CreatedAt: now},
+		{ID: "after", SessionID: "s3", RunID: "r3", NodeID: "next", SeqNum: 2, CreatedAt: now.Add(time.Second)},
+	}
+	for _, cp := range cps {
+		if err := store.SaveCheckpoint(ctx, cp); err != nil {
+			t.Fatalf("SaveCheckpoint: %v", err)
+		}
+	}
+
+	due, err := store.ListDueCheckpoints(ctx, now)
+	if err != nil {
+		t.Fatalf("ListDueCheckpoints: %v", err)
+	}
+	if len(due) != 1 || due[0].ID != "due" {
+		t.Fatalf("expected only checkpoint 'due', got %v", due)
+	}
+}
+
+func TestRunQueueLeases(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	q := &storage.QueuedRun{ID: "q1", Kind: "run", SessionID: "s1", GraphID: "g", Input: map[string]any{"n": 1.0}, CreatedAt: time.Now()}
+	if err := store.EnqueueRun(ctx, q); err != nil {
+		t.Fatalf("EnqueueRun: %v", err)
+	}
+	if err := store.EnqueueRun(ctx, &storage.QueuedRun{ID: "q1", Kind: "run", SessionID: "other", GraphID: "g", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("EnqueueRun duplicate: %v", err)
+	}
+
+	if got, err := store.LeaseRun(ctx, "w1", []string{"other"}, time.Minute); err != nil || got != nil {
+		t.Fatalf("expected no run for unknown graphs, got %v, %v", got, err)
+	}
+	got, err := store.LeaseRun(ctx, "w1", []string{"g"}, 20*time.Millisecond)
+	if err != nil || got == nil {
+		t.Fatalf("LeaseRun: %v, %v", got, err)
+	}
+	if got.SessionID != "s1" || got.Worker != "w1" || got.Status != "leased" || got.Attempts != 1 || got.Input["n"] != 1.0 {
+		t.Fatalf("unexpected leased run: %+v", got)
+	}
+	if again, _ := store.LeaseRun(ctx, "w2", []string{"g"}, time.Minute); again != nil {
+		t.Fatalf("expected the leased run to be unavailable, got %+v", again)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	taken, err := store.LeaseRun(ctx, "w2", []string{"g"}, time.Minute)
+	if err != nil || taken == nil || taken.Worker != "w2" || taken.Attempts != 2 {
+		t.Fatalf("expected w2 to take over the expired lease, got %+v, %v", taken, err)
+	}
+	if err := store.RenewLease(ctx, "q1", "w1", time.Minute); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost renewing a lost lease, got %v", err)
+	}
+	if err := store.FinishRun(ctx, "q1", "w1", "completed", ""); !errors.Is(err, storage.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost finishing a lost lease, got %v", err)
+	}
+	if err := store.FinishRun(ctx, "q1", "w2", "completed", ""); err != nil {
+		t.Fatalf("FinishRun: %v", err)
+	}
+	if done, _ := store.GetQueuedRun(ctx, "q1"); done.Status != "completed" {
+		t.Errorf("expected status completed, got %q", done.Status)
+	}
+}
+
 func TestEventCRUD(t *testing.T) {
 	store := newTestStore(t)
 	ctx := context.Background()
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultSnapshotInterval is the number of checkpoints of a run stored per
+// full state snapshot: the checkpoints in between store their state as a
+// diff against the snapshot.
+const DefaultSnapshotInterval = 10
+
+// CheckpointPruner is implemented by stores that can delete checkpoints.
+// Stores that keep checkpoint state as diffs re-encode the checkpoints that
+// remain, so that every checkpoint still rebuilds its exact state.
+type CheckpointPruner interface {
+	// ListCheckpointSessions returns the IDs of the sessions that have
+	// checkpoints.
+	ListCheckpointSessions(ctx context.Context) ([]string, error)
+	// DeleteCheckpoints deletes the checkpoints ids of sessionID. With no
+	// ids, the session's checkpoints are only re-encoded.
+	DeleteCheckpoints(ctx context.Context, sessionID string, ids []string) error
+}
+
+// StateDiff is a checkpoint state stored as its changes to a snapshot.
+type StateDiff struct {
+	Set   map[string]any `json:"set,omitempty"`
+	Unset []string       `json:"unset,omitempty"`
+}
+
+// DiffState returns the changes that turn base into state. Values are
+// compared in their JSON encoding, so a value that only changed its Go type
+// in a round trip through storage is not part of the diff.
+func DiffState(base, state map[string]any) (*StateDiff, error) {
+	d := &StateDiff{Set: make(map[string]any)}
+	for k, v := range state {
+		old, ok := base[k]
+		if ok {
+			a, err := json.Marshal(old)
+			if err != nil {
+				return nil, fmt.Errorf("diff state key %q: %w", k, err)
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("diff state key %q: %w", k, err)
+			}
+			if bytes.Equal(a, b) {
+				continue
+			}
+		}
+		d.Set[k] = v
+	}
+	for k := range base {
+		if _, ok := state[k]; !ok {
+			d.Unset = append(d.Unset, k)
+		}
+	}
+	return d, nil
+}
+
+// Apply returns base with the diff applied. base is not modified.
+func (d *StateDiff) Apply(base map[string]any) map[string]any {
+	out := make(map[string]any, len(base)+len(d.Set))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range d.Set {
+		out[k] = v
+	}
+	for _, k := range d.Unset {
+		delete(out, k)
+	}
+	return out
+}
+
+// EncodeCheckpointState returns the stored form of a checkpoint's state:
+// its diff against base if base is not nil and the diff is smaller than the
+// state, and the state itself otherwise. isDiff reports which was chosen.
+func EncodeCheckpointState(state, base map[string]any) (data []byte, isDiff bool, err error) {
+	full, err := json.Marshal(state)
+	if err != nil || base == nil || state == nil {
+		return full, false, err
+	}
+	d, err := DiffState(base, state)
+	if err != nil {
+		return nil, false, err
+	}
+	diff, err := json.Marshal(d)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(diff) >= len(full) {
+		return full, false, nil
+	}
+	return diff, true, nil
+}
+
+// DecodeCheckpointState rebuilds a checkpoint's state from its stored form:
+// a diff against base if isDiff is set, and the state itself otherwise.
+func DecodeCheckpointState(data []byte, isDiff bool, base map[string]any) (map[string]any, error) {
+	if !isDiff {
+		var state map[string]any
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("decode checkpoint state: %w", err)
+		}
+		return state, nil
+	}
+	var d StateDiff
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("decode checkpoint diff: %w", err)
+	}
+	return d.Apply(base), nil
+}
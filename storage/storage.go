@@ -3,6 +3,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -71,9 +72,82 @@ type Checkpoint struct {
 	NodeID    string         `json:"node_id"`
 	State     map[string]any `json:"state"`
 	SeqNum    int64          `json:"seq_num"`
+	Metadata  map[string]any `json:"metadata,omitempty"` // runner bookkeeping (branch, next node, ...)
 	CreatedAt time.Time      `json:"created_at"`
 }
 
+// WakeAtKey is the checkpoint metadata key holding the time a run suspended
+// on a durable timer wakes up, formatted with WakeAtFormat so that the
+// stored strings sort in time order.
+const (
+	WakeAtKey    = "wake_at"
+	WakeAtFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+// TimerStore is implemented by stores that can find runs suspended on a
+// durable timer across sessions. Schedulers use it to resume due runs.
+type TimerStore interface {
+	// ListDueCheckpoints returns the latest checkpoint of each session
+	// whose wake-up time is at or before t.
+	ListDueCheckpoints(ctx context.Context, t time.Time) ([]*Checkpoint, error)
+}
+
+// QueuedRun is a graph run waiting in a RunQueue for a worker.
+type QueuedRun struct {
+	ID           string         `json:"id"`
+	Kind         string         `json:"kind"` // run, resume
+	SessionID    string         `json:"session_id"`
+	GraphID      string         `json:"graph_id"`
+	CheckpointID string         `json:"checkpoint_id,omitempty"` // latest checkpoint of the session when enqueued
+	Input        map[string]any `json:"input,omitempty"`
+	Status       string         `json:"status"` // queued, leased, or the status the run finished with
+	Worker       string         `json:"worker,omitempty"`
+	LeaseUntil   time.Time      `json:"lease_until,omitempty"`
+	Attempts     int            `json:"attempts"`
+	Error        string         `json:"error,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// ErrLeaseLost is returned when a worker's lease on a queued run has been
+// taken over by another worker.
+var ErrLeaseLost = errors.New("lease lost")
+
+// RunQueue is implemented by stores that can queue graph runs for a pool of
+// workers. A worker leases a run for a limited time and renews the lease
+// while it executes; a run whose lease expires is leased again by another
+// worker.
+type RunQueue interface {
+	// EnqueueRun adds q to the queue. A run with the same ID is left as is.
+	EnqueueRun(ctx context.Context, q *QueuedRun) error
+	// GetQueuedRun returns the queued run with the given ID.
+	GetQueuedRun(ctx context.Context, id string) (*QueuedRun, error)
+	// LeaseRun leases the oldest run of one of graphIDs that is queued or
+	// whose lease has expired to worker for ttl. It returns nil and no error
+	// when there is no such run.
+	LeaseRun(ctx context.Context, worker string, graphIDs []string, ttl time.Duration) (*QueuedRun, error)
+	// RenewLease extends worker's lease on run id by ttl from now. It
+	// returns ErrLeaseLost if the run is no longer leased to worker.
+	RenewLease(ctx context.Context, id, worker string, ttl time.Duration) error
+	// FinishRun records the status a run leased to worker ended with and
+	// releases the lease; status "queued" hands the run back to the queue.
+	// It returns ErrLeaseLost if the run is no longer leased to worker.
+	FinishRun(ctx context.Context, id, worker, status, errMsg string) error
+}
+
+// RunCanceller is implemented by stores that record requests to cancel
+// graph runs, so that a run can be cancelled from a process other than the
+// one executing it.
+type RunCanceller interface {
+	// RequestCancel records a request to cancel run runID.
+	RequestCancel(ctx context.Context, runID string) error
+	// CancelRequested reports whether a request to cancel runID is
+	// recorded.
+	CancelRequested(ctx context.Context, runID string) (bool, error)
+	// ClearCancel removes the request to cancel runID, if any.
+	ClearCancel(ctx context.Context, runID string) error
+}
+
 // Storage is the primary persistence interface. All adapters must implement this.
 type Storage interface {
 	// Sessions